@@ -0,0 +1,254 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventVerified is a discord user verified for the first time
+	EventVerified = "verified"
+	// EventUpgrade is a discord user moving up a tier
+	EventUpgrade = "upgrade"
+	// EventDowngrade is a discord user moving down a tier or losing their tier
+	EventDowngrade = "downgrade"
+
+	defaultRatePerMinute = 10
+	defaultQueueSize     = 100
+)
+
+type (
+	// Config configures announcements, events not listed use the default templates and
+	// are enabled except for downgrades
+	Config struct {
+		RatePerMinute int                 `json:"ratePerMinute"`
+		QueueSize     int                 `json:"queueSize"`
+		Events        map[string]Template `json:"events"`
+	}
+
+	// Template is the embed posted for an event, Title and Description are text/template
+	// templates executed with the Event
+	Template struct {
+		Enabled     *bool  `json:"enabled"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Color       int    `json:"color"`
+	}
+
+	// Event is something that happened to a holder. Tier and PreviousTier are role mentions,
+	// empty without a tier
+	Event struct {
+		Kind              string
+		DiscordUserID     string
+		Username          string
+		Mention           string
+		Tier              string
+		PreviousTier      string
+		NumAssets         int
+		PreviousNumAssets int
+	}
+
+	// Sender posts embeds, a discordgo session
+	Sender interface {
+		ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	}
+
+	// Announcer posts events to a channel, queued and rate limited so a full verify pass
+	// doesn't flood the channel. Events are only queued while it runs
+	Announcer struct {
+		sender    Sender
+		channelID string
+		templates map[string]compiledTemplate
+		queue     chan *discordgo.MessageEmbed
+		interval  time.Duration
+		running   int32
+	}
+
+	compiledTemplate struct {
+		title       *template.Template
+		description *template.Template
+		color       int
+	}
+)
+
+// LoadConfig loads announcement config from a json file
+func LoadConfig(path string) (Config, error) {
+	config := Config{}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(bytes, &config)
+	if err != nil {
+		return config, fmt.Errorf("Error parsing announcements %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// NewAnnouncer compiles the templates for enabled events, falling back to defaults for
+// any title or description the config leaves empty
+func NewAnnouncer(sender Sender, channelID string, config Config, defaults map[string]Template) (*Announcer, error) {
+	if config.RatePerMinute <= 0 {
+		config.RatePerMinute = defaultRatePerMinute
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	announcer := Announcer{
+		sender:    sender,
+		channelID: channelID,
+		templates: make(map[string]compiledTemplate),
+		queue:     make(chan *discordgo.MessageEmbed, config.QueueSize),
+		interval:  time.Minute / time.Duration(config.RatePerMinute),
+	}
+
+	for _, kind := range []string{EventVerified, EventUpgrade, EventDowngrade} {
+		configured := config.Events[kind]
+		enabled := kind != EventDowngrade
+		if configured.Enabled != nil {
+			enabled = *configured.Enabled
+		}
+		if !enabled {
+			continue
+		}
+
+		if configured.Title == "" {
+			configured.Title = defaults[kind].Title
+		}
+		if configured.Description == "" {
+			configured.Description = defaults[kind].Description
+		}
+		if configured.Color == 0 {
+			configured.Color = defaults[kind].Color
+		}
+
+		title, err := template.New(kind + " title").Parse(configured.Title)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s announcement title: %v", kind, err)
+		}
+		description, err := template.New(kind + " description").Parse(configured.Description)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s announcement description: %v", kind, err)
+		}
+		announcer.templates[kind] = compiledTemplate{title: title, description: description, color: configured.Color}
+	}
+
+	for kind := range config.Events {
+		if kind != EventVerified && kind != EventUpgrade && kind != EventDowngrade {
+			return nil, fmt.Errorf("Unknown announcement event %s", kind)
+		}
+	}
+
+	return &announcer, nil
+}
+
+// Enabled checks if an event kind is announced
+func (a *Announcer) Enabled(kind string) bool {
+	if a == nil {
+		return false
+	}
+	_, ok := a.templates[kind]
+	return ok
+}
+
+// Announce queues an event, it never blocks and drops the event if the queue is full
+func (a *Announcer) Announce(event Event) {
+	if !a.Enabled(event.Kind) {
+		return
+	}
+	log := logrus.WithField("discord_user_id", event.DiscordUserID).WithField("announcement", event.Kind)
+
+	if event.Mention == "" {
+		event.Mention = "<@" + event.DiscordUserID + ">"
+	}
+	embed, err := a.templates[event.Kind].render(event)
+	if err != nil {
+		log.WithError(err).Error("Error rendering announcement")
+		return
+	}
+
+	if atomic.LoadInt32(&a.running) == 0 {
+		log.Info("Announcer not running on this replica, dropping announcement")
+		return
+	}
+
+	select {
+	case a.queue <- embed:
+	default:
+		log.Warn("Announcement queue full, dropping announcement")
+	}
+}
+
+// Run posts queued announcements no faster than the rate limit until the context is canceled,
+// then drops what is left
+func (a *Announcer) Run(ctx context.Context) {
+	atomic.StoreInt32(&a.running, 1)
+	defer a.stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case embed := <-a.queue:
+			_, err := a.sender.ChannelMessageSendEmbed(a.channelID, embed)
+			if err != nil {
+				logrus.WithError(err).Error("Error posting announcement")
+			}
+			if !lifecycle.Sleep(ctx, a.interval) {
+				return
+			}
+		}
+	}
+}
+
+// stop stops queueing and empties the queue, so a later Run doesn't post stale events
+func (a *Announcer) stop() {
+	atomic.StoreInt32(&a.running, 0)
+
+	dropped := 0
+	for {
+		select {
+		case <-a.queue:
+			dropped++
+		default:
+			if dropped > 0 {
+				logrus.Warnf("Dropped %d queued announcements on stopping", dropped)
+			}
+			return
+		}
+	}
+}
+
+func (t compiledTemplate) render(event Event) (*discordgo.MessageEmbed, error) {
+	title := bytes.Buffer{}
+	err := t.title.Execute(&title, event)
+	if err != nil {
+		return nil, err
+	}
+
+	description := bytes.Buffer{}
+	err = t.description.Execute(&description, event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       title.String(),
+		Description: description.String(),
+		Color:       t.color,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
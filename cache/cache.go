@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Cache holds values by key and field for a time, deleting a key drops all its fields
+	Cache interface {
+		Get(ctx context.Context, key, field string) ([]byte, bool, error)
+		Set(ctx context.Context, key, field string, value []byte, ttl time.Duration) error
+		Delete(ctx context.Context, key string) error
+	}
+
+	// Memory keeps entries in memory, evicting the least recently used keys past its size
+	Memory struct {
+		mu      sync.Mutex
+		size    int
+		order   *list.List
+		entries map[string]*list.Element
+	}
+
+	memoryEntry struct {
+		key    string
+		fields map[string]memoryField
+	}
+
+	memoryField struct {
+		value   []byte
+		expires time.Time
+	}
+)
+
+// NewMemory creates an in memory cache holding up to size keys
+func NewMemory(size int) *Memory {
+	return &Memory{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of a field if it hasn't expired
+func (m *Memory) Get(ctx context.Context, key, field string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryEntry)
+	value, ok := entry.fields[field]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(value.expires) {
+		delete(entry.fields, field)
+		if len(entry.fields) == 0 {
+			m.order.Remove(element)
+			delete(m.entries, key)
+		}
+		return nil, false, nil
+	}
+	m.order.MoveToFront(element)
+
+	return value.value, true, nil
+}
+
+// Set stores the value of a field for ttl
+func (m *Memory) Set(ctx context.Context, key, field string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if ok {
+		m.order.MoveToFront(element)
+	} else {
+		element = m.order.PushFront(&memoryEntry{key: key, fields: make(map[string]memoryField)})
+		m.entries[key] = element
+	}
+	element.Value.(*memoryEntry).fields[field] = memoryField{value: value, expires: time.Now().Add(ttl)}
+
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+
+	return nil
+}
+
+// Delete drops a key with all its fields
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if ok {
+		m.order.Remove(element)
+		delete(m.entries, key)
+	}
+
+	return nil
+}
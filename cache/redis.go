@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis keeps entries in a redis compatible server, a hash per key with the expiry stored in
+// front of each value since hash fields can't expire on their own
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis creates a cache for a redis://[:password@]host:port[/db] url, keys are prefixed
+// with prefix and every command gets timeout
+func NewRedis(redisURL, prefix string, timeout time.Duration) (*Redis, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("Redis url should be redis://[:password@]host:port[/db]: %v", err)
+	}
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+
+	return &Redis{client: redis.NewClient(options), prefix: prefix}, nil
+}
+
+// Get returns the value of a field if it hasn't expired
+func (r *Redis) Get(ctx context.Context, key, field string) ([]byte, bool, error) {
+	stored, err := r.client.HGet(ctx, r.prefix+key, field).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(stored) < 8 {
+		return nil, false, fmt.Errorf("Unexpected cached value of %d bytes", len(stored))
+	}
+
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(stored[:8]))*int64(time.Millisecond))
+	if time.Now().After(expires) {
+		return nil, false, nil
+	}
+
+	return stored[8:], true, nil
+}
+
+// Set stores the value of a field for ttl, the whole key expires ttl after its last set. The
+// field and the expiry are set in one transaction so a key is never left without a ttl
+func (r *Redis) Set(ctx context.Context, key, field string, value []byte, ttl time.Duration) error {
+	stored := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(stored, uint64(time.Now().Add(ttl).UnixNano()/int64(time.Millisecond)))
+	stored = append(stored, value...)
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.prefix+key, field, stored)
+		pipe.PExpire(ctx, r.prefix+key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// Delete drops a key with all its fields
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Close closes the connections
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,165 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a request gets unless the client sets its own
+const DefaultTimeout = 30 * time.Second
+
+type (
+	// Client looks up on chain data
+	Client interface {
+		GetAccount(ctx context.Context, stakeAddress string) (*Account, error)
+	}
+
+	// BlockfrostClient struct to hold a client for a blockfrost compatible api
+	BlockfrostClient struct {
+		HttpClient http.Client
+		BaseUrl    string
+		ProjectID  string
+		Timeout    time.Duration
+	}
+
+	// CachedClient remembers the accounts it got, for looking up the same stake addresses
+	// several times in one run. Errors aren't cached
+	CachedClient struct {
+		client   Client
+		mu       sync.Mutex
+		accounts map[string]*Account
+	}
+
+	// Account struct to hold a stake account, ControlledAmount is in lovelace
+	Account struct {
+		StakeAddress     string `json:"stake_address"`
+		Active           bool   `json:"active"`
+		PoolID           string `json:"pool_id"`
+		ControlledAmount string `json:"controlled_amount"`
+	}
+
+	// StubClient serves accounts from memory, for running without a chain data provider
+	StubClient map[string]Account
+)
+
+//NewClient create new blockfrost client for the api at baseURL
+func NewClient(baseURL, projectID string) BlockfrostClient {
+	client := BlockfrostClient{
+		HttpClient: http.Client{},
+		BaseUrl:    baseURL,
+		ProjectID:  projectID,
+		Timeout:    DefaultTimeout,
+	}
+
+	return client
+}
+
+//GetAccount gets the delegation and balance of a stake address, nil if it's not on chain
+func (client BlockfrostClient) GetAccount(ctx context.Context, stakeAddress string) (*Account, error) {
+	logrus.Info("Getting stake account")
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/accounts/%s", client.BaseUrl, stakeAddress), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("project_id", client.ProjectID)
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		logrus.WithError(err).Error("Error posting request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logrus.Errorf("Error getting stake account %d", resp.StatusCode)
+		return nil, fmt.Errorf("Error getting stake account %d", resp.StatusCode)
+	}
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	account := Account{}
+	err = json.Unmarshal(bytes, &account)
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+//GetAccount gets a stub account, nil if it's not known
+func (client StubClient) GetAccount(ctx context.Context, stakeAddress string) (*Account, error) {
+	account, ok := client[stakeAddress]
+	if !ok {
+		return nil, nil
+	}
+
+	return &account, nil
+}
+
+//NewCachedClient caches the accounts client gets until the cached client is dropped
+func NewCachedClient(client Client) *CachedClient {
+	return &CachedClient{
+		client:   client,
+		accounts: make(map[string]*Account),
+	}
+}
+
+//GetAccount gets the account from the cache, or from the client the first time
+func (client *CachedClient) GetAccount(ctx context.Context, stakeAddress string) (*Account, error) {
+	client.mu.Lock()
+	account, ok := client.accounts[stakeAddress]
+	client.mu.Unlock()
+	if ok {
+		return account, nil
+	}
+
+	account, err := client.client.GetAccount(ctx, stakeAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	client.mu.Lock()
+	client.accounts[stakeAddress] = account
+	client.mu.Unlock()
+
+	return account, nil
+}
+
+//LoadStubClient loads stub accounts from a json list of accounts
+func LoadStubClient(path string) (StubClient, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]Account, 0)
+	err = json.Unmarshal(bytes, &accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	client := make(StubClient)
+	for _, account := range accounts {
+		client[account.StakeAddress] = account
+	}
+
+	return client, nil
+}
@@ -0,0 +1,521 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// redacted replaces secrets when printing the config
+	redacted = "<redacted>"
+
+	// CacheMemory caches in each replica's memory
+	CacheMemory = "memory"
+	// CacheRedis caches in a redis compatible server
+	CacheRedis = "redis"
+
+	// LinkPolicyUnlimited lets an nftkeyme account unlock roles for any number of discord users
+	LinkPolicyUnlimited = "unlimited"
+	// LinkPolicyExclusive rejects linking an nftkeyme account already linked to another discord user
+	LinkPolicyExclusive = "exclusive"
+	// LinkPolicyAllow lets an nftkeyme account be linked to at most N discord users
+	LinkPolicyAllow = "allow"
+	// LinkPolicyTransfer moves an nftkeyme account to the discord user who linked it last
+	LinkPolicyTransfer = "transfer"
+)
+
+type (
+	// Config holds everything the service is configured with. Values come from an optional
+	// yaml or toml file, then env vars named in the env tags override them
+	Config struct {
+		Database      Database      `yaml:"database" toml:"database"`
+		Discord       Discord       `yaml:"discord" toml:"discord"`
+		Nftkeyme      Nftkeyme      `yaml:"nftkeyme" toml:"nftkeyme"`
+		Blockfrost    Blockfrost    `yaml:"blockfrost" toml:"blockfrost"`
+		Server        Server        `yaml:"server" toml:"server"`
+		Collections   Collections   `yaml:"collections" toml:"collections"`
+		Roles         Roles         `yaml:"roles" toml:"roles"`
+		Announcements Announcements `yaml:"announcements" toml:"announcements"`
+		Leaderboard   Leaderboard   `yaml:"leaderboard" toml:"leaderboard"`
+		Reload        Reload        `yaml:"reload" toml:"reload"`
+		Leader        Leader        `yaml:"leader" toml:"leader"`
+		Cache         Cache         `yaml:"cache" toml:"cache"`
+	}
+
+	// Database holds the postgres connection
+	Database struct {
+		Addr string `yaml:"addr" toml:"addr" env:"DB_ADDR"`
+		Port int    `yaml:"port" toml:"port" env:"DB_PORT"`
+		User string `yaml:"user" toml:"user" env:"DB_USER"`
+		Pass string `yaml:"pass" toml:"pass" env:"DB_PASS" secret:"true"`
+		Name string `yaml:"name" toml:"name" env:"DB_NAME"`
+		SSL  bool   `yaml:"ssl" toml:"ssl" env:"DB_SSL"`
+	}
+
+	// Discord holds the oauth app, the bot and the server it manages. RoleMap is
+	// <min assets>:<role id> pairs separated by commas
+	Discord struct {
+		URL          string `yaml:"url" toml:"url" env:"DISCORD_URL"`
+		ClientID     string `yaml:"clientId" toml:"clientId" env:"DISCORD_CLIENT_ID"`
+		ClientSecret string `yaml:"clientSecret" toml:"clientSecret" env:"DISCORD_CLIENT_SECRET" secret:"true"`
+		RedirectURL  string `yaml:"redirectUrl" toml:"redirectUrl" env:"DISCORD_REDIRECT_URL"`
+		AuthURL      string `yaml:"authUrl" toml:"authUrl" env:"DISCORD_AUTH_URL"`
+		TokenURL     string `yaml:"tokenUrl" toml:"tokenUrl" env:"DISCORD_TOKEN_URL"`
+		BotToken     string `yaml:"botToken" toml:"botToken" env:"DISCORD_BOT_TOKEN" secret:"true"`
+		ServerID     string `yaml:"serverId" toml:"serverId" env:"DISCORD_SERVER_ID"`
+		ChannelID    string `yaml:"channelId" toml:"channelId" env:"DISCORD_CHANNEL_ID"`
+		RoleMap      string `yaml:"roleMap" toml:"roleMap" env:"DISCORD_ROLE_MAP"`
+
+		Roles map[int]string `yaml:"-" toml:"-"`
+	}
+
+	// Nftkeyme holds the nftkeyme oauth app and api, the client defaults are used for a page
+	// size or max response size of 0. Fetched assets are reused for AssetCacheTTL, 0s to
+	// always fetch
+	Nftkeyme struct {
+		URL          string `yaml:"url" toml:"url" env:"NFTKEYME_URL"`
+		RevokeURL    string `yaml:"revokeUrl" toml:"revokeUrl" env:"NFTKEYME_REVOKE_URL"`
+		ClientID     string `yaml:"clientId" toml:"clientId" env:"NFTKEYME_CLIENT_ID"`
+		ClientSecret string `yaml:"clientSecret" toml:"clientSecret" env:"NFTKEYME_CLIENT_SECRET" secret:"true"`
+		RedirectURL  string `yaml:"redirectUrl" toml:"redirectUrl" env:"NFTKEYME_REDIRECT_URL"`
+		AuthURL      string `yaml:"authUrl" toml:"authUrl" env:"NFTKEYME_AUTH_URL"`
+		TokenURL     string `yaml:"tokenUrl" toml:"tokenUrl" env:"NFTKEYME_TOKEN_URL"`
+
+		PageSize         int    `yaml:"pageSize" toml:"pageSize" env:"NFTKEYME_PAGE_SIZE"`
+		MaxResponseBytes int    `yaml:"maxResponseBytes" toml:"maxResponseBytes" env:"NFTKEYME_MAX_RESPONSE_BYTES"`
+		AssetCacheTTL    string `yaml:"assetCacheTtl" toml:"assetCacheTtl" env:"NFTKEYME_ASSET_CACHE_TTL"`
+
+		AssetCache time.Duration `yaml:"-" toml:"-"`
+	}
+
+	// Blockfrost holds the chain data api used by delegation rules
+	Blockfrost struct {
+		URL       string `yaml:"url" toml:"url" env:"BLOCKFROST_URL"`
+		ProjectID string `yaml:"projectId" toml:"projectId" env:"BLOCKFROST_PROJECT_ID" secret:"true"`
+	}
+
+	// Server holds the web server, AllowedOrigins is comma separated. ShutdownTimeout is how
+	// long requests and background work get to finish on shutdown
+	Server struct {
+		Port            int    `yaml:"port" toml:"port" env:"NFTKEYME_SERVICE_PORT"`
+		AllowedOrigins  string `yaml:"allowedOrigins" toml:"allowedOrigins" env:"ALLOWED_ORIGINS"`
+		AdminAPIKey     string `yaml:"adminApiKey" toml:"adminApiKey" env:"ADMIN_API_KEY" secret:"true"`
+		SessionSecret   string `yaml:"sessionSecret" toml:"sessionSecret" env:"SESSION_SECRET" secret:"true"`
+		ShutdownTimeout string `yaml:"shutdownTimeout" toml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+
+		Origins []string      `yaml:"-" toml:"-"`
+		Drain   time.Duration `yaml:"-" toml:"-"`
+	}
+
+	// Collections holds the policies counted for tiers
+	Collections struct {
+		PolicyIDCheck        string `yaml:"policyIdCheck" toml:"policyIdCheck" env:"POLICY_ID_CHECK"`
+		PolicyIDCheckHunters string `yaml:"policyIdCheckHunters" toml:"policyIdCheckHunters" env:"POLICY_ID_CHECK_HUNTERS"`
+	}
+
+	// Roles holds role rules and what they need, RaritySnapshots is <policy id>=<path>
+	// pairs separated by commas
+	Roles struct {
+		RulesFile       string `yaml:"rulesFile" toml:"rulesFile" env:"ROLE_RULES_FILE"`
+		RaritySnapshots string `yaml:"raritySnapshots" toml:"raritySnapshots" env:"RARITY_SNAPSHOTS"`
+		ChainStubFile   string `yaml:"chainStubFile" toml:"chainStubFile" env:"CHAIN_STUB_FILE"`
+		LinkPolicy      string `yaml:"linkPolicy" toml:"linkPolicy" env:"LINK_POLICY"`
+
+		Snapshots map[string]string `yaml:"-" toml:"-"`
+	}
+
+	// Announcements holds the announcement templates file
+	Announcements struct {
+		File string `yaml:"file" toml:"file" env:"ANNOUNCEMENTS_FILE"`
+	}
+
+	// Leaderboard holds the leaderboard size and how often it is posted, never if empty
+	Leaderboard struct {
+		Size         int    `yaml:"size" toml:"size" env:"LEADERBOARD_SIZE"`
+		PostInterval string `yaml:"postInterval" toml:"postInterval" env:"LEADERBOARD_POST_INTERVAL"`
+
+		Interval time.Duration `yaml:"-" toml:"-"`
+	}
+
+	// Reload holds how often the config and role files are checked for changes, never if
+	// empty, and if linked users are verified again after a reload
+	Reload struct {
+		WatchInterval string `yaml:"watchInterval" toml:"watchInterval" env:"RELOAD_WATCH_INTERVAL"`
+		Reconcile     bool   `yaml:"reconcile" toml:"reconcile" env:"RELOAD_RECONCILE"`
+
+		Interval time.Duration `yaml:"-" toml:"-"`
+	}
+
+	// Leader holds the postgres advisory lock replicas compete for to run the background
+	// workers, and how often they try for it
+	Leader struct {
+		LockKey          int    `yaml:"lockKey" toml:"lockKey" env:"LEADER_LOCK_KEY"`
+		ElectionInterval string `yaml:"electionInterval" toml:"electionInterval" env:"LEADER_ELECTION_INTERVAL"`
+
+		Interval time.Duration `yaml:"-" toml:"-"`
+	}
+
+	// Cache holds where fetched assets are cached, memory keeps up to Size nftkeyme accounts
+	// per replica and redis is shared by every replica through RedisURL
+	Cache struct {
+		Backend  string `yaml:"backend" toml:"backend" env:"CACHE_BACKEND"`
+		Size     int    `yaml:"size" toml:"size" env:"CACHE_SIZE"`
+		RedisURL string `yaml:"redisUrl" toml:"redisUrl" env:"CACHE_REDIS_URL" secret:"true"`
+	}
+)
+
+// Default returns the config before the file and env vars are applied
+func Default() Config {
+	return Config{
+		Database: Database{Port: 5432},
+		Server:   Server{Port: 8080, ShutdownTimeout: "30s"},
+		Nftkeyme: Nftkeyme{AssetCacheTTL: "60s"},
+		Leader:   Leader{LockKey: 7260321, ElectionInterval: "15s"},
+		Cache:    Cache{Backend: CacheMemory, Size: 1000},
+	}
+}
+
+// Load reads the config file if path isn't empty, applies env vars and validates the result
+func Load(path string) (Config, error) {
+	config := Default()
+	if path != "" {
+		err := config.readFile(path)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err := applyEnv(reflect.ValueOf(&config).Elem())
+	if err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+// readFile reads a yaml or toml file depending on its extension
+func (c *Config) readFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(bytes, c)
+	case ".toml":
+		_, err = toml.Decode(string(bytes), c)
+	default:
+		return fmt.Errorf("Config file %s should be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides fields with their env var when it is set and not empty
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := fieldType.Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a number, got %q", name, value)
+			}
+			field.SetInt(int64(number))
+		case reflect.Bool:
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false, got %q", name, value)
+			}
+			field.SetBool(flag)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks every field and parses the derived ones, reporting all problems at once
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	required := func(value, name string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+
+	if err := c.Database.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	required(c.Discord.URL, "DISCORD_URL (discord.url)")
+	required(c.Discord.ClientID, "DISCORD_CLIENT_ID (discord.clientId)")
+	required(c.Discord.ClientSecret, "DISCORD_CLIENT_SECRET (discord.clientSecret)")
+	required(c.Discord.RedirectURL, "DISCORD_REDIRECT_URL (discord.redirectUrl)")
+	required(c.Discord.AuthURL, "DISCORD_AUTH_URL (discord.authUrl)")
+	required(c.Discord.TokenURL, "DISCORD_TOKEN_URL (discord.tokenUrl)")
+	required(c.Discord.BotToken, "DISCORD_BOT_TOKEN (discord.botToken)")
+	required(c.Discord.ServerID, "DISCORD_SERVER_ID (discord.serverId)")
+	required(c.Discord.ChannelID, "DISCORD_CHANNEL_ID (discord.channelId)")
+	required(c.Discord.RoleMap, "DISCORD_ROLE_MAP (discord.roleMap)")
+	if c.Discord.RoleMap != "" {
+		roles, err := ParseRoleMap(c.Discord.RoleMap)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("DISCORD_ROLE_MAP (discord.roleMap): %v", err))
+		}
+		c.Discord.Roles = roles
+	}
+
+	required(c.Nftkeyme.URL, "NFTKEYME_URL (nftkeyme.url)")
+	required(c.Nftkeyme.ClientID, "NFTKEYME_CLIENT_ID (nftkeyme.clientId)")
+	required(c.Nftkeyme.ClientSecret, "NFTKEYME_CLIENT_SECRET (nftkeyme.clientSecret)")
+	required(c.Nftkeyme.RedirectURL, "NFTKEYME_REDIRECT_URL (nftkeyme.redirectUrl)")
+	required(c.Nftkeyme.AuthURL, "NFTKEYME_AUTH_URL (nftkeyme.authUrl)")
+	required(c.Nftkeyme.TokenURL, "NFTKEYME_TOKEN_URL (nftkeyme.tokenUrl)")
+
+	if c.Nftkeyme.PageSize < 0 || c.Nftkeyme.MaxResponseBytes < 0 {
+		problems = append(problems, "NFTKEYME_PAGE_SIZE (nftkeyme.pageSize) and NFTKEYME_MAX_RESPONSE_BYTES (nftkeyme.maxResponseBytes) can't be negative")
+	}
+
+	assetCache, err := time.ParseDuration(c.Nftkeyme.AssetCacheTTL)
+	if err != nil || assetCache < 0 {
+		problems = append(problems, fmt.Sprintf("NFTKEYME_ASSET_CACHE_TTL (nftkeyme.assetCacheTtl) should be a duration like 60s, got %q", c.Nftkeyme.AssetCacheTTL))
+	}
+	c.Nftkeyme.AssetCache = assetCache
+
+	if c.Blockfrost.ProjectID != "" {
+		required(c.Blockfrost.URL, "BLOCKFROST_URL (blockfrost.url) when a project id is set")
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("NFTKEYME_SERVICE_PORT (server.port) should be between 1 and 65535, got %d", c.Server.Port))
+	}
+	c.Server.Origins = splitList(c.Server.AllowedOrigins)
+	drain, err := time.ParseDuration(c.Server.ShutdownTimeout)
+	if err != nil || drain <= 0 {
+		problems = append(problems, fmt.Sprintf("SHUTDOWN_TIMEOUT (server.shutdownTimeout) should be a duration like 30s, got %q", c.Server.ShutdownTimeout))
+	}
+	c.Server.Drain = drain
+
+	required(c.Collections.PolicyIDCheck, "POLICY_ID_CHECK (collections.policyIdCheck)")
+	required(c.Collections.PolicyIDCheckHunters, "POLICY_ID_CHECK_HUNTERS (collections.policyIdCheckHunters)")
+
+	_, _, err = ParseLinkPolicy(c.Roles.LinkPolicy)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("LINK_POLICY (roles.linkPolicy): %v", err))
+	}
+
+	snapshots, err := ParseSnapshots(c.Roles.RaritySnapshots)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("RARITY_SNAPSHOTS (roles.raritySnapshots): %v", err))
+	}
+	c.Roles.Snapshots = snapshots
+
+	if c.Leaderboard.Size < 0 {
+		problems = append(problems, fmt.Sprintf("LEADERBOARD_SIZE (leaderboard.size) can't be negative, got %d", c.Leaderboard.Size))
+	}
+	c.Leaderboard.Interval = 0
+	if c.Leaderboard.PostInterval != "" {
+		interval, err := time.ParseDuration(c.Leaderboard.PostInterval)
+		if err != nil || interval <= 0 {
+			problems = append(problems, fmt.Sprintf("LEADERBOARD_POST_INTERVAL (leaderboard.postInterval) should be a duration like 168h, got %q", c.Leaderboard.PostInterval))
+		}
+		c.Leaderboard.Interval = interval
+	}
+
+	c.Reload.Interval = 0
+	if c.Reload.WatchInterval != "" {
+		interval, err := time.ParseDuration(c.Reload.WatchInterval)
+		if err != nil || interval <= 0 {
+			problems = append(problems, fmt.Sprintf("RELOAD_WATCH_INTERVAL (reload.watchInterval) should be a duration like 30s, got %q", c.Reload.WatchInterval))
+		}
+		c.Reload.Interval = interval
+	}
+
+	leaderInterval, err := time.ParseDuration(c.Leader.ElectionInterval)
+	if err != nil || leaderInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("LEADER_ELECTION_INTERVAL (leader.electionInterval) should be a duration like 15s, got %q", c.Leader.ElectionInterval))
+	}
+	c.Leader.Interval = leaderInterval
+
+	switch c.Cache.Backend {
+	case CacheMemory:
+		if c.Cache.Size < 1 {
+			problems = append(problems, fmt.Sprintf("CACHE_SIZE (cache.size) should be at least 1, got %d", c.Cache.Size))
+		}
+	case CacheRedis:
+		required(c.Cache.RedisURL, "CACHE_REDIS_URL (cache.redisUrl) for the redis cache")
+	default:
+		problems = append(problems, fmt.Sprintf("CACHE_BACKEND (cache.backend) should be %s or %s, got %q", CacheMemory, CacheRedis, c.Cache.Backend))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Validate checks the database settings, for commands that only need the database
+func (d Database) Validate() error {
+	problems := make([]string, 0)
+	for _, field := range []struct{ value, name string }{
+		{d.Addr, "DB_ADDR (database.addr)"},
+		{d.User, "DB_USER (database.user)"},
+		{d.Name, "DB_NAME (database.name)"},
+	} {
+		if field.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", field.name))
+		}
+	}
+	if d.Port < 1 || d.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("DB_PORT (database.port) should be between 1 and 65535, got %d", d.Port))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ParseRoleMap parses <min assets>:<role id> pairs separated by commas
+func ParseRoleMap(roleMap string) (map[int]string, error) {
+	roles := make(map[int]string)
+	for _, pair := range splitList(roleMap) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("%q should be <min assets>:<role id>", pair)
+		}
+		minAssets, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || minAssets < 0 {
+			return nil, fmt.Errorf("%q should start with a number of assets", pair)
+		}
+		if _, ok := roles[minAssets]; ok {
+			return nil, fmt.Errorf("%d assets is mapped more than once", minAssets)
+		}
+		roles[minAssets] = strings.TrimSpace(parts[1])
+	}
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("no roles")
+	}
+
+	return roles, nil
+}
+
+// ParseLinkPolicy parses unlimited, exclusive, allow:N or transfer, empty is unlimited. It
+// returns the mode and how many discord users an nftkeyme account can be linked to, 0 for any
+func ParseLinkPolicy(policy string) (string, int, error) {
+	parts := strings.SplitN(strings.TrimSpace(policy), ":", 2)
+	switch parts[0] {
+	case "", LinkPolicyUnlimited:
+		return LinkPolicyUnlimited, 0, nil
+	case LinkPolicyExclusive:
+		return LinkPolicyExclusive, 1, nil
+	case LinkPolicyTransfer:
+		return LinkPolicyTransfer, 1, nil
+	case LinkPolicyAllow:
+		if len(parts) != 2 {
+			return "", 0, fmt.Errorf("Link policy allow needs a limit, e.g. allow:2")
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max < 1 {
+			return "", 0, fmt.Errorf("Invalid link policy limit %s", parts[1])
+		}
+		return LinkPolicyAllow, max, nil
+	}
+
+	return "", 0, fmt.Errorf("Unknown link policy %s", policy)
+}
+
+// ParseSnapshots parses <policy id>=<path> pairs separated by commas
+func ParseSnapshots(snapshots string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, pair := range splitList(snapshots) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q should be <policy id>=<path>", pair)
+		}
+		paths[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return paths, nil
+}
+
+// DataSourceName returns the postgres connection string
+func (d Database) DataSourceName() string {
+	sslmode := "disable"
+	if d.SSL {
+		sslmode = "require"
+	}
+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", d.Addr, d.Port, d.User, d.Pass, d.Name, sslmode)
+}
+
+// Redacted returns a copy with secrets that are set replaced, for printing
+func (c Config) Redacted() Config {
+	redactSecrets(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+func redactSecrets(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redactSecrets(field)
+			continue
+		}
+		if v.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(redacted)
+		}
+	}
+}
+
+// YAML returns the config as yaml
+func (c Config) YAML() (string, error) {
+	bytes, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testYAML = `database:
+  addr: localhost
+  user: discord
+  pass: secret
+  name: nftkeyme
+discord:
+  url: https://discord.com/api
+  clientId: discord-client
+  clientSecret: discord-secret
+  redirectUrl: http://localhost:8080/discord/callback
+  authUrl: https://discord.com/api/oauth2/authorize
+  tokenUrl: https://discord.com/api/oauth2/token
+  botToken: bot-token
+  serverId: "123"
+  channelId: "456"
+  roleMap: "1:role-holder,5:role-whale"
+nftkeyme:
+  url: https://nftkeyme.example/api
+  clientId: nftkeyme-client
+  clientSecret: nftkeyme-secret
+  redirectUrl: http://localhost:8080/nftkeyme/callback
+  authUrl: https://nftkeyme.example/oauth/authorize
+  tokenUrl: https://nftkeyme.example/oauth/token
+  assetCacheTtl: 30s
+server:
+  port: 8081
+  allowedOrigins: "https://a.example, https://b.example"
+  shutdownTimeout: 10s
+collections:
+  policyIdCheck: policy-chains
+  policyIdCheckHunters: policy-hunters
+roles:
+  raritySnapshots: "policy-chains=chains.csv"
+  linkPolicy: allow:2
+leaderboard:
+  size: 10
+  postInterval: 168h
+reload:
+  watchInterval: 30s
+  reconcile: true
+`
+
+const testTOML = `[database]
+addr = "localhost"
+user = "discord"
+pass = "secret"
+name = "nftkeyme"
+
+[discord]
+url = "https://discord.com/api"
+clientId = "discord-client"
+clientSecret = "discord-secret"
+redirectUrl = "http://localhost:8080/discord/callback"
+authUrl = "https://discord.com/api/oauth2/authorize"
+tokenUrl = "https://discord.com/api/oauth2/token"
+botToken = "bot-token"
+serverId = "123"
+channelId = "456"
+roleMap = "1:role-holder,5:role-whale"
+
+[nftkeyme]
+url = "https://nftkeyme.example/api"
+clientId = "nftkeyme-client"
+clientSecret = "nftkeyme-secret"
+redirectUrl = "http://localhost:8080/nftkeyme/callback"
+authUrl = "https://nftkeyme.example/oauth/authorize"
+tokenUrl = "https://nftkeyme.example/oauth/token"
+assetCacheTtl = "30s"
+
+[server]
+port = 8081
+allowedOrigins = "https://a.example, https://b.example"
+shutdownTimeout = "10s"
+
+[collections]
+policyIdCheck = "policy-chains"
+policyIdCheckHunters = "policy-hunters"
+
+[roles]
+raritySnapshots = "policy-chains=chains.csv"
+linkPolicy = "allow:2"
+
+[leaderboard]
+size = 10
+postInterval = "168h"
+
+[reload]
+watchInterval = "30s"
+reconcile = true
+`
+
+// clearEnv unsets every env var the config reads for the test, so the environment the
+// tests run in doesn't leak in
+func clearEnv(t *testing.T) {
+	for _, name := range envNames(reflect.TypeOf(Config{})) {
+		setEnv(t, name, "")
+	}
+}
+
+func envNames(configType reflect.Type) []string {
+	names := make([]string, 0)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			names = append(names, envNames(field.Type)...)
+			continue
+		}
+		if name := field.Tag.Get("env"); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func setEnv(t *testing.T, name, value string) {
+	previous, set := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// withoutLine drops the line setting key from a config file
+func withoutLine(content, key string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), key) {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestLoadYAMLAndTOMLMatch(t *testing.T) {
+	clearEnv(t)
+
+	fromYAML, err := Load(writeConfig(t, "config.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromTOML, err := Load(writeConfig(t, "config.toml", testTOML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fromYAML, fromTOML) {
+		t.Errorf("yaml and toml differ:\n%+v\n%+v", fromYAML, fromTOML)
+	}
+
+	// derived fields are parsed and defaults kept
+	if fromYAML.Database.Port != 5432 || fromYAML.Leader.LockKey != 7260321 || fromYAML.Cache.Backend != CacheMemory {
+		t.Errorf("defaults not kept: %+v", fromYAML)
+	}
+	if !reflect.DeepEqual(fromYAML.Discord.Roles, map[int]string{1: "role-holder", 5: "role-whale"}) {
+		t.Errorf("got role map %v", fromYAML.Discord.Roles)
+	}
+	if !reflect.DeepEqual(fromYAML.Server.Origins, []string{"https://a.example", "https://b.example"}) {
+		t.Errorf("got origins %v", fromYAML.Server.Origins)
+	}
+	if fromYAML.Nftkeyme.AssetCache != 30*time.Second || fromYAML.Server.Drain != 10*time.Second ||
+		fromYAML.Leaderboard.Interval != 168*time.Hour || fromYAML.Reload.Interval != 30*time.Second ||
+		fromYAML.Leader.Interval != 15*time.Second {
+		t.Errorf("durations not parsed: %+v", fromYAML)
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c Config) bool
+	}{
+		{"string", map[string]string{"DISCORD_CHANNEL_ID": "789"}, func(c Config) bool {
+			return c.Discord.ChannelID == "789"
+		}},
+		{"number", map[string]string{"NFTKEYME_SERVICE_PORT": "9090"}, func(c Config) bool {
+			return c.Server.Port == 9090
+		}},
+		{"bool", map[string]string{"RELOAD_RECONCILE": "false"}, func(c Config) bool {
+			return !c.Reload.Reconcile
+		}},
+		{"derived field", map[string]string{"DISCORD_ROLE_MAP": "3:role-three"}, func(c Config) bool {
+			return reflect.DeepEqual(c.Discord.Roles, map[int]string{3: "role-three"})
+		}},
+		{"duration", map[string]string{"SHUTDOWN_TIMEOUT": "1m"}, func(c Config) bool {
+			return c.Server.Drain == time.Minute
+		}},
+		{"empty keeps the file value", map[string]string{"DB_ADDR": ""}, func(c Config) bool {
+			return c.Database.Addr == "localhost"
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.env {
+				setEnv(t, name, value)
+			}
+
+			c, err := Load(writeConfig(t, "config.yaml", testYAML))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(c) {
+				t.Errorf("env %v not applied: %+v", test.env, c)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		problem string
+	}{
+		{"missing bot token", withoutLine(testYAML, "botToken:"), nil, "DISCORD_BOT_TOKEN (discord.botToken) is required"},
+		{"missing database", withoutLine(testYAML, "addr:"), nil, "DB_ADDR (database.addr) is required"},
+		{"missing policy", withoutLine(testYAML, "policyIdCheckHunters:"), nil, "POLICY_ID_CHECK_HUNTERS (collections.policyIdCheckHunters) is required"},
+		{"unknown link policy", testYAML, map[string]string{"LINK_POLICY": "sometimes"}, "LINK_POLICY (roles.linkPolicy): Unknown link policy"},
+		{"link policy without limit", testYAML, map[string]string{"LINK_POLICY": "allow"}, "LINK_POLICY (roles.linkPolicy): Link policy allow needs a limit"},
+		{"link policy limit below 1", testYAML, map[string]string{"LINK_POLICY": "allow:0"}, "LINK_POLICY (roles.linkPolicy): Invalid link policy limit"},
+		{"invalid shutdown timeout", testYAML, map[string]string{"SHUTDOWN_TIMEOUT": "soon"}, "SHUTDOWN_TIMEOUT (server.shutdownTimeout) should be a duration"},
+		{"negative cache ttl", testYAML, map[string]string{"NFTKEYME_ASSET_CACHE_TTL": "-1s"}, "NFTKEYME_ASSET_CACHE_TTL (nftkeyme.assetCacheTtl) should be a duration"},
+		{"zero post interval", testYAML, map[string]string{"LEADERBOARD_POST_INTERVAL": "0s"}, "LEADERBOARD_POST_INTERVAL (leaderboard.postInterval) should be a duration"},
+		{"invalid watch interval", testYAML, map[string]string{"RELOAD_WATCH_INTERVAL": "often"}, "RELOAD_WATCH_INTERVAL (reload.watchInterval) should be a duration"},
+		{"invalid port", testYAML, map[string]string{"NFTKEYME_SERVICE_PORT": "port"}, "NFTKEYME_SERVICE_PORT should be a number"},
+		{"invalid role map", testYAML, map[string]string{"DISCORD_ROLE_MAP": "many:role"}, "DISCORD_ROLE_MAP (discord.roleMap)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.env {
+				setEnv(t, name, value)
+			}
+
+			_, err := Load(writeConfig(t, "config.yaml", test.content))
+			if err == nil {
+				t.Fatal("loaded an invalid config")
+			}
+			if !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("got %v, want a problem with %q", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestLoadUnknownExtension(t *testing.T) {
+	clearEnv(t)
+
+	_, err := Load(writeConfig(t, "config.json", "{}"))
+	if err == nil || !strings.Contains(err.Error(), "should be .yaml, .yml or .toml") {
+		t.Errorf("got %v, want the extension rejected", err)
+	}
+}
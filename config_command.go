@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/reliablestaking/nftkeyme-discord/config"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+)
+
+// runConfigCheck prints the effective config with secrets redacted and any problems with it,
+// returning the exit code. The files the config points to are loaded the way startup loads them
+func runConfigCheck(configFile string) int {
+	cfg, err := config.Load(configFile)
+
+	problems := make([]string, 0)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	_, roleConfigErr := loadRoleConfig(cfg)
+	if roleConfigErr != nil {
+		problems = append(problems, fmt.Sprintf("Role config: %v", roleConfigErr))
+	}
+	messages, messagesErr := i18n.LoadBundle("locales", "en")
+	if messagesErr != nil {
+		problems = append(problems, fmt.Sprintf("Message catalogs: %v", messagesErr))
+	} else {
+		_, announcerErr := loadAnnouncer(cfg, messages, nil)
+		if announcerErr != nil {
+			problems = append(problems, fmt.Sprintf("Announcements: %v", announcerErr))
+		}
+	}
+
+	effective, yamlErr := cfg.Redacted().YAML()
+	if yamlErr != nil {
+		fmt.Fprintf(os.Stderr, "Error printing config: %v\n", yamlErr)
+		return 1
+	}
+	fmt.Print(effective)
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "Config OK")
+	return 0
+}
@@ -9,4 +9,112 @@ create table discord_user (
     nftkeyme_refresh_token     varchar(128),
     num_assets                 integer,
     UNIQUE(discord_user_id)
-);
\ No newline at end of file
+);
+
+alter table discord_user add column if not exists locale varchar(16);
+
+create table if not exists audit_event (
+    id                         serial PRIMARY KEY,
+    created_at                 timestamp not null default now(),
+    action                     varchar(64) not null,
+    discord_user_id            varchar(64),
+    actor                      varchar(128) not null,
+    detail                     text not null default ''
+);
+
+create table if not exists nftkeyme_link (
+    id                         serial PRIMARY KEY,
+    discord_user_id            varchar(64) not null references discord_user(discord_user_id) on delete cascade,
+    nftkeyme_id                varchar(128) not null,
+    nftkeyme_email             varchar(128),
+    nftkeyme_access_token      varchar(128),
+    nftkeyme_refresh_token     varchar(128),
+    token_expiry               timestamp,
+    num_assets                 integer,
+    created_at                 timestamp not null default now(),
+    UNIQUE(discord_user_id, nftkeyme_id)
+);
+
+-- move single links from discord_user, the old nftkeyme columns are no longer used
+insert into nftkeyme_link (discord_user_id, nftkeyme_id, nftkeyme_email, nftkeyme_access_token, nftkeyme_refresh_token, num_assets)
+    select discord_user_id, nftkeyme_id, nftkeyme_email, nftkeyme_access_token, nftkeyme_refresh_token, num_assets
+    from discord_user where nftkeyme_id is not null
+    on conflict do nothing;
+update discord_user set nftkeyme_id = null, nftkeyme_email = null, nftkeyme_access_token = null, nftkeyme_refresh_token = null
+    where nftkeyme_id is not null;
+
+create index if not exists nftkeyme_link_nftkeyme_id on nftkeyme_link (nftkeyme_id);
+
+-- per asset holding history, first_seen is when the current streak of holding the asset started
+create table if not exists asset_holding (
+    id                         serial PRIMARY KEY,
+    discord_user_id            varchar(64) not null references discord_user(discord_user_id) on delete cascade,
+    policy_id                  varchar(64) not null,
+    asset_name                 varchar(128) not null,
+    first_seen                 timestamp not null,
+    last_seen                  timestamp not null,
+    held                       boolean not null default true,
+    UNIQUE(discord_user_id, policy_id, asset_name)
+);
+
+-- full asset list of a user at every verification
+create table if not exists asset_snapshot (
+    id                         serial PRIMARY KEY,
+    discord_user_id            varchar(64) not null references discord_user(discord_user_id) on delete cascade,
+    taken_at                   timestamp not null,
+    num_assets                 integer not null,
+    assets                     jsonb not null
+);
+
+create index if not exists asset_snapshot_taken_at on asset_snapshot (taken_at, discord_user_id);
+
+-- giveaways, entries are frozen when the giveaway is created
+create table if not exists giveaway (
+    id                         serial PRIMARY KEY,
+    name                       varchar(128) not null,
+    created_at                 timestamp not null default now(),
+    criteria                   jsonb not null,
+    num_winners                integer not null,
+    entries_hash               varchar(64) not null,
+    seed_hash                  varchar(64),
+    seed                       varchar(256),
+    drawn_at                   timestamp
+);
+
+create table if not exists giveaway_entry (
+    id                         serial PRIMARY KEY,
+    giveaway_id                integer not null references giveaway(id) on delete cascade,
+    discord_user_id            varchar(64) not null,
+    weight                     bigint not null,
+    winner_position            integer,
+    UNIQUE(giveaway_id, discord_user_id)
+);
+
+alter table discord_user add column if not exists dm_opt_out boolean not null default false;
+alter table nftkeyme_link add column if not exists broken_at timestamp;
+
+alter table discord_user add column if not exists leaderboard_opt_out boolean not null default false;
+
+-- per collection counts as of the last verification for the leaderboard, null until then
+alter table discord_user add column if not exists num_chains integer;
+alter table discord_user add column if not exists num_hunters integer;
+
+create index if not exists asset_snapshot_discord_user_id_taken_at on asset_snapshot (discord_user_id, taken_at desc);
+
+-- a snapshot per verification, the snapshot for a day is picked when exporting
+drop index if exists asset_snapshot_discord_user_id_taken_on;
+alter table asset_snapshot drop column if exists taken_on;
+
+-- entries stay frozen when a user unlinks or is erased, the published entries hash covers them
+alter table giveaway_entry drop constraint if exists giveaway_entry_discord_user_id_fkey;
+
+-- entries are keyed by a salted hash of the discord user id so erasing a user only clears the
+-- id, entries from before keep their id as key as that is what their entries hash covers
+alter table giveaway add column if not exists entry_salt varchar(64);
+update giveaway set entry_salt = md5(random()::text) where entry_salt is null;
+alter table giveaway alter column entry_salt set not null;
+alter table giveaway_entry add column if not exists entry_key varchar(64);
+update giveaway_entry set entry_key = discord_user_id where entry_key is null;
+alter table giveaway_entry alter column entry_key set not null;
+alter table giveaway_entry alter column discord_user_id drop not null;
+create unique index if not exists giveaway_entry_giveaway_id_entry_key on giveaway_entry (giveaway_id, entry_key);
@@ -1,11 +1,18 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
 )
 
+// linkLockClass namespaces the advisory locks taken per nftkeyme account while linking it
+const linkLockClass = 7260322
+
 type (
 	// Store struct to store Db
 	Store struct {
@@ -23,9 +30,96 @@ type (
 		NftkeymeAccessToken  sql.NullString `db:"nftkeyme_access_token"`
 		NftkeymeRefreshToken sql.NullString `db:"nftkeyme_refresh_token"`
 		NumAssets            sql.NullInt64  `db:"num_assets"`
+		NumChains            sql.NullInt64  `db:"num_chains"`
+		NumHunters           sql.NullInt64  `db:"num_hunters"`
+		Locale               sql.NullString `db:"locale"`
+		DmOptOut             bool           `db:"dm_opt_out"`
+		LeaderboardOptOut    bool           `db:"leaderboard_opt_out"`
+	}
+
+	// NftkeymeLink struct to store a linked nftkeyme account, a discord user can have many
+	NftkeymeLink struct {
+		ID                   int            `db:"id"`
+		DiscordUserID        string         `db:"discord_user_id"`
+		NftkeymeID           string         `db:"nftkeyme_id"`
+		NftkeymeEmail        sql.NullString `db:"nftkeyme_email"`
+		NftkeymeAccessToken  sql.NullString `db:"nftkeyme_access_token"`
+		NftkeymeRefreshToken sql.NullString `db:"nftkeyme_refresh_token"`
+		TokenExpiry          sql.NullTime   `db:"token_expiry"`
+		NumAssets            sql.NullInt64  `db:"num_assets"`
+		CreatedAt            time.Time      `db:"created_at"`
+		BrokenAt             sql.NullTime   `db:"broken_at"`
+	}
+
+	// AuditEvent struct to store an audit trail entry
+	AuditEvent struct {
+		ID            int            `db:"id" json:"id"`
+		CreatedAt     time.Time      `db:"created_at" json:"createdAt"`
+		Action        string         `db:"action" json:"action"`
+		DiscordUserID sql.NullString `db:"discord_user_id" json:"-"`
+		Actor         string         `db:"actor" json:"actor"`
+		Detail        string         `db:"detail" json:"detail"`
+	}
+
+	// AssetHolding struct to store when a user was first and last seen holding an asset,
+	// FirstSeen restarts when an asset comes back after not being held
+	AssetHolding struct {
+		ID            int       `db:"id" json:"-"`
+		DiscordUserID string    `db:"discord_user_id" json:"-"`
+		PolicyID      string    `db:"policy_id" json:"policyId"`
+		AssetName     string    `db:"asset_name" json:"assetName"`
+		FirstSeen     time.Time `db:"first_seen" json:"firstSeen"`
+		LastSeen      time.Time `db:"last_seen" json:"lastSeen"`
+		Held          bool      `db:"held" json:"held"`
+	}
+
+	// AssetSnapshot struct to store the assets a user held at a verification
+	AssetSnapshot struct {
+		ID            int            `db:"id" json:"-"`
+		DiscordUserID string         `db:"discord_user_id" json:"-"`
+		TakenAt       time.Time      `db:"taken_at" json:"takenAt"`
+		NumAssets     int            `db:"num_assets" json:"numAssets"`
+		Assets        types.JSONText `db:"assets" json:"assets"`
+	}
+
+	// Giveaway struct to store a giveaway, Seed and DrawnAt are set once drawn
+	Giveaway struct {
+		ID          int            `db:"id" json:"id"`
+		Name        string         `db:"name" json:"name"`
+		CreatedAt   time.Time      `db:"created_at" json:"createdAt"`
+		Criteria    types.JSONText `db:"criteria" json:"criteria"`
+		NumWinners  int            `db:"num_winners" json:"numWinners"`
+		EntriesHash string         `db:"entries_hash" json:"entriesHash"`
+		EntrySalt   string         `db:"entry_salt" json:"-"`
+		SeedHash    sql.NullString `db:"seed_hash" json:"-"`
+		Seed        sql.NullString `db:"seed" json:"-"`
+		DrawnAt     sql.NullTime   `db:"drawn_at" json:"-"`
+	}
+
+	// GiveawayEntry struct to store a discord user entered in a giveaway, DiscordUserID is
+	// cleared when the user is erased and EntryKey is what the entries hash covers
+	GiveawayEntry struct {
+		ID             int            `db:"id" json:"-"`
+		GiveawayID     int            `db:"giveaway_id" json:"giveawayId"`
+		DiscordUserID  sql.NullString `db:"discord_user_id" json:"-"`
+		EntryKey       string         `db:"entry_key" json:"entryKey"`
+		Weight         int64          `db:"weight" json:"weight"`
+		WinnerPosition sql.NullInt64  `db:"winner_position" json:"-"`
+	}
+
+	// SnapshotAsset struct to store one asset in a snapshot
+	SnapshotAsset struct {
+		PolicyID  string `json:"policyId"`
+		AssetName string `json:"assetName"`
+		Quantity  string `json:"quantity"`
 	}
 )
 
+// Ping checks the database answers
+func (s Store) Ping(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
 // GetUserByDiscordID Gets a user using their discord id
 func (s Store) GetUserByDiscordID(discordUserID string) (*DiscordUser, error) {
 	discordUser := DiscordUser{}
@@ -51,6 +145,17 @@ func (s Store) GetAllDiscordUsers() ([]DiscordUser, error) {
 	return discordUsers, nil
 }
 
+// GetLinkedDiscordUsers Gets all users with at least one linked nftkeyme account
+func (s Store) GetLinkedDiscordUsers() ([]DiscordUser, error) {
+	discordUsers := []DiscordUser{}
+	err := s.Db.Select(&discordUsers, "SELECT * FROM discord_user WHERE discord_user_id IN (SELECT discord_user_id FROM nftkeyme_link)")
+	if err != nil {
+		return nil, err
+	}
+
+	return discordUsers, nil
+}
+
 // InsertDiscordUser inserts a new user into the db
 func (s Store) InsertDiscordUser(discordUserID, discordUsername, discordEmail string) error {
 	insertUserQuery := `INSERT INTO discord_user (discord_user_id,discord_username,discord_email) VALUES($1, $2, $3)`
@@ -64,11 +169,89 @@ func (s Store) InsertDiscordUser(discordUserID, discordUsername, discordEmail st
 	return nil
 }
 
-// UpdateDiscordUser updates a new user in the db
-func (s Store) UpdateDiscordUser(discordUserID, nftkeymeAccessToken, nftkeymeRefreshToken string) error {
-	insertUserQuery := `UPDATE discord_user SET nftkeyme_access_token = $1, nftkeyme_refresh_token = $2 WHERE discord_user_id = $3`
+// UpdateDiscordUserNumAssets updates user with new asset count and the count per collection
+func (s Store) UpdateDiscordUserNumAssets(discordUserID string, numAssets, numChains, numHunters int) error {
+	insertUserQuery := `UPDATE discord_user SET num_assets = $1, num_chains = $2, num_hunters = $3 WHERE discord_user_id = $4`
+
+	rows, err := s.Db.Query(insertUserQuery, numAssets, numChains, numHunters, discordUserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// UpdateDiscordUserLocale updates the language used for messages to the user
+func (s Store) UpdateDiscordUserLocale(discordUserID, locale string) error {
+	insertUserQuery := `UPDATE discord_user SET locale = $1 WHERE discord_user_id = $2`
+
+	rows, err := s.Db.Query(insertUserQuery, locale, discordUserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// UpdateDiscordUserDmOptOut updates whether the user gets notifications from the bot
+func (s Store) UpdateDiscordUserDmOptOut(discordUserID string, optOut bool) error {
+	updateUserQuery := `UPDATE discord_user SET dm_opt_out = $1 WHERE discord_user_id = $2`
+
+	rows, err := s.Db.Query(updateUserQuery, optOut, discordUserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// UpdateDiscordUserLeaderboardOptOut updates whether the user is hidden from the leaderboard
+func (s Store) UpdateDiscordUserLeaderboardOptOut(discordUserID string, optOut bool) error {
+	updateUserQuery := `UPDATE discord_user SET leaderboard_opt_out = $1 WHERE discord_user_id = $2`
+
+	rows, err := s.Db.Query(updateUserQuery, optOut, discordUserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// DeleteDiscordUser deletes a user and everything stored for them, their giveaway entries
+// stay for the entries hash without the discord user id
+func (s Store) DeleteDiscordUser(discordUserID string) error {
+	deleteUserQuery := `DELETE FROM discord_user WHERE discord_user_id = $1`
+	// entries from before keys were salted are keyed by the id itself, those get a salted
+	// key too and their giveaway no longer matches its entries hash
+	rekeyEntriesQuery := `UPDATE giveaway_entry e SET entry_key = encode(sha256((g.entry_salt || e.discord_user_id)::bytea), 'hex')
+		FROM giveaway g WHERE g.id = e.giveaway_id AND e.discord_user_id = $1 AND e.entry_key = e.discord_user_id`
+	anonymizeEntriesQuery := `UPDATE giveaway_entry SET discord_user_id = NULL WHERE discord_user_id = $1`
+
+	tx, err := s.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{deleteUserQuery, rekeyEntriesQuery, anonymizeEntriesQuery} {
+		_, err = tx.Exec(query, discordUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// InsertAuditEvent records an entry in the audit trail
+func (s Store) InsertAuditEvent(action, discordUserID, actor, detail string) error {
+	insertEventQuery := `INSERT INTO audit_event (action,discord_user_id,actor,detail) VALUES($1, $2, $3, $4)`
 
-	rows, err := s.Db.Query(insertUserQuery, nftkeymeAccessToken, nftkeymeRefreshToken, discordUserID)
+	rows, err := s.Db.Query(insertEventQuery, action, discordUserID, actor, detail)
 	if err != nil {
 		return err
 	}
@@ -77,11 +260,84 @@ func (s Store) UpdateDiscordUser(discordUserID, nftkeymeAccessToken, nftkeymeRef
 	return nil
 }
 
-// UpdateDiscordUserNftkeyInfo updates nftkey me user info
-func (s Store) UpdateDiscordUserNftkeyInfo(discordUserID, nftkeymeID, nftkeymeEmail string) error {
-	insertUserQuery := `UPDATE discord_user SET nftkeyme_id = $1, nftkeyme_email = $2 WHERE discord_user_id = $3`
+// GetAuditEventsForDiscordUser gets the audit trail for a user
+func (s Store) GetAuditEventsForDiscordUser(discordUserID string) ([]AuditEvent, error) {
+	auditEvents := []AuditEvent{}
+	err := s.Db.Select(&auditEvents, "SELECT * FROM audit_event where discord_user_id = $1 ORDER BY created_at", discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return auditEvents, nil
+}
 
-	rows, err := s.Db.Query(insertUserQuery, nftkeymeID, nftkeymeEmail, discordUserID)
+// GetNftkeymeLinks gets all nftkeyme accounts linked to a discord user
+func (s Store) GetNftkeymeLinks(discordUserID string) ([]NftkeymeLink, error) {
+	links := []NftkeymeLink{}
+	err := s.Db.Select(&links, "SELECT * FROM nftkeyme_link where discord_user_id = $1 ORDER BY id", discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// GetNftkeymeLinksByNftkeymeID gets every discord user link for an nftkeyme account, oldest first
+func (s Store) GetNftkeymeLinksByNftkeymeID(nftkeymeID string) ([]NftkeymeLink, error) {
+	links := []NftkeymeLink{}
+	err := s.Db.Select(&links, "SELECT * FROM nftkeyme_link where nftkeyme_id = $1 ORDER BY id", nftkeymeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// UpsertNftkeymeLink links an nftkeyme account to a discord user, updating tokens if already
+// linked. Returns false without linking if the account is linked to maxDiscordUsers other
+// discord users already, 0 is no limit. Links of the same account are made one at a time so
+// the limit holds
+func (s Store) UpsertNftkeymeLink(discordUserID, nftkeymeID, nftkeymeEmail, accessToken, refreshToken string, tokenExpiry time.Time, maxDiscordUsers int) (bool, error) {
+	lockQuery := `SELECT pg_advisory_xact_lock($1, hashtext($2))`
+	countOthersQuery := `SELECT count(*) FROM nftkeyme_link WHERE nftkeyme_id = $1 AND discord_user_id <> $2`
+	upsertLinkQuery := `INSERT INTO nftkeyme_link (discord_user_id,nftkeyme_id,nftkeyme_email,nftkeyme_access_token,nftkeyme_refresh_token,token_expiry) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (discord_user_id, nftkeyme_id) DO UPDATE SET nftkeyme_email = $3, nftkeyme_access_token = $4, nftkeyme_refresh_token = $5, token_expiry = $6, broken_at = NULL`
+
+	tx, err := s.Db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(lockQuery, linkLockClass, nftkeymeID)
+	if err != nil {
+		return false, err
+	}
+
+	if maxDiscordUsers > 0 {
+		others := 0
+		err = tx.Get(&others, countOthersQuery, nftkeymeID, discordUserID)
+		if err != nil {
+			return false, err
+		}
+		if others >= maxDiscordUsers {
+			return false, nil
+		}
+	}
+
+	_, err = tx.Exec(upsertLinkQuery, discordUserID, nftkeymeID, nftkeymeEmail, accessToken, refreshToken, nullTime(tokenExpiry))
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// UpdateNftkeymeLinkToken updates the tokens for a link
+func (s Store) UpdateNftkeymeLinkToken(linkID int, accessToken, refreshToken string, tokenExpiry time.Time) error {
+	updateLinkQuery := `UPDATE nftkeyme_link SET nftkeyme_access_token = $1, nftkeyme_refresh_token = $2, token_expiry = $3, broken_at = NULL WHERE id = $4`
+
+	rows, err := s.Db.Query(updateLinkQuery, accessToken, refreshToken, nullTime(tokenExpiry), linkID)
 	if err != nil {
 		return err
 	}
@@ -90,11 +346,11 @@ func (s Store) UpdateDiscordUserNftkeyInfo(discordUserID, nftkeymeID, nftkeymeEm
 	return nil
 }
 
-// UpdateDiscordUserNumAssets updates user with new asset count
-func (s Store) UpdateDiscordUserNumAssets(discordUserID string, numAssets int) error {
-	insertUserQuery := `UPDATE discord_user SET num_assets = $1 WHERE discord_user_id = $2`
+// UpdateNftkeymeLinkNumAssets updates a link with its new asset count
+func (s Store) UpdateNftkeymeLinkNumAssets(linkID int, numAssets int) error {
+	updateLinkQuery := `UPDATE nftkeyme_link SET num_assets = $1 WHERE id = $2`
 
-	rows, err := s.Db.Query(insertUserQuery, numAssets, discordUserID)
+	rows, err := s.Db.Query(updateLinkQuery, numAssets, linkID)
 	if err != nil {
 		return err
 	}
@@ -102,3 +358,235 @@ func (s Store) UpdateDiscordUserNumAssets(discordUserID string, numAssets int) e
 
 	return nil
 }
+
+// SetNftkeymeLinkBroken marks a link whose tokens stopped working, it is cleared when the
+// tokens are refreshed or the account is linked again
+func (s Store) SetNftkeymeLinkBroken(linkID int) error {
+	updateLinkQuery := `UPDATE nftkeyme_link SET broken_at = now() WHERE id = $1`
+
+	rows, err := s.Db.Query(updateLinkQuery, linkID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// DeleteNftkeymeLink removes a linked nftkeyme account
+func (s Store) DeleteNftkeymeLink(linkID int) error {
+	deleteLinkQuery := `DELETE FROM nftkeyme_link WHERE id = $1`
+
+	rows, err := s.Db.Query(deleteLinkQuery, linkID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// RecordAssetHoldings records the assets a user holds now. With release, assets no longer
+// held are marked as such so holding them again starts a new streak
+func (s Store) RecordAssetHoldings(discordUserID string, holdings []AssetHolding, seenAt time.Time, release bool) error {
+	upsertHoldingQuery := `INSERT INTO asset_holding (discord_user_id,policy_id,asset_name,first_seen,last_seen,held) VALUES($1, $2, $3, $4, $4, true)
+		ON CONFLICT (discord_user_id, policy_id, asset_name) DO UPDATE SET
+		first_seen = CASE WHEN asset_holding.held THEN asset_holding.first_seen ELSE $4 END, last_seen = $4, held = true`
+	releaseHoldingsQuery := `UPDATE asset_holding SET held = false WHERE discord_user_id = $1 AND held AND last_seen < $2`
+
+	tx, err := s.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, holding := range holdings {
+		_, err = tx.Exec(upsertHoldingQuery, discordUserID, holding.PolicyID, holding.AssetName, seenAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if release {
+		_, err = tx.Exec(releaseHoldingsQuery, discordUserID, seenAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAssetHoldings gets the holding history of a user
+func (s Store) GetAssetHoldings(discordUserID string) ([]AssetHolding, error) {
+	holdings := []AssetHolding{}
+	err := s.Db.Select(&holdings, "SELECT * FROM asset_holding where discord_user_id = $1 ORDER BY policy_id, asset_name", discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return holdings, nil
+}
+
+// InsertAssetSnapshot records the assets a user holds at a verification
+func (s Store) InsertAssetSnapshot(discordUserID string, takenAt time.Time, numAssets int, assets []SnapshotAsset) error {
+	insertSnapshotQuery := `INSERT INTO asset_snapshot (discord_user_id,taken_at,num_assets,assets) VALUES($1, $2, $3, $4)`
+
+	assetsJSON, err := json.Marshal(assets)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.Db.Query(insertSnapshotQuery, discordUserID, takenAt, numAssets, types.JSONText(assetsJSON))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return nil
+}
+
+// GetAssetSnapshotsBefore gets the latest snapshot of every user taken before a time
+func (s Store) GetAssetSnapshotsBefore(before time.Time) ([]AssetSnapshot, error) {
+	snapshots := []AssetSnapshot{}
+	err := s.Db.Select(&snapshots, "SELECT DISTINCT ON (discord_user_id) * FROM asset_snapshot WHERE taken_at < $1 ORDER BY discord_user_id, taken_at DESC", before)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// GetAssetSnapshotsForDiscordUser gets every snapshot of a user, oldest first
+func (s Store) GetAssetSnapshotsForDiscordUser(discordUserID string) ([]AssetSnapshot, error) {
+	snapshots := []AssetSnapshot{}
+	err := s.Db.Select(&snapshots, "SELECT * FROM asset_snapshot where discord_user_id = $1 ORDER BY taken_at", discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// SnapshotAssets decodes the assets in a snapshot
+func (snapshot AssetSnapshot) SnapshotAssets() ([]SnapshotAsset, error) {
+	assets := make([]SnapshotAsset, 0)
+	err := snapshot.Assets.Unmarshal(&assets)
+	if err != nil {
+		return nil, err
+	}
+
+	return assets, nil
+}
+
+// InsertGiveaway stores a giveaway with its frozen entries and returns its id
+func (s Store) InsertGiveaway(giveaway Giveaway, entries []GiveawayEntry) (int, error) {
+	insertGiveawayQuery := `INSERT INTO giveaway (name,criteria,num_winners,entries_hash,entry_salt,seed_hash) VALUES($1, $2, $3, $4, $5, $6) RETURNING id`
+	insertEntryQuery := `INSERT INTO giveaway_entry (giveaway_id,discord_user_id,entry_key,weight) VALUES($1, $2, $3, $4)`
+
+	tx, err := s.Db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var giveawayID int
+	err = tx.Get(&giveawayID, insertGiveawayQuery, giveaway.Name, giveaway.Criteria, giveaway.NumWinners, giveaway.EntriesHash, giveaway.EntrySalt, giveaway.SeedHash)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		_, err = tx.Exec(insertEntryQuery, giveawayID, entry.DiscordUserID, entry.EntryKey, entry.Weight)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return giveawayID, tx.Commit()
+}
+
+// GetGiveaway gets a giveaway by id, nil if not found
+func (s Store) GetGiveaway(giveawayID int) (*Giveaway, error) {
+	giveaway := Giveaway{}
+	err := s.Db.Get(&giveaway, "SELECT * FROM giveaway where id = $1", giveawayID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &giveaway, nil
+}
+
+// GetGiveaways gets all giveaways, newest first
+func (s Store) GetGiveaways() ([]Giveaway, error) {
+	giveaways := []Giveaway{}
+	err := s.Db.Select(&giveaways, "SELECT * FROM giveaway ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	return giveaways, nil
+}
+
+// GetGiveawayEntries gets the entries of a giveaway ordered by key
+func (s Store) GetGiveawayEntries(giveawayID int) ([]GiveawayEntry, error) {
+	entries := []GiveawayEntry{}
+	err := s.Db.Select(&entries, "SELECT * FROM giveaway_entry where giveaway_id = $1 ORDER BY entry_key", giveawayID)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetGiveawayEntriesForDiscordUser gets every giveaway a user was entered in
+func (s Store) GetGiveawayEntriesForDiscordUser(discordUserID string) ([]GiveawayEntry, error) {
+	entries := []GiveawayEntry{}
+	err := s.Db.Select(&entries, "SELECT * FROM giveaway_entry where discord_user_id = $1 ORDER BY giveaway_id", discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// SetGiveawayDrawn records the seed and the winners' entry keys in order, it does nothing
+// if the giveaway was already drawn and returns whether it was updated
+func (s Store) SetGiveawayDrawn(giveawayID int, seed string, winners []string) (bool, error) {
+	drawGiveawayQuery := `UPDATE giveaway SET seed = $1, drawn_at = now() WHERE id = $2 AND drawn_at IS NULL`
+	setWinnerQuery := `UPDATE giveaway_entry SET winner_position = $1 WHERE giveaway_id = $2 AND entry_key = $3`
+
+	tx, err := s.Db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(drawGiveawayQuery, seed, giveawayID)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if updated == 0 {
+		return false, nil
+	}
+
+	for i, entryKey := range winners {
+		_, err = tx.Exec(setWinnerQuery, i+1, giveawayID, entryKey)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -26,14 +25,12 @@ type (
 	}
 )
 
-//NewClientFromEnvironment create new client from discord client
-func NewClientFromEnvironment() Client {
+//NewClient create new discord client for the api at baseURL
+func NewClient(baseURL string) Client {
 	httpClient := &http.Client{
 		Timeout: time.Second * 30,
 	}
 
-	baseURL := os.Getenv("DISCORD_URL")
-
 	client := Client{
 		HTTPClient: *httpClient,
 		BaseURL:    baseURL,
@@ -51,7 +48,7 @@ func (client Client) GetUserInfo(token string) (*UserInfo, error) {
 
 	resp, err := client.HTTPClient.Do(req)
 	if err != nil {
-		logrus.Errorf("Error posting request", err)
+		logrus.WithError(err).Error("Error posting request")
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -0,0 +1,68 @@
+package giveaway
+
+import (
+	"fmt"
+
+	"github.com/reliablestaking/nftkeyme-discord/snapshot"
+)
+
+// Criteria decides who enters a giveaway. Holders need at least MinAssets assets of
+// Policies (all policies if empty) in the snapshot taken for Date (latest if empty) and,
+// if Roles is set, one of those discord roles. With Weighted every asset is a ticket,
+// otherwise every holder gets one
+type Criteria struct {
+	Policies  []string `json:"policies"`
+	MinAssets int      `json:"minAssets"`
+	Roles     []string `json:"roles"`
+	Weighted  bool     `json:"weighted"`
+	Date      string   `json:"date"`
+}
+
+// Validate checks the criteria and fills in defaults
+func (c *Criteria) Validate() error {
+	if c.MinAssets < 0 {
+		return fmt.Errorf("minAssets can't be negative")
+	}
+	if c.MinAssets == 0 {
+		c.MinAssets = 1
+	}
+	if c.Date != "" {
+		_, err := snapshot.ParseDate(c.Date)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Entries turns the holders meeting the criteria into entries keyed with salt, hasRole
+// reports if a discord user has one of the criteria roles and is only called when roles are set
+func (c Criteria) Entries(holders []snapshot.Holder, salt string, hasRole func(discordUserID string, roleIDs []string) (bool, error)) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	for _, holder := range holders {
+		count := holder.Count()
+		if count < int64(c.MinAssets) {
+			continue
+		}
+
+		if len(c.Roles) > 0 {
+			ok, err := hasRole(holder.DiscordUserID, c.Roles)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		weight := int64(1)
+		if c.Weighted {
+			weight = count
+		}
+		entries = append(entries, Entry{Key: EntryKey(salt, holder.DiscordUserID), DiscordUserID: holder.DiscordUserID, Weight: weight})
+	}
+	Sort(entries)
+
+	return entries, nil
+}
@@ -0,0 +1,117 @@
+package giveaway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrSeedMismatch returned when a seed isn't the one committed to
+var ErrSeedMismatch = errors.New("Seed doesn't match the committed seedHash")
+
+// Entry is a discord user in a giveaway, Weight is how many tickets they hold. Key is the
+// salted hash of the discord user id the draw works on, DiscordUserID is empty once the
+// user is erased
+type Entry struct {
+	Key           string `json:"key"`
+	DiscordUserID string `json:"discordUserId,omitempty"`
+	Weight        int64  `json:"weight"`
+}
+
+// EntryKey is the hex HMAC-SHA256 of the discord user id with the giveaway's salt, the
+// entries hash and the draw only see it so an erased user's entry can stay without their id
+func EntryKey(salt, discordUserID string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(discordUserID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sort orders entries by key, the order draws are made in
+func Sort(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+}
+
+// EntriesHash is the sha256 of the sorted entries, one "<key>:<weight>" line each,
+// published with the results so anyone can check the entries weren't changed
+func EntriesHash(entries []Entry) string {
+	sorted := append([]Entry(nil), entries...)
+	Sort(sorted)
+
+	hash := sha256.New()
+	for _, entry := range sorted {
+		fmt.Fprintf(hash, "%s:%d\n", entry.Key, entry.Weight)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Draw picks winners without replacement, each entry's chance proportional to its weight.
+// It is deterministic given the entries and the seed: round n takes the first 8 bytes of
+// HMAC-SHA256(seed, "<entries hash>:<n>:<attempt>") as a big endian number, retries with
+// the next attempt if it falls in the biased tail, and picks the entry whose cumulative
+// weight range in the sorted entries contains it modulo the remaining total weight
+func Draw(entries []Entry, seed string, winners int) []Entry {
+	remaining := make([]Entry, 0)
+	for _, entry := range entries {
+		if entry.Weight > 0 {
+			remaining = append(remaining, entry)
+		}
+	}
+	Sort(remaining)
+	entriesHash := EntriesHash(remaining)
+
+	drawn := make([]Entry, 0)
+	for round := 0; round < winners && len(remaining) > 0; round++ {
+		total := uint64(0)
+		for _, entry := range remaining {
+			total += uint64(entry.Weight)
+		}
+
+		ticket := randomTicket(seed, entriesHash, round, total)
+		for i, entry := range remaining {
+			if ticket < uint64(entry.Weight) {
+				drawn = append(drawn, entry)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			ticket -= uint64(entry.Weight)
+		}
+	}
+
+	return drawn
+}
+
+// SeedHash is the sha256 hex of a seed, what is committed to before the draw
+func SeedHash(seed string) string {
+	hash := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(hash[:])
+}
+
+// CheckSeed checks the seed is the one committed to with seedHash
+func CheckSeed(seed, seedHash string) error {
+	if !hmac.Equal([]byte(SeedHash(seed)), []byte(seedHash)) {
+		return ErrSeedMismatch
+	}
+
+	return nil
+}
+
+// randomTicket returns an unbiased number in [0, total) derived from the seed
+func randomTicket(seed, entriesHash string, round int, total uint64) uint64 {
+	limit := math.MaxUint64 - math.MaxUint64%total
+	for attempt := 0; ; attempt++ {
+		mac := hmac.New(sha256.New, []byte(seed))
+		fmt.Fprintf(mac, "%s:%d:%d", entriesHash, round, attempt)
+		value := binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+		if value < limit {
+			return value % total
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package giveaway
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testEntries() []Entry {
+	entries := make([]Entry, 0)
+	for i, weight := range []int64{1, 2, 0, 5, 1, 3} {
+		discordUserID := fmt.Sprintf("user-%d", i)
+		entries = append(entries, Entry{Key: EntryKey("salt", discordUserID), DiscordUserID: discordUserID, Weight: weight})
+	}
+
+	return entries
+}
+
+func TestDrawIsDeterministic(t *testing.T) {
+	entries := testEntries()
+
+	first := Draw(entries, "seed", 3)
+	if len(first) != 3 {
+		t.Fatalf("got %d winners, want 3", len(first))
+	}
+
+	// the order entries come in doesn't matter
+	reversed := make([]Entry, 0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		reversed = append(reversed, entries[i])
+	}
+	again := Draw(reversed, "seed", 3)
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("got winners %v, then %v with the same seed", first, again)
+	}
+
+	// some seed among a few picks different winners
+	for i := 0; i < 10; i++ {
+		if !reflect.DeepEqual(first, Draw(entries, fmt.Sprintf("other-%d", i), 3)) {
+			return
+		}
+	}
+	t.Error("every seed picked the same winners")
+}
+
+func TestDrawRespectsWeights(t *testing.T) {
+	entries := []Entry{
+		{Key: EntryKey("salt", "light"), DiscordUserID: "light", Weight: 1},
+		{Key: EntryKey("salt", "heavy"), DiscordUserID: "heavy", Weight: 9},
+		{Key: EntryKey("salt", "none"), DiscordUserID: "none", Weight: 0},
+	}
+
+	wins := make(map[string]int)
+	draws := 2000
+	for i := 0; i < draws; i++ {
+		winners := Draw(entries, fmt.Sprintf("seed-%d", i), 1)
+		if len(winners) != 1 {
+			t.Fatalf("got %d winners, want 1", len(winners))
+		}
+		wins[winners[0].DiscordUserID]++
+	}
+
+	if wins["none"] != 0 {
+		t.Errorf("an entry without tickets won %d times", wins["none"])
+	}
+	// 9 in 10 expected, the bounds are well past what chance varies by over this many draws
+	if wins["heavy"] < draws*85/100 || wins["heavy"] > draws*95/100 {
+		t.Errorf("heavy entry won %d of %d draws, want about 90%%", wins["heavy"], draws)
+	}
+
+	// drawing more winners than entries stops once the entries with tickets are drawn
+	all := Draw(entries, "seed", 5)
+	if len(all) != 2 {
+		t.Errorf("got %d winners, want the 2 entries with tickets", len(all))
+	}
+}
+
+func TestEntriesHashCoversKeysOnly(t *testing.T) {
+	entries := testEntries()
+	hash := EntriesHash(entries)
+
+	erased := append([]Entry(nil), entries...)
+	erased[0].DiscordUserID = ""
+	if EntriesHash(erased) != hash {
+		t.Error("erasing a discord user id changed the entries hash")
+	}
+	if !reflect.DeepEqual(Draw(entries, "seed", 3), withIDs(Draw(erased, "seed", 3), entries)) {
+		t.Error("erasing a discord user id changed the winners")
+	}
+
+	erased[1].Weight++
+	if EntriesHash(erased) == hash {
+		t.Error("changing a weight kept the entries hash")
+	}
+}
+
+func TestCheckSeed(t *testing.T) {
+	commitment := SeedHash("secret")
+
+	tests := []struct {
+		name string
+		seed string
+		err  error
+	}{
+		{"committed seed", "secret", nil},
+		{"other seed", "other", ErrSeedMismatch},
+		{"empty seed", "", ErrSeedMismatch},
+		{"commitment as seed", commitment, ErrSeedMismatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckSeed(test.seed, commitment)
+			if err != test.err {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// withIDs puts back the discord user ids of winners drawn from erased entries
+func withIDs(winners []Entry, entries []Entry) []Entry {
+	ids := make(map[string]string)
+	for _, entry := range entries {
+		ids[entry.Key] = entry.DiscordUserID
+	}
+	for i := range winners {
+		winners[i].DiscordUserID = ids[winners[i].Key]
+	}
+
+	return winners
+}
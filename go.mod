@@ -3,10 +3,14 @@ module github.com/reliablestaking/nftkeyme-discord
 go 1.15
 
 require (
-	github.com/bwmarrin/discordgo v0.23.2
+	github.com/BurntSushi/toml v0.4.1
+	github.com/bwmarrin/discordgo v0.27.1
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/labstack/echo/v4 v4.5.0
 	github.com/lib/pq v1.10.2
 	github.com/sirupsen/logrus v1.8.1
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f
+	golang.org/x/text v0.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,153 @@
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+type (
+	// Bundle holds the message catalogs for every supported language
+	Bundle struct {
+		defaultLang string
+		catalogs    map[string]map[string]string
+		tags        []language.Tag
+		matcher     language.Matcher
+	}
+
+	// Localizer translates messages for a single language
+	Localizer struct {
+		bundle *Bundle
+		Lang   string
+	}
+)
+
+// LoadBundle loads every <lang>.json catalog in dir, defaultLang must be one of them
+func LoadBundle(dir string, defaultLang string) (*Bundle, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	catalogs := make(map[string]map[string]string)
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		catalog := make(map[string]string)
+		err = json.Unmarshal(bytes, &catalog)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing catalog %s: %v", file, err)
+		}
+
+		lang := strings.TrimSuffix(filepath.Base(file), ".json")
+		catalogs[lang] = catalog
+	}
+
+	return NewBundle(defaultLang, catalogs)
+}
+
+// NewBundle creates a bundle from in memory catalogs keyed by language tag
+func NewBundle(defaultLang string, catalogs map[string]map[string]string) (*Bundle, error) {
+	if _, ok := catalogs[defaultLang]; !ok {
+		return nil, fmt.Errorf("No catalog found for default language %s", defaultLang)
+	}
+
+	// default language first so the matcher falls back to it
+	langs := []string{defaultLang}
+	others := make([]string, 0)
+	for lang := range catalogs {
+		if lang != defaultLang {
+			others = append(others, lang)
+		}
+	}
+	sort.Strings(others)
+	langs = append(langs, others...)
+
+	tags := make([]language.Tag, 0)
+	for _, lang := range langs {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid catalog language %s: %v", lang, err)
+		}
+		tags = append(tags, tag)
+	}
+
+	bundle := Bundle{
+		defaultLang: defaultLang,
+		catalogs:    catalogs,
+		tags:        tags,
+		matcher:     language.NewMatcher(tags),
+	}
+
+	return &bundle, nil
+}
+
+// Languages returns the supported language tags, default first
+func (b *Bundle) Languages() []string {
+	langs := make([]string, 0)
+	for _, tag := range b.tags {
+		langs = append(langs, tag.String())
+	}
+
+	return langs
+}
+
+// Match picks the best supported language from the given preferences in order,
+// each preference being a language tag or an Accept-Language header value
+func (b *Bundle) Match(preferences ...string) string {
+	for _, preference := range preferences {
+		if preference == "" {
+			continue
+		}
+
+		desired, _, err := language.ParseAcceptLanguage(preference)
+		if err != nil || len(desired) == 0 {
+			continue
+		}
+
+		_, index, confidence := b.matcher.Match(desired...)
+		if confidence != language.No {
+			return b.tags[index].String()
+		}
+	}
+
+	return b.defaultLang
+}
+
+// Localizer returns a localizer for lang, unknown languages use the default
+func (b *Bundle) Localizer(lang string) Localizer {
+	if _, ok := b.catalogs[lang]; !ok {
+		lang = b.Match(lang)
+	}
+
+	return Localizer{
+		bundle: b,
+		Lang:   lang,
+	}
+}
+
+// T translates key, formatting any args into the message. Missing keys fall
+// back to the default language and then to the key itself
+func (l Localizer) T(key string, args ...interface{}) string {
+	message, ok := l.bundle.catalogs[l.Lang][key]
+	if !ok {
+		message, ok = l.bundle.catalogs[l.bundle.defaultLang][key]
+	}
+	if !ok {
+		return key
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+
+	return message
+}
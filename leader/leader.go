@@ -0,0 +1,200 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// Elector makes one replica the leader by holding a postgres advisory lock on a
+	// dedicated connection, and runs the leader only workers while it holds it
+	Elector struct {
+		db       *sqlx.DB
+		lockKey  int64
+		interval time.Duration
+
+		mu      sync.Mutex
+		leader  bool
+		since   time.Time
+		workers []worker
+		// the running workers while leading, nil otherwise
+		leading *leadership
+	}
+
+	leadership struct {
+		ctx context.Context
+		wg  *sync.WaitGroup
+	}
+
+	worker struct {
+		name string
+		run  func(ctx context.Context)
+	}
+)
+
+// NewElector creates an elector trying for the lock every interval
+func NewElector(db *sqlx.DB, lockKey int64, interval time.Duration) *Elector {
+	return &Elector{
+		db:       db,
+		lockKey:  lockKey,
+		interval: interval,
+	}
+}
+
+// Go registers a worker that only runs on the leader, it should return once the context is
+// canceled
+func (e *Elector) Go(name string, run func(ctx context.Context)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.workers = append(e.workers, worker{name: name, run: run})
+}
+
+// Start runs a one off worker under the current leadership, its context is canceled when
+// ctx is or leadership is lost and stepping down waits for it. Returns false without running
+// it if this replica isn't the leader
+func (e *Elector) Start(ctx context.Context, name string, run func(ctx context.Context)) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leading == nil {
+		return false
+	}
+
+	leading := e.leading
+	workerCtx, cancel := context.WithCancel(ctx)
+	leading.wg.Add(1)
+	go func() {
+		defer leading.wg.Done()
+		defer cancel()
+		go func() {
+			select {
+			case <-leading.ctx.Done():
+				cancel()
+			case <-workerCtx.Done():
+			}
+		}()
+
+		run(workerCtx)
+		logrus.Infof("Leader worker %s stopped", name)
+	}()
+
+	return true
+}
+
+// Leadership returns if this replica is the leader and since when it is or isn't
+func (e *Elector) Leadership() (bool, time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader, e.since
+}
+
+// IsLeader returns if this replica is the leader
+func (e *Elector) IsLeader() bool {
+	leader, _ := e.Leadership()
+	return leader
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.leader = leader
+	e.since = time.Now()
+}
+
+func (e *Elector) setLeading(leading *leadership) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.leading = leading
+}
+
+// Run tries for the lock until the context is canceled. Once it has it the workers run until
+// the lock is lost or the context is canceled, then it waits for them before letting go
+func (e *Elector) Run(ctx context.Context) {
+	e.setLeader(false)
+	for {
+		conn, err := e.acquire(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("Error trying for leader lock")
+		}
+		if conn != nil {
+			e.lead(ctx, conn)
+		}
+
+		if !lifecycle.Sleep(ctx, e.interval) {
+			return
+		}
+	}
+}
+
+// acquire tries for the lock on a dedicated connection, nil if another replica has it
+func (e *Elector) acquire(ctx context.Context) (*sql.Conn, error) {
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired := false
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.lockKey).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// lead runs the workers while the lock's connection stays up
+func (e *Elector) lead(ctx context.Context, conn *sql.Conn) {
+	logrus.Infof("Elected leader, starting %d background workers", len(e.workers))
+	e.setLeader(true)
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	e.setLeading(&leadership{ctx: workerCtx, wg: &wg})
+	for _, w := range e.workers {
+		wg.Add(1)
+		go func(w worker) {
+			defer wg.Done()
+			w.run(workerCtx)
+			logrus.Infof("Leader worker %s stopped", w.name)
+		}(w)
+	}
+
+	for lifecycle.Sleep(ctx, e.interval) {
+		err := conn.PingContext(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("Lost leader lock connection, stopping background workers")
+			break
+		}
+	}
+
+	// nothing more is started once stepping down
+	e.setLeading(nil)
+	cancel()
+	wg.Wait()
+	e.setLeader(false)
+
+	// the lock goes with the session, unlocking first hands over sooner if the connection
+	// goes back to the pool
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", e.lockKey)
+	if err != nil {
+		// a connection still holding the lock must not go back to the pool
+		logrus.WithError(err).Warn("Error releasing leader lock, discarding its connection")
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	conn.Close()
+	logrus.Info("Stepped down as leader")
+}
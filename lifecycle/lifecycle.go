@@ -0,0 +1,153 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// Manager runs the background workers until shutdown, then waits for them to finish
+	// what they are doing and closes what they used
+	Manager struct {
+		ctx     context.Context
+		cancel  context.CancelFunc
+		drain   context.Context
+		expire  context.CancelFunc
+		workers sync.WaitGroup
+		failed  chan string
+
+		mu     sync.Mutex
+		closes []closer
+	}
+
+	closer struct {
+		name  string
+		close func() error
+	}
+)
+
+// NewManager creates a manager, its context is canceled on shutdown
+func NewManager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	drain, expire := context.WithCancel(context.Background())
+	return &Manager{
+		ctx:    ctx,
+		cancel: cancel,
+		drain:  drain,
+		expire: expire,
+		failed: make(chan string, 1),
+	}
+}
+
+// Context returns the context canceled on shutdown
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Drain returns the context canceled once the shutdown timeout is up, workers use it to
+// bound what they finish after shutdown so everything shares one deadline
+func (m *Manager) Drain() context.Context {
+	return m.drain
+}
+
+// Go runs a worker that should return once the context is canceled. A worker returning an
+// error shuts everything down
+func (m *Manager) Go(name string, worker func(ctx context.Context) error) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+
+		err := worker(m.ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Worker %s failed", name)
+			select {
+			case m.failed <- name:
+			default:
+			}
+			return
+		}
+		logrus.Infof("Worker %s stopped", name)
+	}()
+}
+
+// OnClose registers something to close once the workers stopped, closed in reverse order
+func (m *Manager) OnClose(name string, close func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closes = append(m.closes, closer{name: name, close: close})
+}
+
+// Run waits for SIGTERM, SIGINT or a failed worker, then shuts down. It returns false if
+// the workers didn't stop within the timeout or a worker failed
+func (m *Manager) Run(timeout time.Duration) bool {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	ok := true
+	select {
+	case sig := <-signals:
+		logrus.Infof("Got %s, shutting down", sig)
+	case name := <-m.failed:
+		logrus.Errorf("Shutting down after worker %s failed", name)
+		ok = false
+	}
+
+	return m.Shutdown(timeout) && ok
+}
+
+// Shutdown cancels the context, waits up to the timeout for the workers to finish and
+// closes everything registered, returning false if the workers didn't finish in time. The
+// drain context is canceled when the timeout is up
+func (m *Manager) Shutdown(timeout time.Duration) bool {
+	deadline := time.AfterFunc(timeout, m.expire)
+	defer deadline.Stop()
+	defer m.expire()
+	m.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(stopped)
+	}()
+
+	drained := true
+	select {
+	case <-stopped:
+		logrus.Info("All workers stopped")
+	case <-m.drain.Done():
+		logrus.Errorf("Workers didn't stop within %s, closing anyway", timeout)
+		drained = false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.closes) - 1; i >= 0; i-- {
+		err := m.closes[i].close()
+		if err != nil {
+			logrus.WithError(err).Errorf("Error closing %s", m.closes[i].name)
+		}
+	}
+
+	return drained
+}
+
+// Sleep waits for the duration, returning false early if the context is canceled
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -5,15 +5,22 @@ package main
 // @description This is the API to query user's NFT data
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"flag"
 	"os"
-	"strconv"
-	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/jmoiron/sqlx"
+	"github.com/reliablestaking/nftkeyme-discord/announce"
+	"github.com/reliablestaking/nftkeyme-discord/cache"
+	"github.com/reliablestaking/nftkeyme-discord/config"
 	"github.com/reliablestaking/nftkeyme-discord/db"
 	"github.com/reliablestaking/nftkeyme-discord/discord"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/leader"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
 	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
 	"github.com/reliablestaking/nftkeyme-discord/server"
 	"golang.org/x/oauth2"
@@ -29,134 +36,207 @@ var (
 )
 
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "yaml or toml config file, env vars override it")
+	flag.Parse()
+	args := flag.Args()
+
+	// commands that don't need the database
+	if len(args) > 1 && args[0] == "config" && args[1] == "check" {
+		os.Exit(runConfigCheck(*configFile))
+	}
+
+	// the snapshot command only needs the database settings
+	snapshotCommand := len(args) > 0 && args[0] == "snapshot"
+	cfg, err := config.Load(*configFile)
+	if err != nil && snapshotCommand && cfg.Database.Validate() == nil {
+		err = nil
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Error loading config")
+	}
+
 	// init database
-	portInt := 5432
-	port := os.Getenv("DB_PORT")
-	if port != "" {
-		portInt, _ = strconv.Atoi(port)
-	}
-	sslmode := "disable"
-	if os.Getenv("DB_SSL") == "true" {
-		sslmode = "require"
-	}
-	pgCon := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		os.Getenv("DB_ADDR"),
-		portInt,
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASS"),
-		os.Getenv("DB_NAME"),
-		sslmode)
-	database, err := sqlx.Connect("postgres", pgCon)
+	database, err := sqlx.Connect("postgres", cfg.Database.DataSourceName())
 	if err != nil {
 		logrus.WithError(err).Fatal("Error connecting to db...")
 	}
-	defer database.Close()
 	store := db.Store{
 		Db: database,
 	}
 
+	// commands that only need the database
+	if snapshotCommand {
+		runSnapshotCommand(store, args[1:])
+		database.Close()
+		return
+	}
+
+	// background work stops on SIGTERM, then the session and database are closed
+	manager := lifecycle.NewManager()
+	manager.OnClose("database", database.Close)
+
 	// init discord server
-	//TODO: make configurable
 	discordOauthConfig := &oauth2.Config{
-		RedirectURL:  os.Getenv("DISCORD_REDIRECT_URL"),
-		ClientID:     os.Getenv("DISCORD_CLIENT_ID"),
-		ClientSecret: os.Getenv("DISCORD_CLIENT_SECRET"),
+		RedirectURL:  cfg.Discord.RedirectURL,
+		ClientID:     cfg.Discord.ClientID,
+		ClientSecret: cfg.Discord.ClientSecret,
 		Scopes:       []string{"identity"},
-		Endpoint:     oauth2.Endpoint{TokenURL: os.Getenv("DISCORD_TOKEN_URL")},
+		Endpoint:     oauth2.Endpoint{TokenURL: cfg.Discord.TokenURL},
 	}
 
 	nftkeymeOauthConfig := &oauth2.Config{
-		RedirectURL:  os.Getenv("NFTKEYME_REDIRECT_URL"),
-		ClientID:     os.Getenv("NFTKEYME_CLIENT_ID"),
-		ClientSecret: os.Getenv("NFTKEYME_CLIENT_SECRET"),
+		RedirectURL:  cfg.Nftkeyme.RedirectURL,
+		ClientID:     cfg.Nftkeyme.ClientID,
+		ClientSecret: cfg.Nftkeyme.ClientSecret,
 		Scopes:       []string{"offline assets"},
 		Endpoint: oauth2.Endpoint{
-			TokenURL: os.Getenv("NFTKEYME_TOKEN_URL"),
-			AuthURL:  os.Getenv("NFTKEYME_AUTH_URL"),
+			TokenURL: cfg.Nftkeyme.TokenURL,
+			AuthURL:  cfg.Nftkeyme.AuthURL,
 		},
 	}
 
-	discordBotToken := os.Getenv("DISCORD_BOT_TOKEN")
-	if discordBotToken == "" {
-		logrus.Fatalf("Discord bot token not found")
-	}
-
-	discordBot, err := discordgo.New("Bot " + discordBotToken)
+	discordBot, err := discordgo.New("Bot " + cfg.Discord.BotToken)
 	if err != nil {
 		logrus.WithError(err).Fatal("Error setting up discord")
 	}
 
-	discordAuthURL := os.Getenv("DISCORD_AUTH_URL")
-	if discordAuthURL == "" {
-		logrus.Fatalf("Discord auth url not found")
+	messages, err := i18n.LoadBundle("locales", "en")
+	if err != nil {
+		logrus.WithError(err).Fatal("Error loading message catalogs")
 	}
 
-	policyIDCheck := os.Getenv("POLICY_ID_CHECK")
-	if policyIDCheck == "" {
-		logrus.Fatalf("Policy id check")
+	roleConfig, err := loadRoleConfig(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error loading role config")
 	}
 
-	policyIDCheckHunter := os.Getenv("POLICY_ID_CHECK_HUNTERS")
-	if policyIDCheckHunter == "" {
-		logrus.Fatalf("Policy id check")
+	linkPolicy, err := server.ParseLinkPolicy(cfg.Roles.LinkPolicy)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error parsing link policy")
 	}
 
-	serverID := os.Getenv("DISCORD_SERVER_ID")
-	if serverID == "" {
-		logrus.Fatalf("Discrod server id check")
+	sessionSecret := []byte(cfg.Server.SessionSecret)
+	if len(sessionSecret) == 0 {
+		logrus.Warn("SESSION_SECRET not set, using a random secret, logins won't survive a restart")
+		sessionSecret = make([]byte, 32)
+		_, err = rand.Read(sessionSecret)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error generating session secret")
+		}
 	}
 
-	channelID := os.Getenv("DISCORD_CHANNEL_ID")
-	if channelID == "" {
-		logrus.Fatalf("Channel id check")
+	announcer, err := loadAnnouncer(cfg, messages, discordBot)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error setting up announcements")
 	}
 
-	roleMapString := os.Getenv("DISCORD_ROLE_MAP")
-	if roleMapString == "" {
-		logrus.Fatalf("Role map check")
+	nftkeymeClient := nftkeyme.NewClient(cfg.Nftkeyme.URL, cfg.Nftkeyme.RevokeURL, cfg.Nftkeyme.ClientID, cfg.Nftkeyme.ClientSecret)
+	if cfg.Nftkeyme.PageSize > 0 {
+		nftkeymeClient.PageSize = cfg.Nftkeyme.PageSize
 	}
-	roleMap, err := buildRoleMap(roleMapString)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Error building role map %s", roleMapString)
+	if cfg.Nftkeyme.MaxResponseBytes > 0 {
+		nftkeymeClient.MaxResponseBytes = int64(cfg.Nftkeyme.MaxResponseBytes)
+	}
+
+	// asset cache, shared by every replica with redis
+	var assetCache cache.Cache
+	switch cfg.Cache.Backend {
+	case config.CacheMemory:
+		assetCache = cache.NewMemory(cfg.Cache.Size)
+	case config.CacheRedis:
+		redisCache, err := cache.NewRedis(cfg.Cache.RedisURL, "nftkeyme-discord:", 5*time.Second)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error setting up redis cache")
+		}
+		manager.OnClose("redis cache", redisCache.Close)
+		assetCache = redisCache
 	}
 
+	elector := leader.NewElector(database, int64(cfg.Leader.LockKey), cfg.Leader.Interval)
+
 	// init server
 	server := server.Server{
-		Store:                store,
-		Sha1ver:              sha1ver,
-		BuildTime:            buildTime,
-		DiscordOauthConfig:   discordOauthConfig,
-		NftkeymeOauthConfig:  nftkeymeOauthConfig,
-		DiscordClient:        discord.NewClientFromEnvironment(),
-		NftkeymeClient:       nftkeyme.NewClientFromEnvironment(),
-		DiscordSession:       discordBot,
-		DiscordAuthCodeURL:   discordAuthURL,
-		PolicyIDCheck:        policyIDCheck,
-		PolicyIDCheckHunters: policyIDCheckHunter,
-		DiscordServerID:      serverID,
-		DiscordChannelID:     channelID,
-		RoleMap:              roleMap,
-	}
-
-	// start monitor
-	go server.VerifyAccess()
+		Store:               store,
+		Sha1ver:             sha1ver,
+		BuildTime:           buildTime,
+		DiscordOauthConfig:  discordOauthConfig,
+		NftkeymeOauthConfig: nftkeymeOauthConfig,
+		DiscordClient:       discord.NewClient(cfg.Discord.URL),
+		NftkeymeClient:      nftkeymeClient,
+		DiscordSession:      discordBot,
+		Discord:             discordBot,
+		DiscordAuthCodeURL:  cfg.Discord.AuthURL,
+		DiscordServerID:     cfg.Discord.ServerID,
+		DiscordChannelID:    cfg.Discord.ChannelID,
+		Messages:            messages,
+		SessionSecret:       sessionSecret,
+		LinkPolicy:          linkPolicy,
+		Roles:               server.NewRoleConfigs(roleConfig),
+		Readiness:           server.NewReadiness(),
+		Announcer:           announcer,
+		LeaderboardSize:     cfg.Leaderboard.Size,
+		Port:                cfg.Server.Port,
+		AllowedOrigins:      cfg.Server.Origins,
+		AdminAPIKey:         cfg.Server.AdminAPIKey,
+		ShutdownDeadline:    manager.Drain,
+		Leader:              elector,
+		AssetCache:          assetCache,
+		AssetCacheTTL:       cfg.Nftkeyme.AssetCache,
+	}
+
+	// start monitor, background work, the gateway with slash commands and announcements only
+	// run on the replica holding the leader lock
+	manager.Go("setup check", func(ctx context.Context) error {
+		server.MonitorSetup(ctx, 5*time.Minute)
+		return nil
+	})
+	elector.Go("discord bot", server.RunBot)
+	elector.Go("announcer", announcer.Run)
+	elector.Go("verify access", server.VerifyAccess)
+
+	// reload roles on SIGHUP or file change
+	manager.Go("config watcher", func(ctx context.Context) error {
+		watchConfig(ctx, manager, server, *configFile, cfg)
+		return nil
+	})
+
+	// post leaderboard
+	if cfg.Leaderboard.Interval > 0 {
+		elector.Go("leaderboard", func(ctx context.Context) {
+			server.PostLeaderboard(ctx, cfg.Leaderboard.Interval)
+		})
+	}
+	manager.Go("leader election", func(ctx context.Context) error {
+		elector.Run(ctx)
+		return nil
+	})
 
 	// start server
-	server.Start()
-}
+	manager.Go("http server", server.Start)
 
-func buildRoleMap(roleMapString string) (map[int]string, error) {
-	roleMap := make(map[int]string)
+	if !manager.Run(cfg.Server.Drain) {
+		os.Exit(1)
+	}
+}
 
-	roleMapSplits := strings.Split(roleMapString, ",")
-	for _, roleMapSplit := range roleMapSplits {
-		roleMapArray := strings.Split(roleMapSplit, ":")
-		numberValue, err := strconv.Atoi(roleMapArray[0])
+// loadAnnouncer sets up announcements to the channel, default templates come from the
+// message catalog
+func loadAnnouncer(cfg config.Config, messages *i18n.Bundle, sender announce.Sender) (*announce.Announcer, error) {
+	announceConfig := announce.Config{}
+	if cfg.Announcements.File != "" {
+		loaded, err := announce.LoadConfig(cfg.Announcements.File)
 		if err != nil {
 			return nil, err
 		}
-		roleMap[numberValue] = roleMapArray[1]
+		announceConfig = loaded
+	}
+
+	l := messages.Localizer("")
+	announceDefaults := map[string]announce.Template{
+		announce.EventVerified:  {Title: l.T("announce.verified.title"), Description: l.T("announce.verified.description"), Color: 0x2ecc71},
+		announce.EventUpgrade:   {Title: l.T("announce.upgrade.title"), Description: l.T("announce.upgrade.description"), Color: 0xf1c40f},
+		announce.EventDowngrade: {Title: l.T("announce.downgrade.title"), Description: l.T("announce.downgrade.description"), Color: 0x95a5a6},
 	}
 
-	return roleMap, nil
+	return announce.NewAnnouncer(sender, cfg.Discord.ChannelID, announceConfig, announceDefaults)
 }
@@ -0,0 +1,291 @@
+package nftkeyme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/url"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxAssetPages stops following cursors that never end
+const maxAssetPages = 10000
+
+type (
+	// AssetCount is how many assets a user holds and their total quantity
+	AssetCount struct {
+		Assets   int
+		Quantity *big.Int
+	}
+
+	// assetQuantity is the part of an asset counting needs, the metadata is skipped
+	assetQuantity struct {
+		PolicyId string `json:"policy_id"`
+		Quantity string `json:"quantity"`
+	}
+
+	// cappedBody fails reads past the max response size
+	cappedBody struct {
+		body      io.ReadCloser
+		remaining int64
+	}
+)
+
+//GetAssetsForUser gets all the assets for the provided token/user, following pages
+func (client NftkeymeClient) GetAssetsForUser(ctx context.Context, token string, policyID string) ([]Asset, error) {
+	logrus.Info("Getting asset info")
+
+	assets := make([]Asset, 0)
+	found, err := client.eachAsset(ctx, token, policyID, func(dec *json.Decoder) error {
+		asset := Asset{}
+		err := dec.Decode(&asset)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, asset)
+		return nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return assets, nil
+}
+
+//CountAssetsForUser counts the assets for the provided token/user without keeping them,
+//an unparseable quantity counts as 1
+func (client NftkeymeClient) CountAssetsForUser(ctx context.Context, token string, policyID string) (AssetCount, error) {
+	logrus.Info("Counting assets")
+
+	count := NewAssetCount()
+	_, err := client.eachAsset(ctx, token, policyID, func(dec *json.Decoder) error {
+		asset := assetQuantity{}
+		err := dec.Decode(&asset)
+		if err != nil {
+			return err
+		}
+		count.add(Asset{PolicyId: asset.PolicyId, Quantity: asset.Quantity})
+		return nil
+	})
+	if err != nil {
+		return AssetCount{}, err
+	}
+
+	return count, nil
+}
+
+//NewAssetCount creates an empty count
+func NewAssetCount() AssetCount {
+	return AssetCount{Quantity: new(big.Int)}
+}
+
+//CountAssets counts assets the same way CountAssetsForUser does
+func CountAssets(assets []Asset) AssetCount {
+	count := NewAssetCount()
+	for _, asset := range assets {
+		count.add(asset)
+	}
+
+	return count
+}
+
+//Total is the quantity clamped to MaxInt32, what tiers, leaderboards and giveaways count
+func (count AssetCount) Total() int64 {
+	if count.Quantity == nil {
+		return 0
+	}
+	if !count.Quantity.IsInt64() || count.Quantity.Int64() > math.MaxInt32 {
+		return math.MaxInt32
+	}
+
+	return count.Quantity.Int64()
+}
+
+//Add adds another count, like one of another linked account
+func (count AssetCount) Add(other AssetCount) AssetCount {
+	sum := NewAssetCount()
+	sum.Assets = count.Assets + other.Assets
+	if count.Quantity != nil {
+		sum.Quantity.Add(sum.Quantity, count.Quantity)
+	}
+	if other.Quantity != nil {
+		sum.Quantity.Add(sum.Quantity, other.Quantity)
+	}
+
+	return sum
+}
+
+func (count *AssetCount) add(asset Asset) {
+	quantity, ok := asset.QuantityInt()
+	if !ok {
+		quantity = big.NewInt(1)
+	}
+	count.Assets++
+	count.Quantity.Add(count.Quantity, quantity)
+}
+
+//eachAsset streams every asset across all pages to decode, which reads one array element.
+//All pages together are capped at the max response size. Returns false if nftkeyme doesn't
+//know the user, a later page that isn't found is an error as the assets would be incomplete
+func (client NftkeymeClient) eachAsset(ctx context.Context, token string, policyID string, decode func(dec *json.Decoder) error) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, client.AssetsTimeout)
+	defer cancel()
+
+	remaining := client.maxResponseBytes()
+	cursor := ""
+	for page := 0; page < maxAssetPages; page++ {
+		q := url.Values{}
+		if policyID != "" {
+			q.Add("policyId", policyID)
+		}
+		if client.PageSize > 0 {
+			q.Add("limit", strconv.Itoa(client.PageSize))
+		}
+		if cursor != "" {
+			q.Add("cursor", cursor)
+		}
+
+		body, err := client.request(ctx, "getting asset info", "/assets", q, token)
+		if err != nil {
+			return false, err
+		}
+		if body == nil && page > 0 {
+			logrus.Errorf("Asset page %d not found", page)
+			return false, ErrPageNotFound
+		}
+		if body == nil {
+			return false, nil
+		}
+
+		capped := &cappedBody{body: body, remaining: remaining}
+		cursor, err = decodeAssetPage(json.NewDecoder(capped), decode)
+		capped.Close()
+		remaining = capped.remaining
+		if err != nil {
+			return false, err
+		}
+		if cursor == "" {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("Error getting asset info, more than %d pages", maxAssetPages)
+}
+
+//decodeAssetPage reads a page, either a plain array of assets or an object with the assets
+//and the cursor of the next page, which is returned
+func decodeAssetPage(dec *json.Decoder, decode func(dec *json.Decoder) error) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	switch token {
+	case json.Delim('['):
+		return "", decodeAssetArray(dec, decode)
+	case json.Delim('{'):
+	default:
+		return "", fmt.Errorf("Unexpected assets response starting with %v", token)
+	}
+
+	cursor := ""
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case "assets":
+			token, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			if token == nil {
+				continue
+			}
+			if token != json.Delim('[') {
+				return "", fmt.Errorf("Unexpected assets %v", token)
+			}
+			err = decodeAssetArray(dec, decode)
+			if err != nil {
+				return "", err
+			}
+		case "next_cursor":
+			next := ""
+			err = dec.Decode(&next)
+			if err != nil {
+				return "", err
+			}
+			cursor = next
+		default:
+			skip := json.RawMessage{}
+			err = dec.Decode(&skip)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// closing brace
+	_, err = dec.Token()
+	return cursor, err
+}
+
+//decodeAssetArray decodes the elements of an array whose opening bracket was read
+func decodeAssetArray(dec *json.Decoder, decode func(dec *json.Decoder) error) error {
+	for dec.More() {
+		err := decode(dec)
+		if err != nil {
+			return err
+		}
+	}
+
+	// closing bracket
+	_, err := dec.Token()
+	return err
+}
+
+//Read reads up to the remaining size, past it there is an error if there is more to read
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		n, err := b.body.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+//Close closes the body
+func (b *cappedBody) Close() error {
+	return b.body.Close()
+}
+
+//BucketByPolicy groups assets by policy, leaving out assets of other policies
+func BucketByPolicy(assets []Asset, policyIDs []string) map[string][]Asset {
+	buckets := make(map[string][]Asset)
+	for _, policyID := range policyIDs {
+		buckets[policyID] = make([]Asset, 0)
+	}
+	for _, asset := range assets {
+		if bucket, ok := buckets[asset.PolicyId]; ok {
+			buckets[asset.PolicyId] = append(bucket, asset)
+		}
+	}
+
+	return buckets
+}
@@ -0,0 +1,138 @@
+package nftkeyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// pagedAssets serves pages of one asset each, cursors are the next page number
+func pagedAssets(t *testing.T, pages int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		next := ""
+		if page+1 < pages {
+			next = strconv.Itoa(page + 1)
+		}
+		fmt.Fprintf(w, `{"assets": [{"policy_id": "policy", "asset_name": "asset%03d", "quantity": "1"}], "next_cursor": %q}`, page, next)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestGetAssetsForUserPages(t *testing.T) {
+	server := pagedAssets(t, 3)
+	client := NewClient(server.URL, "", "", "")
+
+	assets, err := client.GetAssetsForUser(context.Background(), "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 3 || assets[2].AssetName != "asset002" {
+		t.Errorf("got %v, want 3 assets", assets)
+	}
+}
+
+func TestGetAssetsForUserMaxResponseBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		err      error
+	}{
+		// a page is under 150 bytes, 3 of them are over
+		{"every page fits", 150, ErrResponseTooLarge},
+		{"all pages fit", 1000, nil},
+		{"unlimited", 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := pagedAssets(t, 3)
+			client := NewClient(server.URL, "", "", "")
+			client.MaxResponseBytes = test.maxBytes
+
+			_, err := client.GetAssetsForUser(context.Background(), "token", "")
+			if !errors.Is(err, test.err) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestGetAssetsForUserMissingPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("cursor") != "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"assets": [{"policy_id": "policy", "asset_name": "asset000", "quantity": "1"}], "next_cursor": "1"}`)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "", "", "")
+
+	assets, err := client.GetAssetsForUser(context.Background(), "token", "")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("got %v %v, want a missing page error", assets, err)
+	}
+	_, err = client.CountAssetsForUser(context.Background(), "token", "")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("counting got %v, want a missing page error", err)
+	}
+}
+
+func TestCountAssetsForUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("policyId") != "policy" {
+			t.Errorf("got policy %q, want the filter passed on", r.URL.Query().Get("policyId"))
+		}
+		fmt.Fprint(w, `[
+			{"policy_id": "policy", "asset_name": "a", "quantity": "3", "onchain_metadata": {"name": "A"}},
+			{"policy_id": "policy", "asset_name": "b", "quantity": "oops"}
+		]`)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "", "", "")
+
+	count, err := client.CountAssetsForUser(context.Background(), "token", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Assets != 2 || count.Quantity.Int64() != 4 {
+		t.Errorf("got %d assets with quantity %s, want 2 with 4", count.Assets, count.Quantity)
+	}
+}
+
+func TestAssetCountTotal(t *testing.T) {
+	tests := []struct {
+		name       string
+		quantities []string
+		want       int64
+	}{
+		{"none", nil, 0},
+		{"quantities", []string{"2", "3"}, 5},
+		{"zero", []string{"0", "1"}, 1},
+		{"unparseable counts as 1", []string{"-1", "oops"}, 2},
+		{"clamped", []string{"2147483647", "1"}, math.MaxInt32},
+		{"beyond 64 bits", []string{"100000000000000000000"}, math.MaxInt32},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assets := make([]Asset, 0)
+			for _, quantity := range test.quantities {
+				assets = append(assets, Asset{PolicyId: "policy", Quantity: quantity})
+			}
+
+			got := CountAssets(assets).Total()
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package nftkeyme
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// Fake serves users from memory by access token, for running the service without nftkeyme
+	Fake struct {
+		mu      sync.Mutex
+		users   map[string]FakeUser
+		revoked []string
+		err     error
+	}
+
+	// FakeUser is what the fake serves for a token
+	FakeUser struct {
+		Info      UserInfo
+		Assets    []Asset
+		StakeKeys []StakeKey
+	}
+)
+
+var _ API = NftkeymeClient{}
+var _ API = (*Fake)(nil)
+
+//NewFake creates a fake with no users
+func NewFake() *Fake {
+	return &Fake{users: make(map[string]FakeUser)}
+}
+
+//SetUser serves the user for the token, unknown tokens are rejected as unauthorized
+func (fake *Fake) SetUser(token string, user FakeUser) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.users[token] = user
+}
+
+//SetErr makes every call return err, to act as if nftkeyme is down, nil to recover
+func (fake *Fake) SetErr(err error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.err = err
+}
+
+//Revoked returns the refresh tokens revoked so far
+func (fake *Fake) Revoked() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]string{}, fake.revoked...)
+}
+
+func (fake *Fake) user(ctx context.Context, token string) (FakeUser, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return FakeUser{}, err
+	}
+	if fake.err != nil {
+		return FakeUser{}, fake.err
+	}
+	user, ok := fake.users[token]
+	if !ok {
+		return FakeUser{}, &Error{Op: "getting user", StatusCode: 401}
+	}
+
+	return user, nil
+}
+
+//GetAssetsForUser gets the user's assets of the policy, all of them if empty
+func (fake *Fake) GetAssetsForUser(ctx context.Context, token string, policyID string) ([]Asset, error) {
+	user, err := fake.user(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make([]Asset, 0)
+	for _, asset := range user.Assets {
+		if policyID == "" || asset.PolicyId == policyID {
+			assets = append(assets, asset)
+		}
+	}
+
+	return assets, nil
+}
+
+//CountAssetsForUser counts the user's assets of the policy, all of them if empty
+func (fake *Fake) CountAssetsForUser(ctx context.Context, token string, policyID string) (AssetCount, error) {
+	assets, err := fake.GetAssetsForUser(ctx, token, policyID)
+	if err != nil {
+		return AssetCount{}, err
+	}
+
+	return CountAssets(assets), nil
+}
+
+//GetStakeKeysForUser gets the user's stake keys
+func (fake *Fake) GetStakeKeysForUser(ctx context.Context, token string) ([]StakeKey, error) {
+	user, err := fake.user(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]StakeKey{}, user.StakeKeys...), nil
+}
+
+//GetUserInfo gets the user's info
+func (fake *Fake) GetUserInfo(ctx context.Context, token string) (*UserInfo, error) {
+	user, err := fake.user(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	info := user.Info
+	return &info, nil
+}
+
+//RevokeToken records the refresh token as revoked
+func (fake *Fake) RevokeToken(ctx context.Context, refreshToken string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fake.err != nil {
+		return fake.err
+	}
+	fake.revoked = append(fake.revoked, refreshToken)
+
+	return nil
+}
+
+//Ping fails only if an error is set
+func (fake *Fake) Ping(ctx context.Context) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fake.err
+}
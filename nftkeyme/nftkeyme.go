@@ -1,21 +1,73 @@
 package nftkeyme
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// DefaultTimeout is how long a request gets unless the client sets its own
+	DefaultTimeout = 30 * time.Second
+	// DefaultAssetsTimeout is how long getting all pages of assets gets, big wallets take a while
+	DefaultAssetsTimeout = 300 * time.Second
+	// DefaultPageSize is how many assets are asked for per page
+	DefaultPageSize = 500
+	// DefaultMaxResponseBytes caps the size of a response, all pages of assets together
+	DefaultMaxResponseBytes = 32 << 20
+)
+
+var (
+	// ErrRevokeNotConfigured returned when no revocation endpoint is configured
+	ErrRevokeNotConfigured = errors.New("nftkeyme revoke url not configured")
+	// ErrUnauthorized returned when nftkeyme rejects the token
+	ErrUnauthorized = errors.New("nftkeyme rejected the token")
+	// ErrResponseTooLarge returned when a response is bigger than the client allows
+	ErrResponseTooLarge = errors.New("nftkeyme response too large")
+	// ErrPageNotFound returned when a page after the first isn't found, the assets would be
+	// incomplete
+	ErrPageNotFound = errors.New("nftkeyme asset page not found")
+)
+
 type (
+	// API is the nftkeyme api, every call is bounded by the context and the client's timeout
+	API interface {
+		GetAssetsForUser(ctx context.Context, token string, policyID string) ([]Asset, error)
+		CountAssetsForUser(ctx context.Context, token string, policyID string) (AssetCount, error)
+		GetStakeKeysForUser(ctx context.Context, token string) ([]StakeKey, error)
+		GetUserInfo(ctx context.Context, token string) (*UserInfo, error)
+		RevokeToken(ctx context.Context, refreshToken string) error
+		Ping(ctx context.Context) error
+	}
+
 	// NftkeymeClient struct to hold client
 	NftkeymeClient struct {
-		HttpClient http.Client
-		BaseUrl    string
+		HttpClient       http.Client
+		BaseUrl          string
+		RevokeUrl        string
+		ClientID         string
+		ClientSecret     string
+		Timeout          time.Duration
+		AssetsTimeout    time.Duration
+		PageSize         int
+		MaxResponseBytes int64
+	}
+
+	// Error is a request nftkeyme answered with an unexpected status
+	Error struct {
+		Op         string
+		StatusCode int
 	}
 
 	// Asset struct to hold returned asset data
@@ -26,6 +78,11 @@ type (
 		OnChainMetadata map[string]interface{} `json:"onchain_metadata"`
 	}
 
+	// StakeKey struct to hold a stake address registered to a user
+	StakeKey struct {
+		StakeAddress string `json:"stake_address"`
+	}
+
 	// UserInfo struct to hold user info from nftkeyme
 	UserInfo struct {
 		ID    string `json:"id"`
@@ -33,98 +90,217 @@ type (
 	}
 )
 
-//NewClientFromEnvironment create new nftkeyme client using env vars
-func NewClientFromEnvironment() NftkeymeClient {
-	httpClient := &http.Client{
-		Timeout: time.Second * 300,
+//NewClient create new nftkeyme client for the api at baseURL
+func NewClient(baseURL, revokeURL, clientID, clientSecret string) NftkeymeClient {
+	client := NftkeymeClient{
+		HttpClient:       http.Client{},
+		BaseUrl:          baseURL,
+		RevokeUrl:        revokeURL,
+		ClientID:         clientID,
+		ClientSecret:     clientSecret,
+		Timeout:          DefaultTimeout,
+		AssetsTimeout:    DefaultAssetsTimeout,
+		PageSize:         DefaultPageSize,
+		MaxResponseBytes: DefaultMaxResponseBytes,
 	}
 
-	baseURL := os.Getenv("NFTKEYME_URL")
+	return client
+}
 
-	client := NftkeymeClient{
-		HttpClient: *httpClient,
-		BaseUrl:    baseURL,
+//Error describes the failed request
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error %s %d", e.Op, e.StatusCode)
+}
+
+//Unwrap makes a rejected token match ErrUnauthorized
+func (e *Error) Unwrap() error {
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		return ErrUnauthorized
 	}
 
-	return client
+	return nil
 }
 
-//GetAssetsForUser gets all the assets for the provided token/user
-func (client NftkeymeClient) GetAssetsForUser(token string, policyID string) ([]Asset, error) {
-	logrus.Info("Getting asset info")
+//get sends an authorized GET and decodes the json body into v, returns false if not found
+func (client NftkeymeClient) get(ctx context.Context, timeout time.Duration, op, path string, query url.Values, token string, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/assets", client.BaseUrl), nil)
-	req.Header.Add("Authorization", "Bearer "+token)
+	body, err := client.request(ctx, op, path, query, token)
+	if err != nil || body == nil {
+		return false, err
+	}
+	defer body.Close()
 
-	q := req.URL.Query()
-	if policyID != "" {
-		q.Add("policyId", policyID)
+	err = json.NewDecoder(&cappedBody{body: body, remaining: client.maxResponseBytes()}).Decode(v)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//request sends an authorized GET and returns the body, nil if not found. The caller caps
+//and closes it
+func (client NftkeymeClient) request(ctx context.Context, op, path string, query url.Values, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s", client.BaseUrl, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
 	}
-	req.URL.RawQuery = q.Encode()
 
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		logrus.Errorf("Error posting request", err)
+		logrus.WithError(err).Error("Error posting request")
 		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
+		resp.Body.Close()
 		return nil, nil
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		logrus.Errorf("Error getting asset info %d", resp.StatusCode)
-		return nil, fmt.Errorf("Error getting asset info %d", resp.StatusCode)
+		resp.Body.Close()
+		logrus.Errorf("Error %s %d", op, resp.StatusCode)
+		return nil, &Error{Op: op, StatusCode: resp.StatusCode}
 	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	return resp.Body, nil
+}
+
+//maxResponseBytes is the response size cap, unlimited if not set
+func (client NftkeymeClient) maxResponseBytes() int64 {
+	if client.MaxResponseBytes <= 0 {
+		return math.MaxInt64
 	}
 
-	assets := make([]Asset, 0)
-	err = json.Unmarshal(bytes, &assets)
-	if err != nil {
+	return client.MaxResponseBytes
+}
+
+//GetStakeKeysForUser gets the stake addresses registered to the provided token/user
+func (client NftkeymeClient) GetStakeKeysForUser(ctx context.Context, token string) ([]StakeKey, error) {
+	logrus.Info("Getting stake key info")
+
+	stakeKeys := make([]StakeKey, 0)
+	found, err := client.get(ctx, client.Timeout, "getting stake key info", "/stakekeys", nil, token, &stakeKeys)
+	if err != nil || !found {
 		return nil, err
 	}
 
-	return assets, nil
+	return stakeKeys, nil
+}
+
+//QuantityInt parses the quantity, fungible token quantities can exceed 64 bits
+func (asset Asset) QuantityInt() (*big.Int, bool) {
+	quantity, ok := new(big.Int).SetString(strings.TrimSpace(asset.Quantity), 10)
+	if !ok || quantity.Sign() < 0 {
+		return nil, false
+	}
+
+	return quantity, true
+}
+
+//Decimals returns the decimals from the asset metadata, 0 if not set
+func (asset Asset) Decimals() int {
+	switch decimals := asset.OnChainMetadata["decimals"].(type) {
+	case float64:
+		if decimals >= 0 && decimals <= 255 {
+			return int(decimals)
+		}
+	case string:
+		value, ok := new(big.Int).SetString(strings.TrimSpace(decimals), 10)
+		if ok && value.Sign() >= 0 && value.Cmp(big.NewInt(255)) <= 0 {
+			return int(value.Int64())
+		}
+	}
+
+	return 0
+}
+
+//Amount returns the quantity adjusted for decimals, an unparseable quantity counts as 1
+func (asset Asset) Amount() *big.Rat {
+	quantity, ok := asset.QuantityInt()
+	if !ok {
+		return big.NewRat(1, 1)
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(asset.Decimals())), nil)
+	return new(big.Rat).SetFrac(quantity, scale)
 }
 
 //GetUserInfo get user info
-func (client NftkeymeClient) GetUserInfo(token string) (*UserInfo, error) {
+func (client NftkeymeClient) GetUserInfo(ctx context.Context, token string) (*UserInfo, error) {
 	logrus.Info("Getting user info")
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/userinfo", client.BaseUrl), nil)
-	req.Header.Add("Authorization", "Bearer "+token)
+	userInfo := UserInfo{}
+	found, err := client.get(ctx, client.Timeout, "getting user info", "/userinfo", nil, token, &userInfo)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+//Ping checks the api answers, any response below 500 counts as reachable
+func (client NftkeymeClient) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", client.BaseUrl, nil)
+	if err != nil {
+		return err
+	}
 
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		logrus.Errorf("Error posting request", err)
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
 
-	if resp.StatusCode == 404 {
-		return nil, nil
+	if resp.StatusCode >= 500 {
+		return &Error{Op: "reaching nftkeyme", StatusCode: resp.StatusCode}
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		logrus.Errorf("Error getting user info %d", resp.StatusCode)
-		return nil, fmt.Errorf("Error getting user info %d", resp.StatusCode)
+	return nil
+}
+
+//RevokeToken revokes a refresh token at the provider so it can no longer be used
+func (client NftkeymeClient) RevokeToken(ctx context.Context, refreshToken string) error {
+	logrus.Info("Revoking token")
+	if client.RevokeUrl == "" {
+		return ErrRevokeNotConfigured
 	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("token", refreshToken)
+	form.Set("token_type_hint", "refresh_token")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", client.RevokeUrl, strings.NewReader(form.Encode()))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(client.ClientID), url.QueryEscape(client.ClientSecret))
 
-	userInfo := UserInfo{}
-	err = json.Unmarshal(bytes, &userInfo)
+	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		return nil, err
+		logrus.WithError(err).Error("Error posting request")
+		return err
 	}
+	defer resp.Body.Close()
 
-	return &userInfo, nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logrus.Errorf("Error revoking token %d", resp.StatusCode)
+		return &Error{Op: "revoking token", StatusCode: resp.StatusCode}
+	}
+
+	return nil
 }
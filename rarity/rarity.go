@@ -0,0 +1,194 @@
+package rarity
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// Collection holds the rarity score of every asset in a policy
+	Collection struct {
+		PolicyID string
+		Scores   map[string]float64
+		MaxScore float64
+	}
+
+	// Collections holds collections by policy id
+	Collections map[string]*Collection
+
+	// snapshotAsset is one asset in a json snapshot
+	snapshotAsset struct {
+		AssetName string                 `json:"asset_name"`
+		Traits    map[string]interface{} `json:"traits"`
+	}
+)
+
+// LoadSnapshot imports a snapshot of a policy's assets and their traits and scores it.
+// Json snapshots are either a list of {"asset_name": ..., "traits": {...}} or an object
+// of asset name to traits. Csv snapshots have a header row, the first column is the
+// asset name and every other column a trait type, empty cells mean the trait is missing
+func LoadSnapshot(policyID, path string) (*Collection, error) {
+	var traits map[string]map[string]string
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		traits, err = readCSV(path)
+	} else {
+		traits, err = readJSON(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot %s: %v", path, err)
+	}
+	if len(traits) == 0 {
+		return nil, fmt.Errorf("Snapshot %s has no assets", path)
+	}
+
+	scores := Score(traits)
+	collection := Collection{
+		PolicyID: policyID,
+		Scores:   scores,
+	}
+	for _, score := range scores {
+		if score > collection.MaxScore {
+			collection.MaxScore = score
+		}
+	}
+
+	return &collection, nil
+}
+
+// Score computes a rarity score per asset, summing for each trait type how rare the
+// asset's value is (assets in the collection / assets sharing the value). Not having a
+// trait counts as a value of its own
+func Score(traits map[string]map[string]string) map[string]float64 {
+	traitTypes := make(map[string]bool)
+	for _, assetTraits := range traits {
+		for traitType := range assetTraits {
+			traitTypes[traitType] = true
+		}
+	}
+
+	counts := make(map[string]map[string]int)
+	for traitType := range traitTypes {
+		counts[traitType] = make(map[string]int)
+		for _, assetTraits := range traits {
+			counts[traitType][assetTraits[traitType]]++
+		}
+	}
+
+	total := float64(len(traits))
+	scores := make(map[string]float64)
+	for assetName, assetTraits := range traits {
+		score := 0.0
+		for traitType := range traitTypes {
+			score += total / float64(counts[traitType][assetTraits[traitType]])
+		}
+		scores[assetName] = score
+	}
+
+	return scores
+}
+
+// Score returns the rarity score of an asset, asset names can be hex or plain text
+func (c Collections) Score(policyID, assetName string) (float64, bool) {
+	collection, ok := c[policyID]
+	if !ok {
+		return 0, false
+	}
+
+	if score, ok := collection.Scores[assetName]; ok {
+		return score, true
+	}
+
+	decoded, err := hex.DecodeString(assetName)
+	if err == nil {
+		if score, ok := collection.Scores[string(decoded)]; ok {
+			return score, true
+		}
+	}
+
+	score, ok := collection.Scores[hex.EncodeToString([]byte(assetName))]
+	return score, ok
+}
+
+func readJSON(path string) (map[string]map[string]string, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	traits := make(map[string]map[string]string)
+
+	list := make([]snapshotAsset, 0)
+	if err := json.Unmarshal(bytes, &list); err == nil {
+		for _, asset := range list {
+			if asset.AssetName == "" {
+				return nil, fmt.Errorf("asset without asset_name")
+			}
+			traits[asset.AssetName] = traitStrings(asset.Traits)
+		}
+		return traits, nil
+	}
+
+	byName := make(map[string]map[string]interface{})
+	err = json.Unmarshal(bytes, &byName)
+	if err != nil {
+		return nil, err
+	}
+	for assetName, assetTraits := range byName {
+		traits[assetName] = traitStrings(assetTraits)
+	}
+
+	return traits, nil
+}
+
+func readCSV(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil
+	}
+
+	header := records[0]
+	traits := make(map[string]map[string]string)
+	for _, record := range records[1:] {
+		assetTraits := make(map[string]string)
+		for i := 1; i < len(record) && i < len(header); i++ {
+			value := strings.TrimSpace(record[i])
+			if value != "" {
+				assetTraits[header[i]] = value
+			}
+		}
+		traits[record[0]] = assetTraits
+	}
+
+	return traits, nil
+}
+
+func traitStrings(assetTraits map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for traitType, value := range assetTraits {
+		if value == nil {
+			continue
+		}
+		text := strings.TrimSpace(fmt.Sprint(value))
+		if text != "" {
+			values[traitType] = text
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,153 @@
+package rarity
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testScores are the scores of the test snapshots: 4 assets, Background is Gold once, Blue
+// twice and Red once, Hat is Cap three times and missing once
+var testScores = map[string]float64{
+	"A": 4.0/1 + 4.0/3,
+	"B": 4.0/2 + 4.0/3,
+	"C": 4.0/1 + 4.0/1,
+	"D": 4.0/2 + 4.0/3,
+}
+
+const (
+	testJSONList = `[
+		{"asset_name": "A", "traits": {"Background": "Gold", "Hat": "Cap"}},
+		{"asset_name": "B", "traits": {"Background": "Blue", "Hat": "Cap"}},
+		{"asset_name": "C", "traits": {"Background": "Red", "Hat": null}},
+		{"asset_name": "D", "traits": {"Background": "Blue", "Hat": " Cap "}}
+	]`
+	testJSONObject = `{
+		"A": {"Background": "Gold", "Hat": "Cap"},
+		"B": {"Background": "Blue", "Hat": "Cap"},
+		"C": {"Background": "Red", "Hat": ""},
+		"D": {"Background": "Blue", "Hat": "Cap"}
+	}`
+	testCSV = "asset,Background,Hat\nA,Gold,Cap\nB,Blue,Cap\nC,Red,\nD,Blue, Cap\n"
+)
+
+func writeSnapshot(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "rarity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func sameScore(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"json list", "snapshot.json", testJSONList},
+		{"json object", "snapshot.json", testJSONObject},
+		{"csv", "snapshot.csv", testCSV},
+		{"csv upper case extension", "snapshot.CSV", testCSV},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collection, err := LoadSnapshot("policy", writeSnapshot(t, test.file, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if collection.PolicyID != "policy" {
+				t.Errorf("got policy %s", collection.PolicyID)
+			}
+			if len(collection.Scores) != len(testScores) {
+				t.Errorf("got %d scores, want %d", len(collection.Scores), len(testScores))
+			}
+			for assetName, want := range testScores {
+				if !sameScore(collection.Scores[assetName], want) {
+					t.Errorf("got score %f for %s, want %f", collection.Scores[assetName], assetName, want)
+				}
+			}
+			if !sameScore(collection.MaxScore, testScores["C"]) {
+				t.Errorf("got max score %f, want %f", collection.MaxScore, testScores["C"])
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"empty json", "snapshot.json", `[]`},
+		{"json without asset name", "snapshot.json", `[{"traits": {"Hat": "Cap"}}]`},
+		{"invalid json", "snapshot.json", `{"A": [`},
+		{"csv with only a header", "snapshot.csv", "asset,Hat\n"},
+		{"csv with uneven rows", "snapshot.csv", "asset,Hat\nA,Cap,extra\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadSnapshot("policy", writeSnapshot(t, test.file, test.content))
+			if err == nil {
+				t.Error("loaded an invalid snapshot")
+			}
+		})
+	}
+}
+
+func TestScoreWithoutTraits(t *testing.T) {
+	scores := Score(map[string]map[string]string{"A": {}, "B": {}})
+	if scores["A"] != 0 || scores["B"] != 0 {
+		t.Errorf("got scores %v, want 0 without trait types", scores)
+	}
+}
+
+func TestCollectionsScore(t *testing.T) {
+	collections := Collections{"policy": {PolicyID: "policy", Scores: map[string]float64{
+		"Zombie1":                             3,
+		hex.EncodeToString([]byte("Hunter1")): 2,
+	}}}
+	hexName := hex.EncodeToString([]byte("Zombie1"))
+
+	tests := []struct {
+		name      string
+		policyID  string
+		assetName string
+		score     float64
+		ok        bool
+	}{
+		{"plain name", "policy", "Zombie1", 3, true},
+		{"hex name of a plain score", "policy", hexName, 3, true},
+		{"plain name of a hex score", "policy", "Hunter1", 2, true},
+		{"unknown asset", "policy", "Zombie2", 0, false},
+		{"unknown policy", "other", "Zombie1", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score, ok := collections.Score(test.policyID, test.assetName)
+			if score != test.score || ok != test.ok {
+				t.Errorf("got %f, %t, want %f, %t", score, ok, test.score, test.ok)
+			}
+		})
+	}
+}
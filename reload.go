@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/reliablestaking/nftkeyme-discord/chain"
+	"github.com/reliablestaking/nftkeyme-discord/config"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/reliablestaking/nftkeyme-discord/rarity"
+	"github.com/reliablestaking/nftkeyme-discord/roles"
+	"github.com/reliablestaking/nftkeyme-discord/server"
+	"github.com/sirupsen/logrus"
+)
+
+// loadRoleConfig loads the role map, collections, role rules and rarity snapshots, the
+// part of the config that can be reloaded while running
+func loadRoleConfig(cfg config.Config) (server.RoleConfig, error) {
+	roleRules := make([]roles.Rule, 0)
+	if cfg.Roles.RulesFile != "" {
+		loaded, err := roles.LoadRules(cfg.Roles.RulesFile)
+		if err != nil {
+			return server.RoleConfig{}, err
+		}
+		roleRules = loaded
+	}
+
+	// delegation rules need on chain data, from blockfrost or a stub file
+	roleSources := []roles.Source{roles.AssetSource{}}
+	if cfg.Roles.ChainStubFile != "" {
+		stubClient, err := chain.LoadStubClient(cfg.Roles.ChainStubFile)
+		if err != nil {
+			return server.RoleConfig{}, err
+		}
+		roleSources = append(roleSources, roles.DelegationSource{Client: stubClient})
+	} else if cfg.Blockfrost.ProjectID != "" {
+		roleSources = append(roleSources, roles.DelegationSource{Client: chain.NewClient(cfg.Blockfrost.URL, cfg.Blockfrost.ProjectID)})
+	}
+	roleEngine, err := roles.NewEngine(roleRules, roleSources...)
+	if err != nil {
+		return server.RoleConfig{}, err
+	}
+
+	rarityCollections := make(rarity.Collections)
+	for policyID, path := range cfg.Roles.Snapshots {
+		collection, err := rarity.LoadSnapshot(policyID, path)
+		if err != nil {
+			return server.RoleConfig{}, err
+		}
+		logrus.Infof("Loaded rarity scores for %d assets of policy %s, max score %.2f", len(collection.Scores), collection.PolicyID, collection.MaxScore)
+		rarityCollections[collection.PolicyID] = collection
+	}
+
+	return server.RoleConfig{
+		RoleMap:              cfg.Discord.Roles,
+		PolicyIDCheck:        cfg.Collections.PolicyIDCheck,
+		PolicyIDCheckHunters: cfg.Collections.PolicyIDCheckHunters,
+		RoleEngine:           roleEngine,
+		Rarity:               rarityCollections,
+	}, nil
+}
+
+// reloadRoleConfig loads the config again and swaps in the new role config if all of it is
+// valid, otherwise the running one is kept
+func reloadRoleConfig(manager *lifecycle.Manager, s server.Server, configFile string) (config.Config, bool) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		logrus.WithError(err).Error("Not reloading, config is invalid")
+		return cfg, false
+	}
+
+	roleConfig, err := loadRoleConfig(cfg)
+	if err != nil {
+		logrus.WithError(err).Error("Not reloading, role config is invalid")
+		return cfg, false
+	}
+
+	problems := s.CheckDiscordSetup(roleConfig)
+	problems.Log()
+	if len(problems.Fatal) > 0 {
+		logrus.Error("Not reloading, role config doesn't match the discord server")
+		return cfg, false
+	}
+	s.Readiness.Set(server.ReadinessDiscordSetup, nil, problems.Warnings)
+
+	s.ReloadRoles(manager, roleConfig, cfg.Reload.Reconcile)
+	return cfg, true
+}
+
+// watchConfig reloads the role config on SIGHUP, and when the config file or a file it
+// points to changes if a watch interval is set. Only roles and collections are reloaded,
+// other settings, the watch interval included, need a restart. A reconcile after a reload
+// runs as a worker of the leader
+func watchConfig(ctx context.Context, manager *lifecycle.Manager, s server.Server, configFile string, cfg config.Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var tick <-chan time.Time
+	if cfg.Reload.Interval > 0 {
+		ticker := time.NewTicker(cfg.Reload.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modified := watchedFiles(configFile, cfg)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logrus.Info("Got SIGHUP, reloading config")
+		case <-tick:
+			current := watchedFiles(configFile, cfg)
+			if sameFiles(modified, current) {
+				continue
+			}
+			modified = current
+			logrus.Info("Config files changed, reloading config")
+		}
+
+		reloaded, ok := reloadRoleConfig(manager, s, configFile)
+		if ok {
+			// files the new config points to are watched from now on
+			cfg = reloaded
+			modified = watchedFiles(configFile, cfg)
+		}
+	}
+}
+
+// watchedFiles returns the modification time of the config file and the files it points to
+func watchedFiles(configFile string, cfg config.Config) map[string]time.Time {
+	paths := []string{configFile, cfg.Roles.RulesFile, cfg.Roles.ChainStubFile}
+	for _, path := range cfg.Roles.Snapshots {
+		paths = append(paths, path)
+	}
+
+	modified := make(map[string]time.Time)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			modified[path] = time.Time{}
+			continue
+		}
+		modified[path] = info.ModTime()
+	}
+
+	return modified
+}
+
+func sameFiles(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, modTime := range a {
+		if other, ok := b[path]; !ok || !other.Equal(modTime) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,115 @@
+package roles
+
+import (
+	"context"
+	"fmt"
+)
+
+// Engine evaluates role rules for holders using the registered sources
+type Engine struct {
+	Rules   []Rule
+	sources map[string]Source
+}
+
+// NewEngine creates an engine, every rule's source must be registered
+func NewEngine(rules []Rule, sources ...Source) (Engine, error) {
+	engine := Engine{
+		Rules:   rules,
+		sources: make(map[string]Source),
+	}
+	for _, source := range sources {
+		engine.sources[source.Name()] = source
+	}
+
+	for _, rule := range rules {
+		if _, ok := engine.sources[rule.Source]; !ok {
+			return Engine{}, fmt.Errorf("Role rule %s uses unknown or unconfigured source %s", rule.Name, rule.Source)
+		}
+	}
+
+	return engine, nil
+}
+
+// Evaluate returns whether the holder should have each rule role, a role shared by
+// several rules is granted if any of them matches. On chain lookups are cached for the run
+func (e Engine) Evaluate(ctx context.Context, holder Holder) (map[string]bool, error) {
+	sources := make(map[string]Source)
+	for name, source := range e.sources {
+		if run, ok := source.(runSource); ok {
+			source = run.forRun()
+		}
+		sources[name] = source
+	}
+
+	grants := make(map[string]bool)
+	for _, rule := range e.Rules {
+		source, ok := sources[rule.Source]
+		if !ok {
+			return nil, fmt.Errorf("Role rule %s uses unknown source %s", rule.Name, rule.Source)
+		}
+
+		eligible, err := source.Eligible(ctx, rule, holder)
+		if err != nil {
+			return nil, fmt.Errorf("Error evaluating role rule %s: %v", rule.Name, err)
+		}
+		grants[rule.RoleID] = grants[rule.RoleID] || eligible
+	}
+
+	return grants, nil
+}
+
+// UsesSource checks if any rule uses the source
+func (e Engine) UsesSource(name string) bool {
+	for _, rule := range e.Rules {
+		if rule.Source == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Policies returns the policies asset rules are limited to whose assets are needed in full
+func (e Engine) Policies() []string {
+	policyIDs := make([]string, 0)
+	for _, rule := range e.Rules {
+		if rule.Source == SourceAssets && rule.Policy != "" && !rule.CountOnly() {
+			policyIDs = append(policyIDs, rule.Policy)
+		}
+	}
+
+	return policyIDs
+}
+
+// CountPolicies returns the policies only count rules look at, counting their assets is
+// enough
+func (e Engine) CountPolicies() []string {
+	full := make(map[string]bool)
+	for _, policyID := range e.Policies() {
+		full[policyID] = true
+	}
+
+	policyIDs := make([]string, 0)
+	for _, rule := range e.Rules {
+		if rule.CountOnly() && !full[rule.Policy] {
+			full[rule.Policy] = true
+			policyIDs = append(policyIDs, rule.Policy)
+		}
+	}
+
+	return policyIDs
+}
+
+// RoleIDs returns every role the rules manage
+func (e Engine) RoleIDs() []string {
+	seen := make(map[string]bool)
+	roleIDs := make([]string, 0)
+	for _, rule := range e.Rules {
+		if !seen[rule.RoleID] {
+			seen[rule.RoleID] = true
+			roleIDs = append(roleIDs, rule.RoleID)
+		}
+	}
+
+	return roleIDs
+}
@@ -0,0 +1,529 @@
+package roles
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a compiled match expression evaluated against a single asset.
+//
+// Expressions compare asset fields with literals:
+//
+//	meta.rarity == "Legendary"
+//	meta.attributes.background == "Gold" || meta["Background Color"] == "Gold"
+//	name ~ "^ZombieChain0[0-9]{2}$" && !(meta.traits == "Zombie")
+//	quantity >= 10
+//
+// Fields are policy, name (the asset name), quantity and rarity (when the collection has
+// a rarity snapshot), plus meta.<path> into the on chain CIP-25 metadata. Operators are
+// == != < <= > >= ~ (regex match) !~ && || ! and parentheses. Comparing a list matches
+// if any element matches and a field on its own is true when it is set. A decimal string
+// like "12" compares as a number against a number, two strings always compare as text and
+// only numbers can be ordered.
+type Expr interface {
+	eval(fields map[string]interface{}) interface{}
+}
+
+// Compile parses an expression
+func Compile(source string) (Expr, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+
+	return expr, nil
+}
+
+// Eval evaluates a compiled expression against the fields of an asset
+func Eval(expr Expr, fields map[string]interface{}) bool {
+	return truthy(expr.eval(fields))
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenDot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "!~", "&&", "||", "<", ">", "~", "!"}
+
+func lex(source string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{tokenLBracket, "[", i})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{tokenRBracket, "]", i})
+			i++
+		case r == '.':
+			tokens = append(tokens, token{tokenDot, ".", i})
+			i++
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokenString, sb.String(), start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{tokenOp, op, i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", string(r), i)
+			}
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "end of expression", len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.isOp("!") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{inner}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind != tokenOp {
+		return left, nil
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: t.text, left: left, right: right}, nil
+	case "~", "!~":
+		p.next()
+		pattern := p.next()
+		if pattern.kind != tokenString {
+			return nil, fmt.Errorf("expected a quoted regex after %s at %d", t.text, pattern.pos)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex at %d: %v", pattern.pos, err)
+		}
+		return matchExpr{negate: t.text == "!~", value: left, re: re}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokenRParen {
+			return nil, fmt.Errorf("missing ) for ( at %d", t.pos)
+		}
+		return inner, nil
+	case tokenString:
+		return literalExpr{t.text}, nil
+	case tokenNumber:
+		number, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at %d", t.text, t.pos)
+		}
+		return literalExpr{number}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literalExpr{true}, nil
+		case "false":
+			return literalExpr{false}, nil
+		case "null":
+			return literalExpr{nil}, nil
+		}
+		return p.parsePath(t)
+	}
+
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) parsePath(first token) (Expr, error) {
+	path := []string{first.text}
+	for {
+		switch p.peek().kind {
+		case tokenDot:
+			p.next()
+			t := p.next()
+			if t.kind != tokenIdent && t.kind != tokenNumber {
+				return nil, fmt.Errorf("expected a field name after . at %d", t.pos)
+			}
+			path = append(path, t.text)
+		case tokenLBracket:
+			p.next()
+			t := p.next()
+			if t.kind != tokenString && t.kind != tokenNumber {
+				return nil, fmt.Errorf("expected a quoted field name in [] at %d", t.pos)
+			}
+			if p.next().kind != tokenRBracket {
+				return nil, fmt.Errorf("missing ] at %d", t.pos)
+			}
+			path = append(path, t.text)
+		default:
+			return pathExpr{path}, nil
+		}
+	}
+}
+
+type (
+	orExpr      struct{ left, right Expr }
+	andExpr     struct{ left, right Expr }
+	notExpr     struct{ inner Expr }
+	literalExpr struct{ value interface{} }
+	pathExpr    struct{ path []string }
+	compareExpr struct {
+		op          string
+		left, right Expr
+	}
+	matchExpr struct {
+		negate bool
+		value  Expr
+		re     *regexp.Regexp
+	}
+)
+
+func (e orExpr) eval(fields map[string]interface{}) interface{} {
+	return truthy(e.left.eval(fields)) || truthy(e.right.eval(fields))
+}
+
+func (e andExpr) eval(fields map[string]interface{}) interface{} {
+	return truthy(e.left.eval(fields)) && truthy(e.right.eval(fields))
+}
+
+func (e notExpr) eval(fields map[string]interface{}) interface{} {
+	return !truthy(e.inner.eval(fields))
+}
+
+func (e literalExpr) eval(fields map[string]interface{}) interface{} {
+	return e.value
+}
+
+func (e pathExpr) eval(fields map[string]interface{}) interface{} {
+	var value interface{} = fields
+	for _, key := range e.path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			found, ok := v[key]
+			if !ok {
+				found, ok = lookupFold(v, key)
+			}
+			if !ok {
+				return nil
+			}
+			value = found
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err == nil {
+				if index < 0 || index >= len(v) {
+					return nil
+				}
+				value = v[index]
+				continue
+			}
+			// CIP-25 traits are often a list of single key maps, look the key up in each
+			values := make([]interface{}, 0)
+			for _, element := range v {
+				if m, ok := element.(map[string]interface{}); ok {
+					if found, ok := m[key]; ok {
+						values = append(values, found)
+					} else if found, ok := lookupFold(m, key); ok {
+						values = append(values, found)
+					}
+				}
+			}
+			if len(values) == 0 {
+				return nil
+			}
+			value = values
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+func (e compareExpr) eval(fields map[string]interface{}) interface{} {
+	left := e.left.eval(fields)
+	right := e.right.eval(fields)
+
+	if list, ok := left.([]interface{}); ok {
+		for _, element := range list {
+			if compare(e.op, element, right) {
+				return true
+			}
+		}
+		return e.op == "!=" && len(list) == 0
+	}
+
+	return compare(e.op, left, right)
+}
+
+func (e matchExpr) eval(fields map[string]interface{}) interface{} {
+	value := e.value.eval(fields)
+
+	matched := false
+	if list, ok := value.([]interface{}); ok {
+		for _, element := range list {
+			if element != nil && e.re.MatchString(fmt.Sprint(element)) {
+				matched = true
+			}
+		}
+	} else if value != nil {
+		matched = e.re.MatchString(fmt.Sprint(value))
+	}
+
+	return matched != e.negate
+}
+
+// lookupFold finds a metadata key ignoring case, trait names are not capitalized consistently
+func lookupFold(m map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func compare(op string, left, right interface{}) bool {
+	leftNumber, leftIsNumber := toNumber(left)
+	rightNumber, rightIsNumber := toNumber(right)
+	if leftIsNumber && !rightIsNumber {
+		rightNumber, rightIsNumber = decimalString(right)
+	} else if rightIsNumber && !leftIsNumber {
+		leftNumber, leftIsNumber = decimalString(left)
+	}
+
+	if leftIsNumber && rightIsNumber {
+		switch op {
+		case "==":
+			return leftNumber == rightNumber
+		case "!=":
+			return leftNumber != rightNumber
+		case "<":
+			return leftNumber < rightNumber
+		case "<=":
+			return leftNumber <= rightNumber
+		case ">":
+			return leftNumber > rightNumber
+		case ">=":
+			return leftNumber >= rightNumber
+		}
+	}
+
+	switch op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	// ordering only applies to numbers
+	return false
+}
+
+func equal(left, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == nil && right == nil
+	}
+
+	switch l := left.(type) {
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	}
+
+	return fmt.Sprint(left) == fmt.Sprint(right)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// decimalString reads a plain decimal string as a number, metadata often stores numbers as
+// strings. Hex, exponents, inf and nan stay strings
+func decimalString(value interface{}) (float64, bool) {
+	s, ok := value.(string)
+	if !ok || !decimalPattern.MatchString(strings.TrimSpace(s)) {
+		return 0, false
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return number, err == nil
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+
+	return true
+}
@@ -0,0 +1,148 @@
+package roles
+
+import (
+	"strings"
+	"testing"
+)
+
+func testFields() map[string]interface{} {
+	return map[string]interface{}{
+		"policy":   "policy-1",
+		"name":     "ZombieChain042",
+		"quantity": "12",
+		"rarity":   3.0,
+		"meta": map[string]interface{}{
+			"rarity":     "Legendary",
+			"rank":       "007",
+			"level":      7.0,
+			"hex":        "0x10",
+			"big":        "inf",
+			"exponent":   "1e3",
+			"thousand":   "1000",
+			"Background": "Gold",
+			"empty":      "",
+			"traits": []interface{}{
+				map[string]interface{}{"eyes": "Red"},
+				map[string]interface{}{"hat": "Crown"},
+			},
+			"tags": []interface{}{"zombie", "chain"},
+		},
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// fields and literals
+		{`meta.rarity == "Legendary"`, true},
+		{`meta.rarity != "Legendary"`, false},
+		{`meta["Background"] == "Gold"`, true},
+		{`meta.background == "Gold"`, true},
+		{`meta.missing == null`, true},
+		{`meta.missing`, false},
+		{`meta.empty`, false},
+		{`meta.rarity`, true},
+		{`true`, true},
+		{`false`, false},
+
+		// precedence, && binds tighter than || and ! tighter than both
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!true || true`, true},
+		{`false || false || true`, true},
+		{`true && true && !true`, false},
+		{`quantity > 10 && meta.rarity == "Legendary" || meta.rarity == "Common"`, true},
+		{`quantity > 20 && (meta.rarity == "Legendary" || meta.rarity == "Common")`, false},
+
+		// numbers
+		{`quantity >= 10`, true},
+		{`quantity < 10`, false},
+		{`quantity == 12`, true},
+		{`rarity <= 3`, true},
+		{`rarity > 3`, false},
+		{`meta.level == 7`, true},
+		{`meta.level >= -1`, true},
+		{`meta.rank == 7`, true},
+		{`7 == meta.rank`, true},
+
+		// strings compare as text, only plain decimals compare as numbers against numbers
+		{`quantity == "12"`, true},
+		{`meta.rank == "7"`, false},
+		{`meta.rank == "007"`, true},
+		{`meta.exponent == meta.thousand`, false},
+		{`meta.exponent == 1000`, false},
+		{`meta.exponent == "1e3"`, true},
+		{`meta.hex == 16`, false},
+		{`meta.big > 1`, false},
+		{`meta.rank > "1"`, false},
+		{`meta.rarity > 1`, false},
+		{`meta.rarity == 0`, false},
+
+		// lists match if any element does
+		{`meta.tags == "chain"`, true},
+		{`meta.tags == "hunter"`, false},
+		{`meta.tags != "zombie"`, true},
+		{`meta.traits.hat == "Crown"`, true},
+		{`meta.traits.eyes == "Blue"`, false},
+		{`meta.tags.0 == "zombie"`, true},
+		{`meta.tags.5 == null`, true},
+
+		// regex
+		{`name ~ "^ZombieChain0[0-9]{2}$"`, true},
+		{`name !~ "^ZombieChain0[0-9]{2}$"`, false},
+		{`meta.tags ~ "^ch"`, true},
+		{`meta.missing ~ ".*"`, false},
+		{`meta.missing !~ ".*"`, true},
+		{`name ~ 'Chain\\d+'`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := Compile(test.expr)
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			if got := Eval(expr, testFields()); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, `unexpected "end of expression" at 0`},
+		{`meta.rarity == "Legendary`, `unterminated string at 15`},
+		{`(quantity > 1`, `missing ) for ( at 0`},
+		{`meta["rarity" == 1`, `missing ] at 5`},
+		{`meta[rarity] == 1`, `expected a quoted field name in [] at 5`},
+		{`meta. == 1`, `expected a field name after . at 6`},
+		{`name ~ 1`, `expected a quoted regex after ~ at 7`},
+		{`name ~ "("`, `invalid regex at 7`},
+		{`quantity > 1 2`, `unexpected "2" at 13`},
+		{`quantity >`, `unexpected "end of expression" at 10`},
+		{`quantity = 1`, `unexpected "=" at 9`},
+		{`quantity == 1.2.3`, `invalid number 1.2.3 at 12`},
+		{`&& true`, `unexpected "&&" at 0`},
+		{`quantity # 1`, `unexpected "#" at 9`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			_, err := Compile(test.expr)
+			if err == nil {
+				t.Fatal("compiled, want an error")
+			}
+			if !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("got %q, want %q", err.Error(), test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package roles
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+)
+
+type (
+	// Rule grants a discord role to holders with at least Min assets matching an expression.
+	// Policy limits the rule to one policy and makes sure its assets are queried, MinQuantity
+	// also requires the total quantity of the matching assets, adjusted for decimals.
+	// MinRarity requires the rarest matching asset to score at least that much and
+	// MinRaritySum the scores of all matching assets added up. MinHeldDays only counts
+	// assets the holder has held continuously for at least that many days.
+	// Source picks what the rule checks, assets by default or delegation, which requires
+	// the holder's stake keys to be delegated to one of Pools with at least MinAda
+	Rule struct {
+		Name         string   `json:"name"`
+		RoleID       string   `json:"role"`
+		Source       string   `json:"source"`
+		Policy       string   `json:"policy"`
+		Match        string   `json:"match"`
+		Min          int      `json:"min"`
+		MinQuantity  string   `json:"minQuantity"`
+		MinRarity    float64  `json:"minRarity"`
+		MinRaritySum float64  `json:"minRaritySum"`
+		MinHeldDays  int      `json:"minHeldDays"`
+		Pools        []string `json:"pools"`
+		MinAda       string   `json:"minAda"`
+
+		expr        Expr
+		minQuantity *big.Rat
+		minAda      *big.Rat
+	}
+
+	// Holder is what rules are evaluated against for a discord user. Counts has the assets of
+	// policies only count rules look at, counted without fetching their metadata
+	Holder struct {
+		Assets         []nftkeyme.Asset
+		Rarity         RarityScorer
+		StakeAddresses []string
+		History        HoldingHistory
+		Counts         map[string]nftkeyme.AssetCount
+	}
+
+	// RarityScorer looks up the rarity score of an asset
+	RarityScorer interface {
+		Score(policyID, assetName string) (float64, bool)
+	}
+
+	// HoldingHistory looks up since when an asset has been held without interruption
+	HoldingHistory interface {
+		HeldSince(policyID, assetName string) (time.Time, bool)
+	}
+)
+
+// LoadRules loads and compiles role rules from a json file
+func LoadRules(path string) ([]Rule, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]Rule, 0)
+	err = json.Unmarshal(bytes, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing role rules %s: %v", path, err)
+	}
+
+	return CompileRules(rules)
+}
+
+// CompileRules validates rules and compiles their match expressions
+func CompileRules(rules []Rule) ([]Rule, error) {
+	compiled := make([]Rule, 0)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.RoleID == "" {
+			return nil, fmt.Errorf("Role rule %s has no role", rule.Name)
+		}
+		if rule.Source == "" {
+			rule.Source = SourceAssets
+		}
+
+		var err error
+		switch rule.Source {
+		case SourceAssets:
+			err = rule.compileAssets()
+		case SourceDelegation:
+			err = rule.compileDelegation()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Role rule %s: %v", rule.Name, err)
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled, nil
+}
+
+func (r *Rule) compileAssets() error {
+	if r.MinRarity < 0 || r.MinRaritySum < 0 {
+		return fmt.Errorf("rarity thresholds can't be negative")
+	}
+	if r.MinHeldDays < 0 {
+		return fmt.Errorf("minHeldDays can't be negative")
+	}
+	if r.Match == "" && r.Policy == "" {
+		return fmt.Errorf("needs a policy or a match expression")
+	}
+	if r.Min <= 0 {
+		r.Min = 1
+	}
+
+	if r.Match != "" {
+		expr, err := Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match expression: %v", err)
+		}
+		r.expr = expr
+	}
+
+	if r.MinQuantity != "" {
+		minQuantity, ok := new(big.Rat).SetString(r.MinQuantity)
+		if !ok || minQuantity.Sign() < 0 {
+			return fmt.Errorf("invalid minQuantity %s", r.MinQuantity)
+		}
+		r.minQuantity = minQuantity
+	}
+
+	return nil
+}
+
+func (r *Rule) compileDelegation() error {
+	if len(r.Pools) == 0 {
+		return fmt.Errorf("delegation rules need pools")
+	}
+
+	r.minAda = new(big.Rat)
+	if r.MinAda != "" {
+		minAda, ok := new(big.Rat).SetString(r.MinAda)
+		if !ok || minAda.Sign() < 0 {
+			return fmt.Errorf("invalid minAda %s", r.MinAda)
+		}
+		r.minAda = minAda
+	}
+
+	return nil
+}
+
+// matching returns the assets the rule applies to
+func (r Rule) matching(holder Holder) []nftkeyme.Asset {
+	matched := make([]nftkeyme.Asset, 0)
+	for _, asset := range holder.Assets {
+		if r.Policy != "" && asset.PolicyId != r.Policy {
+			continue
+		}
+		if r.expr != nil && !Eval(r.expr, holder.Fields(asset)) {
+			continue
+		}
+		if r.MinHeldDays > 0 && holder.heldDays(asset) < r.MinHeldDays {
+			continue
+		}
+		matched = append(matched, asset)
+	}
+
+	return matched
+}
+
+// CountOnly checks if the rule only needs how many assets of its policy the holder has
+func (r Rule) CountOnly() bool {
+	return r.Source == SourceAssets && r.Policy != "" && r.Match == "" && r.MinQuantity == "" &&
+		r.MinRarity == 0 && r.MinRaritySum == 0 && r.MinHeldDays == 0
+}
+
+// Count returns how many assets match the rule
+func (r Rule) Count(holder Holder) int {
+	if count, ok := holder.Counts[r.Policy]; ok && r.CountOnly() {
+		return count.Assets
+	}
+
+	return len(r.matching(holder))
+}
+
+// Matches checks if the holder's assets satisfy the rule
+func (r Rule) Matches(holder Holder) bool {
+	if count, ok := holder.Counts[r.Policy]; ok && r.CountOnly() {
+		return count.Assets >= r.Min
+	}
+
+	matched := r.matching(holder)
+	if len(matched) < r.Min {
+		return false
+	}
+
+	if r.minQuantity != nil && TotalAmount(matched).Cmp(r.minQuantity) < 0 {
+		return false
+	}
+
+	if r.MinRarity > 0 || r.MinRaritySum > 0 {
+		maxScore, sumScore := holder.rarity(matched)
+		if maxScore < r.MinRarity || sumScore < r.MinRaritySum {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rarity returns the highest and total rarity scores of the assets, unscored assets count 0
+func (h Holder) rarity(assets []nftkeyme.Asset) (float64, float64) {
+	maxScore, sumScore := 0.0, 0.0
+	if h.Rarity == nil {
+		return maxScore, sumScore
+	}
+
+	for _, asset := range assets {
+		score, ok := h.Rarity.Score(asset.PolicyId, asset.AssetName)
+		if !ok {
+			continue
+		}
+		sumScore += score
+		if score > maxScore {
+			maxScore = score
+		}
+	}
+
+	return maxScore, sumScore
+}
+
+// heldDays returns the whole days an asset has been held without interruption
+func (h Holder) heldDays(asset nftkeyme.Asset) int {
+	if h.History == nil {
+		return 0
+	}
+
+	since, ok := h.History.HeldSince(asset.PolicyId, asset.AssetName)
+	if !ok {
+		return 0
+	}
+
+	return int(time.Since(since).Hours() / 24)
+}
+
+// TotalAmount sums asset quantities adjusted for decimals
+func TotalAmount(assets []nftkeyme.Asset) *big.Rat {
+	total := new(big.Rat)
+	for _, asset := range assets {
+		total.Add(total, asset.Amount())
+	}
+
+	return total
+}
+
+// Fields returns the fields of an asset that expressions can use
+func (h Holder) Fields(asset nftkeyme.Asset) map[string]interface{} {
+	fields := map[string]interface{}{
+		"policy":   asset.PolicyId,
+		"name":     asset.AssetName,
+		"quantity": asset.Quantity,
+		"meta":     asset.OnChainMetadata,
+	}
+
+	if h.Rarity != nil {
+		if score, ok := h.Rarity.Score(asset.PolicyId, asset.AssetName); ok {
+			fields["rarity"] = score
+		}
+	}
+
+	if h.History != nil {
+		if _, ok := h.History.HeldSince(asset.PolicyId, asset.AssetName); ok {
+			fields["heldDays"] = h.heldDays(asset)
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,69 @@
+package roles
+
+import (
+	"testing"
+
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/reliablestaking/nftkeyme-discord/rarity"
+)
+
+func TestRuleRarityThresholds(t *testing.T) {
+	// A scores 4 + 4/3, B and D 2 + 4/3 and C 8
+	scores := rarity.Score(map[string]map[string]string{
+		"A": {"Background": "Gold", "Hat": "Cap"},
+		"B": {"Background": "Blue", "Hat": "Cap"},
+		"C": {"Background": "Red"},
+		"D": {"Background": "Blue", "Hat": "Cap"},
+	})
+	collections := rarity.Collections{"policy": {PolicyID: "policy", Scores: scores, MaxScore: scores["C"]}}
+
+	tests := []struct {
+		name   string
+		rule   Rule
+		assets []string
+		want   bool
+	}{
+		{"rarest above min", Rule{MinRarity: 3}, []string{"B", "D"}, true},
+		{"rarest below min", Rule{MinRarity: 4}, []string{"B", "D"}, false},
+		{"one rare asset is enough", Rule{MinRarity: 7}, []string{"B", "C"}, true},
+		{"sum above min", Rule{MinRaritySum: 6.5}, []string{"B", "D"}, true},
+		{"sum below min", Rule{MinRaritySum: 7}, []string{"B", "D"}, false},
+		{"both met", Rule{MinRarity: 5, MinRaritySum: 13}, []string{"A", "C"}, true},
+		{"sum met but not rarest", Rule{MinRarity: 8.5, MinRaritySum: 13}, []string{"A", "C"}, false},
+		{"unscored assets count 0", Rule{MinRarity: 0.5}, []string{"X"}, false},
+		{"only matching assets are scored", Rule{Match: `rarity < 4`, MinRaritySum: 7}, []string{"B", "C", "D"}, false},
+		{"min assets still applies", Rule{Min: 2, MinRarity: 7}, []string{"C"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.RoleID = "role"
+			test.rule.Policy = "policy"
+			rules, err := CompileRules([]Rule{test.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			holder := Holder{Rarity: collections}
+			for _, assetName := range test.assets {
+				holder.Assets = append(holder.Assets, nftkeyme.Asset{PolicyId: "policy", AssetName: assetName, Quantity: "1"})
+			}
+
+			if got := rules[0].Matches(holder); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleRarityThresholdsCantBeNegative(t *testing.T) {
+	for _, rule := range []Rule{
+		{RoleID: "role", Policy: "policy", MinRarity: -1},
+		{RoleID: "role", Policy: "policy", MinRaritySum: -1},
+	} {
+		_, err := CompileRules([]Rule{rule})
+		if err == nil {
+			t.Errorf("compiled %+v", rule)
+		}
+	}
+}
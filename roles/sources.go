@@ -0,0 +1,92 @@
+package roles
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/reliablestaking/nftkeyme-discord/chain"
+)
+
+const (
+	// SourceAssets checks the holder's assets, the default
+	SourceAssets = "assets"
+	// SourceDelegation checks the holder's stake key delegation
+	SourceDelegation = "delegation"
+
+	lovelacePerAda = 1000000
+)
+
+type (
+	// Source checks one kind of eligibility, rules pick a source by name
+	Source interface {
+		Name() string
+		Eligible(ctx context.Context, rule Rule, holder Holder) (bool, error)
+	}
+
+	// runSource is a source keeping state for one evaluation, like looked up accounts,
+	// the engine asks for a fresh one on every run
+	runSource interface {
+		forRun() Source
+	}
+
+	// AssetSource checks the assets returned by nftkeyme
+	AssetSource struct{}
+
+	// DelegationSource checks stake key delegation using on chain data
+	DelegationSource struct {
+		Client chain.Client
+	}
+)
+
+// Name of the source
+func (AssetSource) Name() string {
+	return SourceAssets
+}
+
+// Eligible checks the rule against the holder's assets
+func (AssetSource) Eligible(ctx context.Context, rule Rule, holder Holder) (bool, error) {
+	return rule.Matches(holder), nil
+}
+
+// Name of the source
+func (DelegationSource) Name() string {
+	return SourceDelegation
+}
+
+// forRun caches accounts for one evaluation, rules on the same holder share the lookups
+func (d DelegationSource) forRun() Source {
+	return DelegationSource{Client: chain.NewCachedClient(d.Client)}
+}
+
+// Eligible adds up the ada controlled by the holder's stake keys delegated to one of the
+// rule's pools and checks it against the rule's minimum
+func (d DelegationSource) Eligible(ctx context.Context, rule Rule, holder Holder) (bool, error) {
+	pools := make(map[string]bool)
+	for _, pool := range rule.Pools {
+		pools[pool] = true
+	}
+
+	delegated := false
+	total := new(big.Int)
+	for _, stakeAddress := range holder.StakeAddresses {
+		account, err := d.Client.GetAccount(ctx, stakeAddress)
+		if err != nil {
+			return false, err
+		}
+		if account == nil || !account.Active || !pools[account.PoolID] {
+			continue
+		}
+
+		delegated = true
+		lovelace, ok := new(big.Int).SetString(account.ControlledAmount, 10)
+		if ok {
+			total.Add(total, lovelace)
+		}
+	}
+	if !delegated {
+		return false, nil
+	}
+
+	ada := new(big.Rat).SetFrac(total, big.NewInt(lovelacePerAda))
+	return ada.Cmp(rule.minAda) >= 0, nil
+}
@@ -0,0 +1,60 @@
+package roles
+
+import (
+	"context"
+	"testing"
+
+	"github.com/reliablestaking/nftkeyme-discord/chain"
+)
+
+// countingClient counts the lookups of each stake address
+type countingClient struct {
+	accounts chain.StubClient
+	lookups  map[string]int
+}
+
+func (c countingClient) GetAccount(ctx context.Context, stakeAddress string) (*chain.Account, error) {
+	c.lookups[stakeAddress]++
+	return c.accounts.GetAccount(ctx, stakeAddress)
+}
+
+func TestEvaluateCachesAccountsPerRun(t *testing.T) {
+	client := countingClient{
+		accounts: chain.StubClient{
+			"stake-1": {StakeAddress: "stake-1", Active: true, PoolID: "pool-1", ControlledAmount: "5000000"},
+		},
+		lookups: make(map[string]int),
+	}
+	rules, err := CompileRules([]Rule{
+		{Name: "delegator", RoleID: "role-1", Source: SourceDelegation, Pools: []string{"pool-1"}, MinAda: "1"},
+		{Name: "big delegator", RoleID: "role-2", Source: SourceDelegation, Pools: []string{"pool-1"}, MinAda: "10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewEngine(rules, DelegationSource{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := Holder{StakeAddresses: []string{"stake-1", "stake-2"}}
+	grants, err := engine.Evaluate(context.Background(), holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !grants["role-1"] || grants["role-2"] {
+		t.Errorf("got grants %v, want only role-1", grants)
+	}
+	if client.lookups["stake-1"] != 1 || client.lookups["stake-2"] != 1 {
+		t.Errorf("got lookups %v, want one per stake address", client.lookups)
+	}
+
+	// the next run looks the accounts up again
+	_, err = engine.Evaluate(context.Background(), holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.lookups["stake-1"] != 2 {
+		t.Errorf("got %d lookups after the second run, want 2", client.lookups["stake-1"])
+	}
+}
@@ -0,0 +1,518 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// AccountActionUnlink removes the link and all data for the user
+	AccountActionUnlink = "unlink"
+	// AccountActionExport downloads all data stored for the user
+	AccountActionExport = "export"
+	// AccountActionManage logs in to manage linked nftkeyme accounts
+	AccountActionManage = "manage"
+
+	accountStateCookieName = "account_state"
+
+	auditActionUnlink     = "unlink"
+	auditActionErase      = "erase"
+	auditActionRemoveLink = "remove_link"
+)
+
+type (
+	// UserExport holds everything stored about a user
+	UserExport struct {
+		ExportedAt        time.Time          `json:"exportedAt"`
+		DiscordUserID     string             `json:"discordUserId"`
+		DiscordUsername   string             `json:"discordUsername"`
+		DiscordEmail      string             `json:"discordEmail"`
+		NumAssets         *int64             `json:"numAssets"`
+		Locale            string             `json:"locale"`
+		DmOptOut          bool               `json:"dmOptOut"`
+		LeaderboardOptOut bool               `json:"leaderboardOptOut"`
+		NftkeymeLinks     []LinkExport       `json:"nftkeymeLinks"`
+		AuditEvents       []db.AuditEvent    `json:"auditEvents"`
+		AssetHoldings     []db.AssetHolding  `json:"assetHoldings"`
+		AssetSnapshots    []db.AssetSnapshot `json:"assetSnapshots"`
+		GiveawayEntries   []db.GiveawayEntry `json:"giveawayEntries"`
+	}
+
+	// LinkExport holds what is stored about a linked nftkeyme account, tokens are not exported
+	LinkExport struct {
+		NftkeymeID    string    `json:"nftkeymeId"`
+		NftkeymeEmail string    `json:"nftkeymeEmail"`
+		TokensStored  bool      `json:"tokensStored"`
+		NumAssets     *int64    `json:"numAssets"`
+		LinkedAt      time.Time `json:"linkedAt"`
+	}
+)
+
+// removeUser revokes the user's nftkeyme refresh token, removes their managed roles,
+// deletes everything stored for them and records it in the audit trail. Returns false
+// if the user was not found
+func (s Server) removeUser(ctx context.Context, log *logrus.Entry, discordUserID, action, actor string) (bool, error) {
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		return false, err
+	}
+	if discordUser == nil {
+		return false, nil
+	}
+
+	links, err := s.Store.GetNftkeymeLinks(discordUserID)
+	if err != nil {
+		return false, err
+	}
+
+	notes := make([]string, 0)
+	for _, link := range links {
+		notes = append(notes, s.revokeLinkToken(ctx, log, link))
+	}
+
+	err = s.removeManagedRoles(log, discordUserID)
+	if err != nil {
+		return false, err
+	}
+	notes = append(notes, "roles removed")
+
+	err = s.Store.DeleteDiscordUser(discordUserID)
+	if err != nil {
+		return false, err
+	}
+	notes = append(notes, "data deleted")
+
+	err = s.Store.InsertAuditEvent(action, discordUserID, actor, strings.Join(notes, ", "))
+	if err != nil {
+		log.WithError(err).Error("Error recording audit event")
+		return true, err
+	}
+
+	log.Infof("Removed discord user %s (%s by %s)", discordUserID, action, actor)
+	return true, nil
+}
+
+// revokeLinkToken revokes the refresh token of a link, returning a note for the audit trail.
+// Removal still goes ahead if revoking fails, the token is deleted on our side
+func (s Server) revokeLinkToken(ctx context.Context, log *logrus.Entry, link db.NftkeymeLink) string {
+	if link.NftkeymeRefreshToken.String == "" {
+		return fmt.Sprintf("link %s had no token", link.NftkeymeID)
+	}
+
+	err := s.NftkeymeClient.RevokeToken(ctx, link.NftkeymeRefreshToken.String)
+	if err != nil {
+		log.WithError(err).Errorf("Error revoking nftkeyme token for %s", link.NftkeymeID)
+		return fmt.Sprintf("link %s token revoke failed: %s", link.NftkeymeID, err.Error())
+	}
+
+	return fmt.Sprintf("link %s token revoked", link.NftkeymeID)
+}
+
+// removeLink unlinks one nftkeyme account from a user and reassigns roles from the rest
+func (s Server) removeLink(ctx context.Context, log *logrus.Entry, discordUserID string, linkID int, action, actor string) (bool, error) {
+	links, err := s.Store.GetNftkeymeLinks(discordUserID)
+	if err != nil {
+		return false, &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	var link *db.NftkeymeLink
+	for i := range links {
+		if links[i].ID == linkID {
+			link = &links[i]
+		}
+	}
+	if link == nil {
+		return false, nil
+	}
+
+	note := s.revokeLinkToken(ctx, log, *link)
+	err = s.Store.DeleteNftkeymeLink(link.ID)
+	if err != nil {
+		return false, &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	err = s.Store.InsertAuditEvent(action, discordUserID, actor, note)
+	if err != nil {
+		log.WithError(err).Error("Error recording audit event")
+	}
+
+	if len(links) == 1 {
+		err = s.Store.UpdateDiscordUserNumAssets(discordUserID, 0, 0, 0)
+		if err != nil {
+			return true, &flowError{Kind: ErrorKindStorage, Err: err}
+		}
+		_, err = s.recordHoldings(log, discordUserID, nil, true)
+		if err != nil {
+			return true, err
+		}
+		err = s.recordSnapshot(log, discordUserID, nil, 0)
+		if err != nil {
+			return true, err
+		}
+		err = s.removeManagedRoles(log, discordUserID)
+		if err != nil {
+			return true, &flowError{Kind: discordErrorKind(err), Err: err}
+		}
+		return true, nil
+	}
+
+	return true, s.assignRoles(ctx, log, discordUserID)
+}
+
+// removeManagedRoles removes every role in the role map from the user
+func (s Server) removeManagedRoles(log *logrus.Entry, discordUserID string) error {
+	for _, roleID := range s.roleConfig().managedRoleIDs() {
+		err := s.Discord.GuildMemberRoleRemove(s.DiscordServerID, discordUserID, roleID)
+		if err != nil {
+			if discordErrorKind(err) == ErrorKindNotInGuild {
+				log.Infof("User %s no longer in server, skipping role removal", discordUserID)
+				return nil
+			}
+			log.WithError(err).Errorf("Error removing user from role %s", roleID)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportUser gathers everything stored about a user, nil if not found
+func (s Server) exportUser(discordUserID string) (*UserExport, error) {
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := s.Store.GetNftkeymeLinks(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	auditEvents, err := s.Store.GetAuditEventsForDiscordUser(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	assetHoldings, err := s.Store.GetAssetHoldings(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	assetSnapshots, err := s.Store.GetAssetSnapshotsForDiscordUser(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	giveawayEntries, err := s.Store.GetGiveawayEntriesForDiscordUser(discordUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if discordUser == nil && len(auditEvents) == 0 {
+		return nil, nil
+	}
+
+	export := UserExport{
+		ExportedAt:      time.Now().UTC(),
+		DiscordUserID:   discordUserID,
+		NftkeymeLinks:   make([]LinkExport, 0),
+		AuditEvents:     auditEvents,
+		AssetHoldings:   assetHoldings,
+		AssetSnapshots:  assetSnapshots,
+		GiveawayEntries: giveawayEntries,
+	}
+	if discordUser != nil {
+		export.DiscordUsername = discordUser.DiscordUsername
+		export.DiscordEmail = discordUser.DiscordEmail
+		if discordUser.NumAssets.Valid {
+			export.NumAssets = &discordUser.NumAssets.Int64
+		}
+		export.Locale = discordUser.Locale.String
+		export.DmOptOut = discordUser.DmOptOut
+		export.LeaderboardOptOut = discordUser.LeaderboardOptOut
+	}
+	for _, link := range links {
+		linkExport := LinkExport{
+			NftkeymeID:    link.NftkeymeID,
+			NftkeymeEmail: link.NftkeymeEmail.String,
+			TokensStored:  link.NftkeymeAccessToken.Valid || link.NftkeymeRefreshToken.Valid,
+			LinkedAt:      link.CreatedAt,
+		}
+		if link.NumAssets.Valid {
+			numAssets := link.NumAssets.Int64
+			linkExport.NumAssets = &numAssets
+		}
+		export.NftkeymeLinks = append(export.NftkeymeLinks, linkExport)
+	}
+
+	return &export, nil
+}
+
+// accountPage holds what is shown on the account page
+type accountPage struct {
+	L           i18n.Localizer
+	Heading     string
+	Description string
+	Actions     bool
+	LoggedIn    bool
+	Links       []db.NftkeymeLink
+	ManageLink  string
+	AddLink     string
+	ExportLink  string
+	UnlinkLink  string
+
+	// set to ask the user to confirm unlinking
+	UnlinkConfirm bool
+	UnlinkToken   string
+}
+
+// RenderAccount renders the page to manage linked accounts, download or delete stored data
+func (s Server) RenderAccount(c echo.Context) error {
+	l := s.localizer(c)
+	page := s.newAccountPage(l, l.T("account.heading"), l.T("account.description"))
+	page.Actions = true
+
+	discordUserID := s.sessionUser(c)
+	if discordUserID != "" {
+		links, err := s.Store.GetNftkeymeLinks(discordUserID)
+		if err != nil {
+			requestLogger(c).WithError(err).Error("Error getting nftkeyme links")
+			return s.RenderError(c, ErrorKindStorage)
+		}
+		page.LoggedIn = true
+		page.Links = links
+	}
+
+	return s.renderAccountPage(c, page)
+}
+
+func (s Server) newAccountPage(l i18n.Localizer, heading, description string) accountPage {
+	return accountPage{
+		L:           l,
+		Heading:     heading,
+		Description: description,
+		ManageLink:  "/init?action=" + AccountActionManage,
+		AddLink:     "/account/links/add",
+		ExportLink:  "/init?action=" + AccountActionExport,
+		UnlinkLink:  "/init?action=" + AccountActionUnlink,
+	}
+}
+
+func (s Server) renderAccountPage(c echo.Context, page accountPage) error {
+	err := c.Render(http.StatusOK, "account.html", page)
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error rendering account template")
+	}
+	return err
+}
+
+// AddNftkeymeLink sends a logged in user to nftkeyme to link another account
+func (s Server) AddNftkeymeLink(c echo.Context) error {
+	discordUserID := s.sessionUser(c)
+	if discordUserID == "" {
+		return c.Redirect(302, "/init?action="+AccountActionManage)
+	}
+
+	// force the login screen so a different nftkeyme account can be picked
+	url := s.NftkeymeOauthConfig.AuthCodeURL(discordUserID, oauth2.SetAuthURLParam("prompt", "login"))
+
+	return c.Redirect(302, url)
+}
+
+// DeleteNftkeymeLink unlinks one nftkeyme account from the logged in user
+func (s Server) DeleteNftkeymeLink(c echo.Context) error {
+	discordUserID := s.sessionUser(c)
+	if discordUserID == "" {
+		return c.Redirect(302, "/init?action="+AccountActionManage)
+	}
+	log := requestLogger(c).WithField("discord_user_id", discordUserID)
+
+	linkID, err := strconv.Atoi(c.Param("linkId"))
+	if err != nil {
+		return s.RenderError(c, ErrorKindInternal)
+	}
+
+	log.Infof("Removing nftkeyme link %d", linkID)
+	_, err = s.removeLink(c.Request().Context(), log, discordUserID, linkID, auditActionRemoveLink, "self")
+	if err != nil {
+		log.WithError(err).Error("Error removing nftkeyme link")
+		return s.RenderError(c, errorKindOf(err))
+	}
+
+	return c.Redirect(302, "/account")
+}
+
+// startAccountAction sends the user through discord login to prove who they are
+// before an account action, binding the oauth state to a cookie
+func (s Server) startAccountAction(c echo.Context, action string) error {
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error generating state")
+		return s.RenderError(c, ErrorKindInternal)
+	}
+	state := action + ":" + hex.EncodeToString(nonceBytes)
+
+	c.SetCookie(&http.Cookie{
+		Name:     accountStateCookieName,
+		Value:    state,
+		Path:     "/",
+		Expires:  time.Now().Add(15 * time.Minute),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL, err := url.Parse(s.DiscordAuthCodeURL)
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error parsing discord auth url")
+		return s.RenderError(c, ErrorKindInternal)
+	}
+	q := authURL.Query()
+	q.Set("state", state)
+	authURL.RawQuery = q.Encode()
+
+	return c.Redirect(302, authURL.String())
+}
+
+// accountAction returns the account action for the discord callback, empty for the
+// normal link flow. Errors if the state doesn't match the one we issued
+func (s Server) accountAction(c echo.Context) (string, error) {
+	state := c.QueryParam("state")
+	action := strings.SplitN(state, ":", 2)[0]
+	if action != AccountActionUnlink && action != AccountActionExport && action != AccountActionManage {
+		return "", nil
+	}
+
+	cookie, err := c.Cookie(accountStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return "", errors.New("account action state mismatch")
+	}
+	c.SetCookie(&http.Cookie{Name: accountStateCookieName, Path: "/", MaxAge: -1})
+
+	return action, nil
+}
+
+// handleAccountAction runs an account action for a discord user who just logged in
+func (s Server) handleAccountAction(c echo.Context, log *logrus.Entry, action, discordUserID string) error {
+	l := s.localizer(c)
+	notFound := s.newAccountPage(l, l.T("account.heading"), l.T("account.not_found"))
+	switch action {
+	case AccountActionManage:
+		return c.Redirect(302, "/account")
+	case AccountActionExport:
+		export, err := s.exportUser(discordUserID)
+		if err != nil {
+			log.WithError(err).Error("Error exporting user")
+			return s.RenderError(c, ErrorKindStorage)
+		}
+		if export == nil {
+			return s.renderAccountPage(c, notFound)
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"nftkeyme-discord-%s.json\"", discordUserID))
+		return c.JSONPretty(http.StatusOK, export, "  ")
+	case AccountActionUnlink:
+		page := s.newAccountPage(l, l.T("account.unlink_confirm.heading"), l.T("account.unlink_confirm.description"))
+		page.UnlinkConfirm = true
+		page.UnlinkToken = s.unlinkToken(discordUserID)
+		return s.renderAccountPage(c, page)
+	}
+
+	return s.RenderError(c, ErrorKindInternal)
+}
+
+// UnlinkAccount unlinks the logged in user and deletes their data once they confirmed it on
+// the page shown after logging in, the form carries a token bound to the user
+func (s Server) UnlinkAccount(c echo.Context) error {
+	discordUserID := s.sessionUser(c)
+	if discordUserID == "" {
+		return c.Redirect(302, "/init?action="+AccountActionUnlink)
+	}
+	log := requestLogger(c).WithField("discord_user_id", discordUserID)
+
+	if !s.validUnlinkToken(discordUserID, c.FormValue("token")) {
+		log.Warn("Unlink confirmation token is invalid or expired")
+		return s.RenderError(c, ErrorKindSessionNotFound)
+	}
+
+	l := s.localizer(c)
+	found, err := s.removeUser(c.Request().Context(), log, discordUserID, auditActionUnlink, "self")
+	if err != nil {
+		log.WithError(err).Error("Error unlinking user")
+		return s.RenderError(c, errorKindOfRemoval(err))
+	}
+	if !found {
+		return s.renderAccountPage(c, s.newAccountPage(l, l.T("account.heading"), l.T("account.not_found")))
+	}
+
+	return s.renderAccountPage(c, s.newAccountPage(l, l.T("account.unlinked.heading"), l.T("account.unlinked.description")))
+}
+
+// errorKindOfRemoval maps a removeUser error to an ErrorKind
+func errorKindOfRemoval(err error) ErrorKind {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return ErrorKindDiscordUnavailable
+	}
+
+	return ErrorKindStorage
+}
+
+// adminAuth checks the admin api key, admin routes are disabled without one
+func adminAuth(apiKey string) func(key string, c echo.Context) (bool, error) {
+	return func(key string, c echo.Context) (bool, error) {
+		if apiKey == "" {
+			return false, nil
+		}
+		return subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1, nil
+	}
+}
+
+// AdminEraseUser revokes, de-roles and deletes all data for a user
+func (s Server) AdminEraseUser(c echo.Context) error {
+	discordUserID := c.Param("discordUserId")
+	log := requestLogger(c).WithField("discord_user_id", discordUserID)
+
+	found, err := s.removeUser(c.Request().Context(), log, discordUserID, auditActionErase, "admin")
+	if err != nil {
+		log.WithError(err).Error("Error erasing user")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if !found {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminExportUser returns everything stored about a user
+func (s Server) AdminExportUser(c echo.Context) error {
+	discordUserID := c.Param("discordUserId")
+	log := requestLogger(c).WithField("discord_user_id", discordUserID)
+
+	export, err := s.exportUser(discordUserID)
+	if err != nil {
+		log.WithError(err).Error("Error exporting user")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if export == nil {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+
+	return c.JSON(http.StatusOK, export)
+}
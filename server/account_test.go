@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// postUnlink posts the unlink confirmation form from the browser a discord user logged in
+// with, none if empty
+func (env *testEnv) postUnlink(t *testing.T, sessionUser, token string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Renderer = testRenderer{}
+	form := url.Values{"token": {token}}
+	req := httptest.NewRequest(http.MethodPost, "/account/unlink", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if sessionUser != "" {
+		login := httptest.NewRecorder()
+		env.server.setSession(e.NewContext(req, login), sessionUser)
+		req.Header.Set("Cookie", login.Header().Get("Set-Cookie"))
+	}
+	rec := httptest.NewRecorder()
+
+	err := env.server.UnlinkAccount(e.NewContext(req, rec))
+	if err != nil {
+		t.Fatalf("unlinking: %v", err)
+	}
+	return rec
+}
+
+func TestUnlinkAccountNeedsConfirmation(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"))
+
+	// logging in for the unlink action only asks to confirm
+	e := echo.New()
+	e.Renderer = testRenderer{}
+	rec := httptest.NewRecorder()
+	err := env.server.handleAccountAction(e.NewContext(httptest.NewRequest(http.MethodGet, "/discord", nil), rec), logrus.WithField("test", true), AccountActionUnlink, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := env.store.GetUserByDiscordID("user-1"); user == nil {
+		t.Fatal("user erased before confirming")
+	}
+
+	tests := []struct {
+		name        string
+		sessionUser string
+		token       string
+		status      int
+	}{
+		{"no session", "", env.server.unlinkToken("user-1"), http.StatusFound},
+		{"no token", "user-1", "", http.StatusBadRequest},
+		{"token of another user", "user-1", env.server.unlinkToken("user-2"), http.StatusBadRequest},
+		{"expired token", "user-1", "1|" + env.server.signSession("unlink|user-1|1"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := env.postUnlink(t, test.sessionUser, test.token)
+			if rec.Code != test.status {
+				t.Errorf("got status %d, want %d", rec.Code, test.status)
+			}
+			if user, _ := env.store.GetUserByDiscordID("user-1"); user == nil {
+				t.Error("user erased without a valid confirmation")
+			}
+		})
+	}
+
+	rec = env.postUnlink(t, "user-1", env.server.unlinkToken("user-1"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want the unlinked page", rec.Code)
+	}
+	if user, _ := env.store.GetUserByDiscordID("user-1"); user != nil {
+		t.Error("user not erased after confirming")
+	}
+	if len(env.nftkeyme.Revoked()) != 1 {
+		t.Error("refresh token not revoked")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/reliablestaking/nftkeyme-discord/announce"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+)
+
+// tierFor returns the role map tier for a number of assets, the highest threshold reached
+func (rc RoleConfig) tierFor(numAssets int) (int, string, bool) {
+	keys := make([]int, 0)
+	for k := range rc.RoleMap {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+
+	for _, k := range keys {
+		if numAssets >= k {
+			return k, rc.RoleMap[k], true
+		}
+	}
+
+	return 0, "", false
+}
+
+// tierChange describes how a verification changed a user's tier
+type tierChange struct {
+	FirstVerification bool
+	Upgrade           bool
+	Downgrade         bool
+	Tier              string
+	PreviousTier      string
+	NumAssets         int
+	PreviousNumAssets int
+	Chains            int
+	Hunters           int
+}
+
+// compareTiers compares the tier stored for the user before a verification with the new one
+func (rc RoleConfig) compareTiers(previous *db.DiscordUser, numAssets int) tierChange {
+	change := tierChange{NumAssets: numAssets}
+	newKey, newRoleID, hasNew := rc.tierFor(numAssets)
+	change.Tier = newRoleID
+
+	if previous == nil || !previous.NumAssets.Valid {
+		change.FirstVerification = true
+		return change
+	}
+
+	change.PreviousNumAssets = int(previous.NumAssets.Int64)
+	oldKey, oldRoleID, hasOld := rc.tierFor(change.PreviousNumAssets)
+	change.PreviousTier = oldRoleID
+
+	switch {
+	case hasNew && (!hasOld || newKey > oldKey):
+		change.Upgrade = true
+	case hasOld && (!hasNew || newKey < oldKey):
+		change.Downgrade = true
+	}
+
+	return change
+}
+
+// announceTierChange posts new verifications and tier changes to the channel
+func (s Server) announceTierChange(discordUser *db.DiscordUser, change tierChange) {
+	event := announce.Event{
+		NumAssets:         change.NumAssets,
+		PreviousNumAssets: change.PreviousNumAssets,
+		Tier:              roleMention(change.Tier),
+		PreviousTier:      roleMention(change.PreviousTier),
+	}
+	if discordUser != nil {
+		event.DiscordUserID = discordUser.DiscordUserID
+		event.Username = discordUser.DiscordUsername
+	}
+
+	switch {
+	case change.FirstVerification:
+		event.Kind = announce.EventVerified
+	case change.Upgrade:
+		event.Kind = announce.EventUpgrade
+	case change.Downgrade:
+		event.Kind = announce.EventDowngrade
+	default:
+		return
+	}
+
+	s.Announcer.Announce(event)
+}
+
+func roleMention(roleID string) string {
+	if roleID == "" {
+		return ""
+	}
+	return "<@&" + roleID + ">"
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/sirupsen/logrus"
+)
+
+// assetCacheKey is the cache key for an nftkeyme account's assets, with a field per policy
+func assetCacheKey(nftkeymeID string) string {
+	return "assets:" + nftkeymeID
+}
+
+// cachedAssets returns the cached assets of an nftkeyme account by policy, and the policies
+// that aren't cached
+func (s Server) cachedAssets(ctx context.Context, log *logrus.Entry, nftkeymeID string, policyIDs []string) (map[string][]nftkeyme.Asset, []string) {
+	buckets := make(map[string][]nftkeyme.Asset)
+	if s.AssetCache == nil || s.AssetCacheTTL <= 0 {
+		return buckets, policyIDs
+	}
+
+	missing := make([]string, 0)
+	for _, policyID := range policyIDs {
+		value, ok, err := s.AssetCache.Get(ctx, assetCacheKey(nftkeymeID), policyID)
+		if err != nil {
+			log.WithError(err).Warn("Error reading asset cache")
+			missing = append(missing, policyID)
+			continue
+		}
+		if !ok {
+			missing = append(missing, policyID)
+			continue
+		}
+
+		assets := make([]nftkeyme.Asset, 0)
+		err = json.Unmarshal(value, &assets)
+		if err != nil {
+			log.WithError(err).Warn("Error decoding cached assets")
+			missing = append(missing, policyID)
+			continue
+		}
+		buckets[policyID] = assets
+	}
+
+	return buckets, missing
+}
+
+// cacheAssets caches the assets of an nftkeyme account by policy
+func (s Server) cacheAssets(ctx context.Context, log *logrus.Entry, nftkeymeID string, buckets map[string][]nftkeyme.Asset) {
+	if s.AssetCache == nil || s.AssetCacheTTL <= 0 {
+		return
+	}
+
+	for policyID, assets := range buckets {
+		value, err := json.Marshal(assets)
+		if err != nil {
+			log.WithError(err).Warn("Error encoding assets to cache")
+			return
+		}
+		err = s.AssetCache.Set(ctx, assetCacheKey(nftkeymeID), policyID, value, s.AssetCacheTTL)
+		if err != nil {
+			log.WithError(err).Warn("Error writing asset cache")
+			return
+		}
+	}
+}
+
+// invalidateAssets drops the cached assets of an nftkeyme account, when it is linked or
+// transferred the next check fetches them again
+func (s Server) invalidateAssets(ctx context.Context, log *logrus.Entry, nftkeymeID string) {
+	if s.AssetCache == nil {
+		return
+	}
+
+	err := s.AssetCache.Delete(ctx, assetCacheKey(nftkeymeID))
+	if err != nil {
+		log.WithError(err).Warn("Error invalidating asset cache")
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/sirupsen/logrus"
+)
+
+// commandHandler handles a slash command for a user, returning the reply
+type commandHandler func(log *logrus.Entry, i *discordgo.InteractionCreate, discordUserID string, l i18n.Localizer) (string, error)
+
+// botCommands returns the slash commands registered in the discord server
+func (s Server) botCommands() []*discordgo.ApplicationCommand {
+	l := s.Messages.Localizer("")
+	return []*discordgo.ApplicationCommand{
+		{
+			Name:        "unlink",
+			Description: l.T("bot.unlink.description"),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "confirm",
+					Description: l.T("bot.unlink.option"),
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "notifications",
+			Description: l.T("bot.notifications.description"),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enabled",
+					Description: l.T("bot.notifications.option"),
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "leaderboard",
+			Description: l.T("bot.leaderboard.description"),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "collection",
+					Description: l.T("bot.leaderboard.option"),
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: l.T("leaderboard.tab.all"), Value: LeaderboardAll},
+						{Name: l.T("leaderboard.tab.chains"), Value: LeaderboardChains},
+						{Name: l.T("leaderboard.tab.hunters"), Value: LeaderboardHunters},
+					},
+				},
+			},
+		},
+		{
+			Name:        "privacy",
+			Description: l.T("bot.privacy.description"),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "leaderboard",
+					Description: l.T("bot.privacy.option"),
+					Required:    true,
+				},
+			},
+		},
+	}
+}
+
+func (s Server) commandHandlers() map[string]commandHandler {
+	return map[string]commandHandler{
+		"unlink":        s.commandUnlink,
+		"notifications": s.commandNotifications,
+		"leaderboard":   s.commandLeaderboard,
+		"privacy":       s.commandPrivacy,
+	}
+}
+
+// RunBot keeps the discord gateway open with slash commands registered until the context is
+// canceled. Only the leader runs it so every interaction is handled once
+func (s Server) RunBot(ctx context.Context) {
+	removeHandler := s.DiscordSession.AddHandler(s.handleInteraction)
+	defer removeHandler()
+
+	for {
+		err := s.startBot()
+		if err == nil {
+			break
+		}
+		logrus.WithError(err).Error("Error starting discord bot, slash commands unavailable")
+		s.DiscordSession.Close()
+		if !lifecycle.Sleep(ctx, time.Minute) {
+			return
+		}
+	}
+
+	<-ctx.Done()
+	err := s.DiscordSession.Close()
+	if err != nil {
+		logrus.WithError(err).Error("Error closing discord gateway")
+	}
+}
+
+// startBot opens the discord gateway and registers slash commands in the server
+func (s Server) startBot() error {
+	err := s.DiscordSession.Open()
+	if err != nil {
+		return err
+	}
+
+	botUser, err := s.DiscordSession.User("@me")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DiscordSession.ApplicationCommandBulkOverwrite(botUser.ID, s.DiscordServerID, s.botCommands())
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Registered %d slash commands", len(s.botCommands()))
+	return nil
+}
+
+// handleInteraction dispatches slash commands, replies are only visible to the caller
+func (s Server) handleInteraction(session *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	name := i.ApplicationCommandData().Name
+	handler, ok := s.commandHandlers()[name]
+	if !ok {
+		return
+	}
+
+	discordUserID := ""
+	if i.Member != nil && i.Member.User != nil {
+		discordUserID = i.Member.User.ID
+	} else if i.User != nil {
+		discordUserID = i.User.ID
+	}
+	log := logrus.WithField("interaction_id", i.ID).WithField("discord_user_id", discordUserID)
+	log.Infof("Handling slash command %s", name)
+	l := s.Messages.Localizer(s.Messages.Match(string(i.Locale)))
+
+	err := session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("Error acknowledging interaction")
+		return
+	}
+
+	reply, err := handler(log, i, discordUserID, l)
+	if err != nil {
+		log.WithError(err).Errorf("Error handling slash command %s", name)
+		reply = l.T("bot.error", i.ID)
+	}
+
+	_, err = session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &reply,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error replying to interaction")
+	}
+}
+
+// commandUnlink unlinks the caller and deletes their data
+func (s Server) commandUnlink(log *logrus.Entry, i *discordgo.InteractionCreate, discordUserID string, l i18n.Localizer) (string, error) {
+	confirmed := false
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "confirm" {
+			confirmed = option.BoolValue()
+		}
+	}
+	if !confirmed {
+		return l.T("bot.unlink.not_confirmed"), nil
+	}
+
+	// not canceled with the interaction, an unlink started is finished up to the shutdown deadline
+	found, err := s.removeUser(s.ShutdownDeadline(), log, discordUserID, auditActionUnlink, "self")
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return l.T("bot.unlink.not_linked"), nil
+	}
+
+	return l.T("bot.unlink.done"), nil
+}
+
+// commandNotifications turns notifications from the bot on or off for the caller
+func (s Server) commandNotifications(log *logrus.Entry, i *discordgo.InteractionCreate, discordUserID string, l i18n.Localizer) (string, error) {
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		return "", err
+	}
+	if discordUser == nil {
+		return l.T("bot.unlink.not_linked"), nil
+	}
+
+	enabled := true
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "enabled" {
+			enabled = option.BoolValue()
+		}
+	}
+
+	err = s.Store.UpdateDiscordUserDmOptOut(discordUserID, !enabled)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Notifications enabled %t", enabled)
+
+	if enabled {
+		return l.T("bot.notifications.on"), nil
+	}
+	return l.T("bot.notifications.off"), nil
+}
+
+// commandLeaderboard shows the top holders overall or of a collection
+func (s Server) commandLeaderboard(log *logrus.Entry, i *discordgo.InteractionCreate, discordUserID string, l i18n.Localizer) (string, error) {
+	collection := LeaderboardAll
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "collection" {
+			collection = leaderboardCollection(option.StringValue())
+		}
+	}
+
+	return s.leaderboardMessage(l, collection)
+}
+
+// commandPrivacy shows or hides the caller on the leaderboard
+func (s Server) commandPrivacy(log *logrus.Entry, i *discordgo.InteractionCreate, discordUserID string, l i18n.Localizer) (string, error) {
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		return "", err
+	}
+	if discordUser == nil {
+		return l.T("bot.unlink.not_linked"), nil
+	}
+
+	shown := true
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "leaderboard" {
+			shown = option.BoolValue()
+		}
+	}
+
+	err = s.Store.UpdateDiscordUserLeaderboardOptOut(discordUserID, !shown)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Shown on leaderboard %t", shown)
+
+	if shown {
+		return l.T("bot.privacy.shown"), nil
+	}
+	return l.T("bot.privacy.hidden"), nil
+}
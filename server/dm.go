@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/sirupsen/logrus"
+)
+
+// sendDirectMessage sends a direct message to a discord user from the bot
+func (s Server) sendDirectMessage(discordUserID, message string) error {
+	channel, err := s.Discord.UserChannelCreate(discordUserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Discord.ChannelMessageSend(channel.ID, message)
+	return err
+}
+
+// notifyUser sends a notification in the user's language unless they opted out. If the
+// user doesn't accept direct messages they are mentioned in the channel instead
+func (s Server) notifyUser(log *logrus.Entry, discordUserID string, message func(l i18n.Localizer) string) {
+	l := s.Messages.Localizer("")
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		log.WithError(err).Error("Error getting discord user to notify")
+	}
+	if discordUser != nil {
+		if discordUser.DmOptOut {
+			log.Info("User opted out of notifications, not notifying")
+			return
+		}
+		l = s.Messages.Localizer(discordUser.Locale.String)
+	}
+
+	text := message(l)
+	err = s.sendDirectMessage(discordUserID, text)
+	if err == nil {
+		return
+	}
+	if !directMessagesClosed(err) {
+		log.WithError(err).Error("Error sending direct message")
+		return
+	}
+
+	log.Info("User doesn't accept direct messages, mentioning in channel")
+	_, err = s.Discord.ChannelMessageSend(s.DiscordChannelID, fmt.Sprintf("<@%s> %s", discordUserID, text))
+	if err != nil {
+		log.WithError(err).Error("Error mentioning user in channel")
+	}
+}
+
+// notifyTierChange lets a user know their tier changed and what they hold now
+func (s Server) notifyTierChange(log *logrus.Entry, discordUserID string, change tierChange) {
+	key := "dm.tier_upgrade"
+	if change.Downgrade {
+		key = "dm.tier_downgrade"
+	}
+
+	previousTier := s.roleName(change.PreviousTier)
+	tier := s.roleName(change.Tier)
+	s.notifyUser(log, discordUserID, func(l i18n.Localizer) string {
+		if previousTier == "" {
+			previousTier = l.T("dm.no_tier")
+		}
+		if tier == "" {
+			tier = l.T("dm.no_tier")
+		}
+		counts := []string{
+			l.T("dm.collection.chains", change.Chains),
+			l.T("dm.collection.hunters", change.Hunters),
+		}
+		return l.T(key, previousTier, tier, strings.Join(counts, ", "))
+	})
+}
+
+// roleName looks up the name of a role in the server, roles can't be mentioned in direct
+// messages. Falls back to the id
+func (s Server) roleName(roleID string) string {
+	if roleID == "" {
+		return ""
+	}
+
+	roles, err := s.Discord.GuildRoles(s.DiscordServerID)
+	if err != nil {
+		logrus.WithError(err).Error("Error getting server roles")
+		return roleID
+	}
+	for _, role := range roles {
+		if role.ID == roleID {
+			return role.Name
+		}
+	}
+
+	return roleID
+}
+
+// directMessagesClosed checks if a direct message failed because the user doesn't accept them
+func directMessagesClosed(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	if restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeCannotSendMessagesToThisUser {
+		return true
+	}
+
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
+}
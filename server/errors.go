@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ErrorKind categorizes a failure in the linking flow
+type ErrorKind int
+
+const (
+	// ErrorKindInternal is an unexpected failure
+	ErrorKindInternal ErrorKind = iota
+	// ErrorKindAccessDenied user declined consent at discord or nftkeyme
+	ErrorKindAccessDenied
+	// ErrorKindCodeExpired auth code was missing, expired or already used
+	ErrorKindCodeExpired
+	// ErrorKindSessionNotFound nftkeyme callback without a matching discord login
+	ErrorKindSessionNotFound
+	// ErrorKindNotInGuild discord user is not a member of the server
+	ErrorKindNotInGuild
+	// ErrorKindDiscordUnavailable discord api call failed
+	ErrorKindDiscordUnavailable
+	// ErrorKindNftkeymeUnavailable nftkeyme api call failed
+	ErrorKindNftkeymeUnavailable
+	// ErrorKindStorage database call failed
+	ErrorKindStorage
+	// ErrorKindAlreadyLinked nftkeyme account is linked to too many discord users
+	ErrorKindAlreadyLinked
+)
+
+// errorPage holds what is shown to the user for an ErrorKind, as catalog keys
+type errorPage struct {
+	Status    int
+	Key       string
+	RetryLink string
+	RetryKey  string
+}
+
+var errorPages = map[ErrorKind]errorPage{
+	ErrorKindInternal:            {http.StatusInternalServerError, "error.internal", "/init", "error.retry.try_again"},
+	ErrorKindAccessDenied:        {http.StatusForbidden, "error.access_denied", "/init", "error.retry.start_over"},
+	ErrorKindCodeExpired:         {http.StatusBadRequest, "error.code_expired", "/init", "error.retry.start_over"},
+	ErrorKindSessionNotFound:     {http.StatusBadRequest, "error.session_not_found", "/init", "error.retry.start_over"},
+	ErrorKindNotInGuild:          {http.StatusForbidden, "error.not_in_guild", "/init", "error.retry.try_again"},
+	ErrorKindDiscordUnavailable:  {http.StatusBadGateway, "error.discord_unavailable", "/init", "error.retry.try_again"},
+	ErrorKindNftkeymeUnavailable: {http.StatusBadGateway, "error.nftkeyme_unavailable", "/init", "error.retry.try_again"},
+	ErrorKindStorage:             {http.StatusServiceUnavailable, "error.storage", "/init", "error.retry.try_again"},
+	ErrorKindAlreadyLinked:       {http.StatusConflict, "error.already_linked", "/account", "error.retry.manage"},
+}
+
+// exchangeErrorKind maps an oauth code exchange or refresh error to an ErrorKind. Only an
+// invalid_grant error means the code or refresh token expired or was revoked, anything else
+// like a rate limit or a rejected client is the provider failing
+func exchangeErrorKind(err error, provider ErrorKind) ErrorKind {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && oauthErrorCode(retrieveErr.Body) == "invalid_grant" {
+		return ErrorKindCodeExpired
+	}
+
+	return provider
+}
+
+// oauthErrorCode returns the error code of an oauth token endpoint response, which is json
+// or form encoded
+func oauthErrorCode(body []byte) string {
+	var jsonErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &jsonErr) == nil {
+		return jsonErr.Error
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return values.Get("error")
+}
+
+// discordErrorKind maps an error from the discord api to an ErrorKind
+func discordErrorKind(err error) ErrorKind {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember {
+		return ErrorKindNotInGuild
+	}
+
+	return ErrorKindDiscordUnavailable
+}
+
+// flowError tags an error with the ErrorKind shown to the user
+type flowError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *flowError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *flowError) Unwrap() error {
+	return e.Err
+}
+
+// errorKindOf returns the ErrorKind tagged on err, or ErrorKindInternal
+func errorKindOf(err error) ErrorKind {
+	var fe *flowError
+	if errors.As(err, &fe) {
+		return fe.Kind
+	}
+
+	return ErrorKindInternal
+}
+
+// requestID returns the correlation id assigned to the current request
+func requestID(c echo.Context) string {
+	return c.Response().Header().Get(echo.HeaderXRequestID)
+}
+
+// requestLogger returns a logger tagged with the current request id
+func requestLogger(c echo.Context) *logrus.Entry {
+	return logrus.WithField("request_id", requestID(c))
+}
@@ -0,0 +1,606 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/reliablestaking/nftkeyme-discord/roles"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testServerID     = "server-1"
+	testChannelID    = "channel-1"
+	testPolicyChains = "policy-chains"
+	testPolicyHunter = "policy-hunters"
+	testRoleHolder   = "role-holder"
+	testRoleWhale    = "role-whale"
+	testRoleBot      = "role-bot"
+	testBotID        = "bot"
+)
+
+// fakeStore keeps users and links in memory, methods the flows under test don't use panic
+type fakeStore struct {
+	Store
+
+	mu        sync.Mutex
+	users     map[string]*db.DiscordUser
+	links     []db.NftkeymeLink
+	nextID    int
+	holdings  map[string][]db.AssetHolding
+	snapshots []db.AssetSnapshot
+	audit     []db.AuditEvent
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users:    make(map[string]*db.DiscordUser),
+		holdings: make(map[string][]db.AssetHolding),
+	}
+}
+
+func (f *fakeStore) GetUserByDiscordID(discordUserID string) (*db.DiscordUser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[discordUserID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (f *fakeStore) GetAllDiscordUsers() ([]db.DiscordUser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users := make([]db.DiscordUser, 0)
+	for _, user := range f.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (f *fakeStore) UpdateDiscordUserLeaderboardOptOut(discordUserID string, optOut bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, ok := f.users[discordUserID]; ok {
+		user.LeaderboardOptOut = optOut
+	}
+	return nil
+}
+
+func (f *fakeStore) InsertDiscordUser(discordUserID, discordUsername, discordEmail string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	f.users[discordUserID] = &db.DiscordUser{ID: f.nextID, DiscordUserID: discordUserID, DiscordUsername: discordUsername, DiscordEmail: discordEmail}
+	return nil
+}
+
+func (f *fakeStore) UpdateDiscordUserNumAssets(discordUserID string, numAssets, numChains, numHunters int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, ok := f.users[discordUserID]; ok {
+		user.NumAssets = sql.NullInt64{Int64: int64(numAssets), Valid: true}
+		user.NumChains = sql.NullInt64{Int64: int64(numChains), Valid: true}
+		user.NumHunters = sql.NullInt64{Int64: int64(numHunters), Valid: true}
+	}
+	return nil
+}
+
+func (f *fakeStore) UpdateDiscordUserLocale(discordUserID, locale string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, ok := f.users[discordUserID]; ok {
+		user.Locale = sql.NullString{String: locale, Valid: true}
+	}
+	return nil
+}
+
+func (f *fakeStore) GetNftkeymeLinks(discordUserID string) ([]db.NftkeymeLink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	links := make([]db.NftkeymeLink, 0)
+	for _, link := range f.links {
+		if link.DiscordUserID == discordUserID {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (f *fakeStore) GetNftkeymeLinksByNftkeymeID(nftkeymeID string) ([]db.NftkeymeLink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	links := make([]db.NftkeymeLink, 0)
+	for _, link := range f.links {
+		if link.NftkeymeID == nftkeymeID {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (f *fakeStore) UpsertNftkeymeLink(discordUserID, nftkeymeID, nftkeymeEmail, accessToken, refreshToken string, tokenExpiry time.Time, maxDiscordUsers int) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	others := 0
+	for _, link := range f.links {
+		if link.NftkeymeID == nftkeymeID && link.DiscordUserID != discordUserID {
+			others++
+		}
+	}
+	if maxDiscordUsers > 0 && others >= maxDiscordUsers {
+		return false, nil
+	}
+
+	for i, link := range f.links {
+		if link.DiscordUserID == discordUserID && link.NftkeymeID == nftkeymeID {
+			f.links[i].NftkeymeEmail = sql.NullString{String: nftkeymeEmail, Valid: true}
+			f.links[i].NftkeymeAccessToken = sql.NullString{String: accessToken, Valid: true}
+			f.links[i].NftkeymeRefreshToken = sql.NullString{String: refreshToken, Valid: true}
+			f.links[i].TokenExpiry = sql.NullTime{Time: tokenExpiry, Valid: true}
+			f.links[i].BrokenAt = sql.NullTime{}
+			return true, nil
+		}
+	}
+
+	f.nextID++
+	f.links = append(f.links, db.NftkeymeLink{
+		ID:                   f.nextID,
+		DiscordUserID:        discordUserID,
+		NftkeymeID:           nftkeymeID,
+		NftkeymeEmail:        sql.NullString{String: nftkeymeEmail, Valid: true},
+		NftkeymeAccessToken:  sql.NullString{String: accessToken, Valid: true},
+		NftkeymeRefreshToken: sql.NullString{String: refreshToken, Valid: true},
+		TokenExpiry:          sql.NullTime{Time: tokenExpiry, Valid: true},
+		CreatedAt:            time.Now(),
+	})
+	return true, nil
+}
+
+func (f *fakeStore) UpdateNftkeymeLinkToken(linkID int, accessToken, refreshToken string, tokenExpiry time.Time) error {
+	return f.updateLink(linkID, func(link *db.NftkeymeLink) {
+		link.NftkeymeAccessToken = sql.NullString{String: accessToken, Valid: true}
+		link.NftkeymeRefreshToken = sql.NullString{String: refreshToken, Valid: true}
+		link.TokenExpiry = sql.NullTime{Time: tokenExpiry, Valid: true}
+		link.BrokenAt = sql.NullTime{}
+	})
+}
+
+func (f *fakeStore) UpdateNftkeymeLinkNumAssets(linkID int, numAssets int) error {
+	return f.updateLink(linkID, func(link *db.NftkeymeLink) {
+		link.NumAssets = sql.NullInt64{Int64: int64(numAssets), Valid: true}
+	})
+}
+
+func (f *fakeStore) SetNftkeymeLinkBroken(linkID int) error {
+	return f.updateLink(linkID, func(link *db.NftkeymeLink) {
+		link.BrokenAt = sql.NullTime{Time: time.Now(), Valid: true}
+	})
+}
+
+func (f *fakeStore) DeleteNftkeymeLink(linkID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, link := range f.links {
+		if link.ID == linkID {
+			f.links = append(f.links[:i], f.links[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) DeleteDiscordUser(discordUserID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.users, discordUserID)
+	links := make([]db.NftkeymeLink, 0)
+	for _, link := range f.links {
+		if link.DiscordUserID != discordUserID {
+			links = append(links, link)
+		}
+	}
+	f.links = links
+	return nil
+}
+
+func (f *fakeStore) updateLink(linkID int, update func(link *db.NftkeymeLink)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range f.links {
+		if f.links[i].ID == linkID {
+			update(&f.links[i])
+			return nil
+		}
+	}
+	return fmt.Errorf("link %d not found", linkID)
+}
+
+func (f *fakeStore) link(discordUserID, nftkeymeID string) (db.NftkeymeLink, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, link := range f.links {
+		if link.DiscordUserID == discordUserID && link.NftkeymeID == nftkeymeID {
+			return link, true
+		}
+	}
+	return db.NftkeymeLink{}, false
+}
+
+func (f *fakeStore) RecordAssetHoldings(discordUserID string, holdings []db.AssetHolding, seenAt time.Time, release bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	existing := f.holdings[discordUserID]
+	for _, holding := range holdings {
+		found := false
+		for i := range existing {
+			if existing[i].PolicyID == holding.PolicyID && existing[i].AssetName == holding.AssetName {
+				if !existing[i].Held {
+					existing[i].FirstSeen = seenAt
+				}
+				existing[i].LastSeen = seenAt
+				existing[i].Held = true
+				found = true
+			}
+		}
+		if !found {
+			existing = append(existing, db.AssetHolding{DiscordUserID: discordUserID, PolicyID: holding.PolicyID, AssetName: holding.AssetName, FirstSeen: seenAt, LastSeen: seenAt, Held: true})
+		}
+	}
+	for i := range existing {
+		if release && existing[i].Held && existing[i].LastSeen.Before(seenAt) {
+			existing[i].Held = false
+		}
+	}
+	f.holdings[discordUserID] = existing
+	return nil
+}
+
+func (f *fakeStore) GetAssetHoldings(discordUserID string) ([]db.AssetHolding, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]db.AssetHolding{}, f.holdings[discordUserID]...), nil
+}
+
+func (f *fakeStore) InsertAssetSnapshot(discordUserID string, takenAt time.Time, numAssets int, assets []db.SnapshotAsset) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	assetsJSON, err := json.Marshal(assets)
+	if err != nil {
+		return err
+	}
+	f.snapshots = append(f.snapshots, db.AssetSnapshot{DiscordUserID: discordUserID, TakenAt: takenAt, NumAssets: numAssets, Assets: assetsJSON})
+	return nil
+}
+
+func (f *fakeStore) InsertAuditEvent(action, discordUserID, actor, detail string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.audit = append(f.audit, db.AuditEvent{Action: action, DiscordUserID: sql.NullString{String: discordUserID, Valid: true}, Actor: actor, Detail: detail})
+	return nil
+}
+
+// fakeDiscord keeps the roles of server members and the messages sent, the bot can manage
+// the server roles and post in every channel
+type fakeDiscord struct {
+	mu                 sync.Mutex
+	guildRoles         []*discordgo.Role
+	channelPermissions int64
+	roles              map[string]map[string]bool
+	messages           map[string][]string
+}
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		guildRoles: []*discordgo.Role{
+			{ID: testRoleHolder, Name: "Holder", Position: 1},
+			{ID: testRoleWhale, Name: "Whale", Position: 2},
+			{ID: testRoleBot, Name: "Bot", Position: 3, Permissions: discordgo.PermissionManageRoles},
+		},
+		channelPermissions: discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionEmbedLinks,
+		roles:              map[string]map[string]bool{testBotID: {testRoleBot: true}},
+		messages:           make(map[string][]string),
+	}
+}
+
+func (f *fakeDiscord) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	if userID == "@me" {
+		userID = testBotID
+	}
+	return &discordgo.User{ID: userID}, nil
+}
+
+func (f *fakeDiscord) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &discordgo.Guild{ID: guildID, OwnerID: "owner", Roles: f.guildRoles}, nil
+}
+
+func (f *fakeDiscord) UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.channelPermissions, nil
+}
+
+func (f *fakeDiscord) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	member := &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID}}
+	for roleID, held := range f.roles[userID] {
+		if held {
+			member.Roles = append(member.Roles, roleID)
+		}
+	}
+	sort.Strings(member.Roles)
+	return member, nil
+}
+
+func (f *fakeDiscord) GuildMemberRoleAdd(guildID, userID, roleID string, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.roles[userID] == nil {
+		f.roles[userID] = make(map[string]bool)
+	}
+	f.roles[userID][roleID] = true
+	return nil
+}
+
+func (f *fakeDiscord) GuildMemberRoleRemove(guildID, userID, roleID string, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.roles[userID], roleID)
+	return nil
+}
+
+func (f *fakeDiscord) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.guildRoles, nil
+}
+
+func (f *fakeDiscord) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: "dm-" + recipientID}, nil
+}
+
+func (f *fakeDiscord) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.messages[channelID] = append(f.messages[channelID], content)
+	return &discordgo.Message{ChannelID: channelID, Content: content}, nil
+}
+
+func (f *fakeDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.ChannelMessageSend(channelID, data.Content)
+}
+
+func (f *fakeDiscord) hasRole(userID, roleID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.roles[userID][roleID]
+}
+
+func (f *fakeDiscord) directMessages(userID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.messages["dm-"+userID]...)
+}
+
+// fakeTokens is an oauth token endpoint, a code or refresh token is exchanged for the access
+// token it names unless a failure is set for it
+type fakeTokens struct {
+	mu       sync.Mutex
+	failures map[string]fakeTokenFailure
+	requests int
+}
+
+type fakeTokenFailure struct {
+	status int
+	body   string
+}
+
+func (f *fakeTokens) fail(codeOrRefreshToken string, status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[codeOrRefreshToken] = fakeTokenFailure{status: status, body: body}
+}
+
+func (f *fakeTokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	grant := r.FormValue("code")
+	if r.FormValue("grant_type") == "refresh_token" {
+		grant = r.FormValue("refresh_token")
+	}
+	if failure, ok := f.failures[grant]; ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(failure.status)
+		io.WriteString(w, failure.body)
+		return
+	}
+
+	accessToken := grant
+	if r.FormValue("grant_type") == "refresh_token" {
+		accessToken = "refreshed-" + grant
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"refresh_token": grant,
+		"expires_in":    3600,
+	})
+}
+
+func (f *fakeTokens) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests
+}
+
+// testRenderer renders the name of the template so tests can check which page was shown
+type testRenderer struct{}
+
+func (testRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	_, err := io.WriteString(w, name)
+	return err
+}
+
+type testEnv struct {
+	server   Server
+	store    *fakeStore
+	discord  *fakeDiscord
+	nftkeyme *nftkeyme.Fake
+	tokens   *fakeTokens
+}
+
+// newTestEnv creates a server backed by fakes, one asset of the collections is the holder
+// tier and five the whale tier
+func newTestEnv(t *testing.T) *testEnv {
+	messages, err := i18n.LoadBundle("../locales", "en")
+	if err != nil {
+		t.Fatalf("loading messages: %v", err)
+	}
+
+	tokens := &fakeTokens{failures: make(map[string]fakeTokenFailure)}
+	tokenServer := httptest.NewServer(tokens)
+	t.Cleanup(tokenServer.Close)
+
+	env := &testEnv{
+		store:    newFakeStore(),
+		discord:  newFakeDiscord(),
+		nftkeyme: nftkeyme.NewFake(),
+		tokens:   tokens,
+	}
+	env.server = Server{
+		Store:          env.store,
+		Discord:        env.discord,
+		NftkeymeClient: env.nftkeyme,
+		NftkeymeOauthConfig: &oauth2.Config{
+			ClientID:     "client",
+			ClientSecret: "secret",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   tokenServer.URL + "/auth",
+				TokenURL:  tokenServer.URL + "/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		DiscordServerID:  testServerID,
+		DiscordChannelID: testChannelID,
+		Messages:         messages,
+		SessionSecret:    []byte("test"),
+		LinkPolicy:       LinkPolicy{Mode: LinkPolicyUnlimited},
+		Roles: NewRoleConfigs(RoleConfig{
+			RoleMap:              map[int]string{1: testRoleHolder, 5: testRoleWhale},
+			PolicyIDCheck:        testPolicyChains,
+			PolicyIDCheckHunters: testPolicyHunter,
+			RoleEngine:           roles.Engine{},
+		}),
+		Readiness:        NewReadiness(),
+		ShutdownDeadline: context.Background,
+	}
+
+	return env
+}
+
+// addUser adds a discord user who logged in
+func (env *testEnv) addUser(t *testing.T, discordUserID string) {
+	err := env.store.InsertDiscordUser(discordUserID, "user "+discordUserID, discordUserID+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addLink links an nftkeyme account holding the assets with a token that is still valid
+func (env *testEnv) addLink(t *testing.T, discordUserID, nftkeymeID string, assets ...nftkeyme.Asset) {
+	token := "token-" + discordUserID + "-" + nftkeymeID
+	env.nftkeyme.SetUser(token, nftkeyme.FakeUser{
+		Info:   nftkeyme.UserInfo{ID: nftkeymeID, Email: nftkeymeID + "@example.com"},
+		Assets: assets,
+	})
+	_, err := env.store.UpsertNftkeymeLink(discordUserID, nftkeymeID, nftkeymeID+"@example.com", token, "refresh-"+token, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expireLink makes the next use of a link refresh its token
+func (env *testEnv) expireLink(t *testing.T, discordUserID, nftkeymeID string) db.NftkeymeLink {
+	link, ok := env.store.link(discordUserID, nftkeymeID)
+	if !ok {
+		t.Fatalf("no link from %s to %s", discordUserID, nftkeymeID)
+	}
+	err := env.store.updateLink(link.ID, func(link *db.NftkeymeLink) {
+		link.TokenExpiry = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func chains(name, quantity string) nftkeyme.Asset {
+	return nftkeyme.Asset{PolicyId: testPolicyChains, AssetName: name, Quantity: quantity}
+}
+
+func hunter(name string) nftkeyme.Asset {
+	return nftkeyme.Asset{PolicyId: testPolicyHunter, AssetName: name, Quantity: "1"}
+}
+
+func otherAsset(name string) nftkeyme.Asset {
+	return nftkeyme.Asset{PolicyId: "policy-other", AssetName: name, Quantity: "1"}
+}
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/giveaway"
+	"github.com/reliablestaking/nftkeyme-discord/snapshot"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// GiveawayRequest is the body to create a giveaway. SeedHash optionally commits to the
+	// seed up front, the sha256 hex of the seed that will be used to draw
+	GiveawayRequest struct {
+		Name       string            `json:"name"`
+		NumWinners int               `json:"numWinners"`
+		Criteria   giveaway.Criteria `json:"criteria"`
+		SeedHash   string            `json:"seedHash"`
+	}
+
+	// DrawRequest is the body to draw a giveaway. The seed must match the giveaway's seedHash,
+	// a random seed is used for giveaways created without one
+	DrawRequest struct {
+		Seed string `json:"seed"`
+	}
+
+	// GiveawayResult holds a giveaway with everything needed to check the draw, Winners are
+	// the entry keys in the order drawn
+	GiveawayResult struct {
+		db.Giveaway
+		SeedHash  string           `json:"seedHash,omitempty"`
+		Seed      string           `json:"seed,omitempty"`
+		DrawnAt   *time.Time       `json:"drawnAt,omitempty"`
+		Entries   []giveaway.Entry `json:"entries"`
+		Winners   []string         `json:"winners"`
+		Announced bool             `json:"announced"`
+	}
+)
+
+// AdminCreateGiveaway freezes the entries of a new giveaway from the holder snapshot
+func (s Server) AdminCreateGiveaway(c echo.Context) error {
+	log := requestLogger(c)
+
+	request := GiveawayRequest{}
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid giveaway: %v", err))
+	}
+	if request.Name == "" || request.NumWinners < 1 {
+		return c.String(http.StatusBadRequest, "A giveaway needs a name and at least one winner")
+	}
+	err = request.Criteria.Validate()
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if request.SeedHash != "" {
+		decoded, err := hex.DecodeString(request.SeedHash)
+		if err != nil || len(decoded) != sha256.Size {
+			return c.String(http.StatusBadRequest, "seedHash should be a sha256 hex digest")
+		}
+	}
+
+	day, _ := snapshot.ParseDate(request.Criteria.Date)
+	holders, err := snapshot.Take(s.Store, day, request.Criteria.Policies)
+	if err != nil {
+		log.WithError(err).Error("Error taking snapshot")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+
+	salt, err := randomHex()
+	if err != nil {
+		return err
+	}
+	entries, err := request.Criteria.Entries(holders, salt, func(discordUserID string, roleIDs []string) (bool, error) {
+		return s.hasAnyRole(log, discordUserID, roleIDs)
+	})
+	if err != nil {
+		log.WithError(err).Error("Error checking giveaway roles")
+		return c.JSON(http.StatusBadGateway, nil)
+	}
+
+	criteria, err := json.Marshal(request.Criteria)
+	if err != nil {
+		return err
+	}
+	newGiveaway := db.Giveaway{
+		Name:        request.Name,
+		Criteria:    criteria,
+		NumWinners:  request.NumWinners,
+		EntriesHash: giveaway.EntriesHash(entries),
+		EntrySalt:   salt,
+		SeedHash:    sql.NullString{String: strings.ToLower(request.SeedHash), Valid: request.SeedHash != ""},
+	}
+	dbEntries := make([]db.GiveawayEntry, 0)
+	for _, entry := range entries {
+		dbEntries = append(dbEntries, db.GiveawayEntry{
+			DiscordUserID: sql.NullString{String: entry.DiscordUserID, Valid: true},
+			EntryKey:      entry.Key,
+			Weight:        entry.Weight,
+		})
+	}
+
+	giveawayID, err := s.Store.InsertGiveaway(newGiveaway, dbEntries)
+	if err != nil {
+		log.WithError(err).Error("Error storing giveaway")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	log.Infof("Created giveaway %d with %d entries", giveawayID, len(entries))
+
+	return s.renderGiveaway(c, giveawayID, false, http.StatusCreated)
+}
+
+// AdminGetGiveaways lists giveaways
+func (s Server) AdminGetGiveaways(c echo.Context) error {
+	giveaways, err := s.Store.GetGiveaways()
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error getting giveaways")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+
+	return c.JSON(http.StatusOK, giveaways)
+}
+
+// AdminGetGiveaway gets a giveaway with its entries and winners
+func (s Server) AdminGetGiveaway(c echo.Context) error {
+	giveawayID, err := strconv.Atoi(c.Param("giveawayId"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+
+	return s.renderGiveaway(c, giveawayID, false, http.StatusOK)
+}
+
+// AdminDrawGiveaway draws the winners of a giveaway and announces them in the channel
+func (s Server) AdminDrawGiveaway(c echo.Context) error {
+	log := requestLogger(c)
+
+	giveawayID, err := strconv.Atoi(c.Param("giveawayId"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+	log = log.WithField("giveaway_id", giveawayID)
+
+	request := DrawRequest{}
+	if c.Request().ContentLength != 0 {
+		err = json.NewDecoder(c.Request().Body).Decode(&request)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid draw: %v", err))
+		}
+	}
+
+	stored, err := s.Store.GetGiveaway(giveawayID)
+	if err != nil {
+		log.WithError(err).Error("Error getting giveaway")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if stored == nil {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+	if stored.DrawnAt.Valid {
+		return c.String(http.StatusConflict, "Giveaway already drawn")
+	}
+
+	// a seed chosen after the entries are public could be searched for one picking a
+	// particular winner, so only a seed committed to at creation is accepted
+	seed := request.Seed
+	if stored.SeedHash.Valid {
+		err = giveaway.CheckSeed(seed, stored.SeedHash.String)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	} else if seed != "" {
+		return c.String(http.StatusBadRequest, "A seed can only be given for a giveaway created with its seedHash")
+	} else {
+		seed, err = randomHex()
+		if err != nil {
+			return err
+		}
+	}
+
+	dbEntries, err := s.Store.GetGiveawayEntries(giveawayID)
+	if err != nil {
+		log.WithError(err).Error("Error getting giveaway entries")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if giveaway.EntriesHash(giveawayEntries(dbEntries)) != stored.EntriesHash {
+		log.Error("Giveaway entries don't match the entries hash")
+		return c.String(http.StatusConflict, "Giveaway entries changed since it was created")
+	}
+
+	drawn := giveaway.Draw(giveawayEntries(dbEntries), seed, stored.NumWinners)
+	winners := make([]string, 0)
+	for _, winner := range drawn {
+		winners = append(winners, winner.Key)
+	}
+
+	updated, err := s.Store.SetGiveawayDrawn(giveawayID, seed, winners)
+	if err != nil {
+		log.WithError(err).Error("Error storing giveaway winners")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if !updated {
+		return c.String(http.StatusConflict, "Giveaway already drawn")
+	}
+	log.Infof("Drew %d winners from %d entries", len(winners), len(dbEntries))
+
+	announced := true
+	err = s.announceGiveaway(*stored, len(dbEntries), seed, drawn)
+	if err != nil {
+		log.WithError(err).Error("Error announcing giveaway winners")
+		announced = false
+	}
+
+	return s.renderGiveaway(c, giveawayID, announced, http.StatusOK)
+}
+
+// renderGiveaway writes a giveaway with its entries and winners
+func (s Server) renderGiveaway(c echo.Context, giveawayID int, announced bool, status int) error {
+	log := requestLogger(c).WithField("giveaway_id", giveawayID)
+
+	stored, err := s.Store.GetGiveaway(giveawayID)
+	if err != nil {
+		log.WithError(err).Error("Error getting giveaway")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if stored == nil {
+		return c.JSON(http.StatusNotFound, nil)
+	}
+
+	dbEntries, err := s.Store.GetGiveawayEntries(giveawayID)
+	if err != nil {
+		log.WithError(err).Error("Error getting giveaway entries")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+
+	result := GiveawayResult{
+		Giveaway:  *stored,
+		SeedHash:  stored.SeedHash.String,
+		Seed:      stored.Seed.String,
+		Entries:   giveawayEntries(dbEntries),
+		Winners:   giveawayWinners(dbEntries),
+		Announced: announced,
+	}
+	if stored.DrawnAt.Valid {
+		result.DrawnAt = &stored.DrawnAt.Time
+	}
+
+	return c.JSON(status, result)
+}
+
+// announceGiveaway posts the winners and what is needed to check the draw to the channel
+func (s Server) announceGiveaway(stored db.Giveaway, numEntries int, seed string, winners []giveaway.Entry) error {
+	l := s.Messages.Localizer("")
+
+	mentions := make([]string, 0)
+	for _, winner := range winners {
+		if winner.DiscordUserID == "" {
+			mentions = append(mentions, l.T("giveaway.erased_winner"))
+			continue
+		}
+		mentions = append(mentions, "<@"+winner.DiscordUserID+">")
+	}
+	if len(mentions) == 0 {
+		mentions = append(mentions, l.T("giveaway.no_winners"))
+	}
+
+	message := l.T("giveaway.announcement", stored.Name, strings.Join(mentions, ", "), numEntries, stored.EntriesHash, seed)
+	_, err := s.Discord.ChannelMessageSend(s.DiscordChannelID, message)
+	return err
+}
+
+// hasAnyRole checks if a discord user has one of the roles, users who left the server don't
+func (s Server) hasAnyRole(log *logrus.Entry, discordUserID string, roleIDs []string) (bool, error) {
+	member, err := s.Discord.GuildMember(s.DiscordServerID, discordUserID)
+	if err != nil {
+		if discordErrorKind(err) == ErrorKindNotInGuild {
+			log.Infof("User %s no longer in server, not entering giveaway", discordUserID)
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, memberRole := range member.Roles {
+		for _, roleID := range roleIDs {
+			if memberRole == roleID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func giveawayEntries(dbEntries []db.GiveawayEntry) []giveaway.Entry {
+	entries := make([]giveaway.Entry, 0)
+	for _, entry := range dbEntries {
+		entries = append(entries, giveaway.Entry{Key: entry.EntryKey, DiscordUserID: entry.DiscordUserID.String, Weight: entry.Weight})
+	}
+
+	return entries
+}
+
+func giveawayWinners(dbEntries []db.GiveawayEntry) []string {
+	winners := make([]string, 0)
+	for position := 1; ; position++ {
+		found := false
+		for _, entry := range dbEntries {
+			if entry.WinnerPosition.Valid && entry.WinnerPosition.Int64 == int64(position) {
+				winners = append(winners, entry.EntryKey)
+				found = true
+			}
+		}
+		if !found {
+			return winners
+		}
+	}
+}
+
+func randomHex() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(random), nil
+}
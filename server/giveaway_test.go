@@ -0,0 +1,150 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/giveaway"
+)
+
+// fakeGiveawayStore keeps one giveaway and its entries
+type fakeGiveawayStore struct {
+	*fakeStore
+	giveaway db.Giveaway
+	entries  []db.GiveawayEntry
+}
+
+func (f *fakeGiveawayStore) GetGiveaway(giveawayID int) (*db.Giveaway, error) {
+	if giveawayID != f.giveaway.ID {
+		return nil, nil
+	}
+	stored := f.giveaway
+	return &stored, nil
+}
+
+func (f *fakeGiveawayStore) GetGiveawayEntries(giveawayID int) ([]db.GiveawayEntry, error) {
+	return append([]db.GiveawayEntry{}, f.entries...), nil
+}
+
+func (f *fakeGiveawayStore) SetGiveawayDrawn(giveawayID int, seed string, winners []string) (bool, error) {
+	if f.giveaway.DrawnAt.Valid {
+		return false, nil
+	}
+	f.giveaway.Seed = sql.NullString{String: seed, Valid: true}
+	f.giveaway.DrawnAt.Valid = true
+	for position, winner := range winners {
+		for i := range f.entries {
+			if f.entries[i].EntryKey == winner {
+				f.entries[i].WinnerPosition = sql.NullInt64{Int64: int64(position + 1), Valid: true}
+			}
+		}
+	}
+	return true, nil
+}
+
+func newGiveawayEnv(t *testing.T, committedSeed string) (*testEnv, *fakeGiveawayStore) {
+	env := newTestEnv(t)
+	entries := []giveaway.Entry{
+		{Key: giveaway.EntryKey("salt", "user-1"), DiscordUserID: "user-1", Weight: 1},
+		{Key: giveaway.EntryKey("salt", "user-2"), DiscordUserID: "user-2", Weight: 3},
+	}
+	store := &fakeGiveawayStore{
+		fakeStore: env.store,
+		giveaway:  db.Giveaway{ID: 1, Name: "raffle", NumWinners: 1, EntriesHash: giveaway.EntriesHash(entries)},
+	}
+	if committedSeed != "" {
+		store.giveaway.SeedHash = sql.NullString{String: giveaway.SeedHash(committedSeed), Valid: true}
+	}
+	for _, entry := range entries {
+		store.entries = append(store.entries, db.GiveawayEntry{
+			GiveawayID:    1,
+			DiscordUserID: sql.NullString{String: entry.DiscordUserID, Valid: true},
+			EntryKey:      entry.Key,
+			Weight:        entry.Weight,
+		})
+	}
+	env.server.Store = store
+
+	return env, store
+}
+
+func (env *testEnv) draw(t *testing.T, giveawayID int, body string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/admin/giveaways/"+strconv.Itoa(giveawayID)+"/draw", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("giveawayId")
+	c.SetParamValues(strconv.Itoa(giveawayID))
+
+	err := env.server.AdminDrawGiveaway(c)
+	if err != nil {
+		t.Fatalf("drawing: %v", err)
+	}
+	return rec
+}
+
+func TestAdminDrawGiveawaySeed(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed string
+		body      string
+		status    int
+	}{
+		{"committed seed", "secret", `{"seed":"secret"}`, http.StatusOK},
+		{"wrong seed", "secret", `{"seed":"other"}`, http.StatusBadRequest},
+		{"missing committed seed", "secret", ``, http.StatusBadRequest},
+		{"random seed", "", ``, http.StatusOK},
+		{"seed without commitment", "", `{"seed":"chosen"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env, store := newGiveawayEnv(t, test.committed)
+
+			rec := env.draw(t, 1, test.body)
+
+			if rec.Code != test.status {
+				t.Fatalf("got status %d (%s), want %d", rec.Code, rec.Body.String(), test.status)
+			}
+			if store.giveaway.DrawnAt.Valid != (test.status == http.StatusOK) {
+				t.Errorf("drawn is %t", store.giveaway.DrawnAt.Valid)
+			}
+		})
+	}
+}
+
+func TestAdminDrawGiveawayRefusesChangedEntries(t *testing.T) {
+	env, store := newGiveawayEnv(t, "")
+	store.entries = store.entries[1:]
+
+	rec := env.draw(t, 1, ``)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if store.giveaway.DrawnAt.Valid {
+		t.Error("drawn from changed entries")
+	}
+}
+
+func TestAdminDrawGiveawayWithErasedEntry(t *testing.T) {
+	env, store := newGiveawayEnv(t, "")
+	for i := range store.entries {
+		store.entries[i].DiscordUserID = sql.NullString{}
+	}
+
+	rec := env.draw(t, 1, ``)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d (%s), want %d", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+	if !store.giveaway.DrawnAt.Valid {
+		t.Error("giveaway not drawn")
+	}
+}
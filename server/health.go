@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// HealthOK is the status of a passing check
+	HealthOK = "ok"
+	// HealthFail is the status of a failing check
+	HealthFail = "fail"
+
+	// passes run daily and take 5 seconds per linked user
+	maxVerificationAge = 48 * time.Hour
+	readinessTimeout   = 5 * time.Second
+)
+
+type (
+	// Health is the body of the health and readiness endpoints
+	Health struct {
+		Status string                 `json:"status"`
+		Leader *bool                  `json:"leader,omitempty"`
+		Checks map[string]HealthCheck `json:"checks,omitempty"`
+	}
+
+	// HealthCheck is the result of one readiness check
+	HealthCheck struct {
+		Status       string     `json:"status"`
+		Error        string     `json:"error,omitempty"`
+		Note         string     `json:"note,omitempty"`
+		Problems     []string   `json:"problems,omitempty"`
+		Warnings     []string   `json:"warnings,omitempty"`
+		LastVerified *time.Time `json:"lastVerified,omitempty"`
+		AgeSeconds   *int64     `json:"ageSeconds,omitempty"`
+	}
+)
+
+// GetHealth reports the process is alive
+func (s Server) GetHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, Health{Status: HealthOK})
+}
+
+// GetReadiness checks everything the service needs, 503 if any check fails
+func (s Server) GetReadiness(c echo.Context) error {
+	isLeader := s.Leader.IsLeader()
+	health := Health{
+		Status: HealthOK,
+		Leader: &isLeader,
+		Checks: map[string]HealthCheck{
+			"database":            checkResult(s.checkDatabase()),
+			"discordSession":      s.checkDiscordSession(),
+			ReadinessDiscordSetup: s.checkDiscordSetup(),
+			"nftkeyme":            checkResult(s.checkNftkeyme(c.Request().Context())),
+			"nftkeymeOauth":       checkResult(s.checkNftkeymeOauth()),
+			"verification":        s.checkVerification(),
+		},
+	}
+
+	status := http.StatusOK
+	for _, check := range health.Checks {
+		if check.Status != HealthOK {
+			health.Status = HealthFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	return c.JSON(status, health)
+}
+
+func (s Server) checkDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	return s.Store.Ping(ctx)
+}
+
+func (s Server) checkNftkeyme(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	return s.NftkeymeClient.Ping(ctx)
+}
+
+func (s Server) checkDiscordSession() HealthCheck {
+	if !s.Leader.IsLeader() {
+		return HealthCheck{Status: HealthOK, Note: "not the leader, the gateway is opened by the leader"}
+	}
+
+	return checkResult(s.checkDiscordGateway())
+}
+
+func (s Server) checkDiscordGateway() error {
+	if s.DiscordSession == nil {
+		return fmt.Errorf("discord session not set up")
+	}
+
+	s.DiscordSession.RLock()
+	ready := s.DiscordSession.DataReady
+	s.DiscordSession.RUnlock()
+	if !ready {
+		return fmt.Errorf("discord gateway not connected")
+	}
+
+	return nil
+}
+
+func (s Server) checkDiscordSetup() HealthCheck {
+	warnings := s.Readiness.Warnings()[ReadinessDiscordSetup]
+	problems, ok := s.Readiness.Problems()[ReadinessDiscordSetup]
+	if ok {
+		return HealthCheck{Status: HealthFail, Problems: problems, Warnings: warnings}
+	}
+
+	return HealthCheck{Status: HealthOK, Warnings: warnings}
+}
+
+func (s Server) checkNftkeymeOauth() error {
+	endpoint := s.NftkeymeOauthConfig.Endpoint
+	if endpoint.TokenURL == "" || endpoint.AuthURL == "" || s.NftkeymeOauthConfig.ClientID == "" || s.NftkeymeOauthConfig.ClientSecret == "" {
+		return fmt.Errorf("nftkeyme oauth token endpoint or client not configured")
+	}
+
+	return nil
+}
+
+// checkVerification fails if no verification pass finished recently on the leader, a
+// replica that just became leader has until the max age for its first one
+func (s Server) checkVerification() HealthCheck {
+	isLeader, since := s.Leader.Leadership()
+	if !isLeader {
+		return HealthCheck{Status: HealthOK, Note: "not the leader, verification runs on the leader"}
+	}
+
+	verified := s.Readiness.Verified()
+	if verified.Before(since) {
+		if time.Since(since) > maxVerificationAge {
+			return HealthCheck{Status: HealthFail, Error: fmt.Sprintf("no verification pass since becoming leader %s ago", time.Since(since).Round(time.Second))}
+		}
+		return HealthCheck{Status: HealthOK}
+	}
+
+	age := int64(time.Since(verified).Seconds())
+	check := HealthCheck{Status: HealthOK, LastVerified: &verified, AgeSeconds: &age}
+	if time.Since(verified) > maxVerificationAge {
+		check.Status = HealthFail
+		check.Error = fmt.Sprintf("last verification pass is older than %s", maxVerificationAge)
+	}
+
+	return check
+}
+
+func checkResult(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: HealthFail, Error: err.Error()}
+	}
+
+	return HealthCheck{Status: HealthOK}
+}
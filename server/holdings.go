@@ -0,0 +1,75 @@
+package server
+
+import (
+	"time"
+
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/sirupsen/logrus"
+)
+
+// heldSince holds when each currently held asset started being held, by policy and asset name
+type heldSince map[string]time.Time
+
+// HeldSince returns since when an asset has been held without interruption
+func (h heldSince) HeldSince(policyID, assetName string) (time.Time, bool) {
+	since, ok := h[policyID+"."+assetName]
+	return since, ok
+}
+
+// recordHoldings updates the holding history with the assets the user holds now and
+// returns the history for role rules. Assets missing from an incomplete list, with links
+// skipped, stay held
+func (s Server) recordHoldings(log *logrus.Entry, discordUserID string, assets []nftkeyme.Asset, complete bool) (heldSince, error) {
+	holdings := make([]db.AssetHolding, 0)
+	seen := make(map[string]bool)
+	for _, asset := range assets {
+		key := asset.PolicyId + "." + asset.AssetName
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		holdings = append(holdings, db.AssetHolding{PolicyID: asset.PolicyId, AssetName: asset.AssetName})
+	}
+
+	err := s.Store.RecordAssetHoldings(discordUserID, holdings, time.Now().UTC(), complete)
+	if err != nil {
+		log.WithError(err).Error("Error recording asset holdings")
+		return nil, &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	history, err := s.Store.GetAssetHoldings(discordUserID)
+	if err != nil {
+		log.WithError(err).Error("Error getting asset holdings")
+		return nil, &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	since := make(heldSince)
+	for _, holding := range history {
+		if holding.Held {
+			since[holding.PolicyID+"."+holding.AssetName] = holding.FirstSeen
+		}
+	}
+
+	return since, nil
+}
+
+// recordSnapshot stores the full list of assets the user holds now
+func (s Server) recordSnapshot(log *logrus.Entry, discordUserID string, assets []nftkeyme.Asset, numAssets int) error {
+	snapshotAssets := make([]db.SnapshotAsset, 0)
+	for _, asset := range assets {
+		snapshotAssets = append(snapshotAssets, db.SnapshotAsset{
+			PolicyID:  asset.PolicyId,
+			AssetName: asset.AssetName,
+			Quantity:  asset.Quantity,
+		})
+	}
+
+	err := s.Store.InsertAssetSnapshot(discordUserID, time.Now().UTC(), numAssets, snapshotAssets)
+	if err != nil {
+		log.WithError(err).Error("Error recording asset snapshot")
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LeaderboardAll ranks holders by both collections
+	LeaderboardAll = "all"
+	// LeaderboardChains ranks holders by chains
+	LeaderboardChains = "chains"
+	// LeaderboardHunters ranks holders by hunters
+	LeaderboardHunters = "hunters"
+
+	defaultLeaderboardSize = 10
+)
+
+// leaderboardEntry is a ranked holder, holders with the same count share a rank
+type leaderboardEntry struct {
+	Rank          int
+	DiscordUserID string
+	Username      string
+	NumAssets     int
+}
+
+// leaderboard ranks holders by their assets of a collection as of their last verification,
+// leaving out users who opted out
+func (s Server) leaderboard(collection string) ([]leaderboardEntry, error) {
+	if collection != "" && leaderboardCollection(collection) != collection {
+		return nil, fmt.Errorf("Unknown leaderboard collection %s", collection)
+	}
+
+	discordUsers, err := s.Store.GetAllDiscordUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]leaderboardEntry, 0)
+	for _, discordUser := range discordUsers {
+		numAssets := leaderboardCount(discordUser, collection)
+		if discordUser.LeaderboardOptOut || numAssets == 0 {
+			continue
+		}
+		entries = append(entries, leaderboardEntry{
+			DiscordUserID: discordUser.DiscordUserID,
+			Username:      discordUser.DiscordUsername,
+			NumAssets:     numAssets,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].NumAssets != entries[j].NumAssets {
+			return entries[i].NumAssets > entries[j].NumAssets
+		}
+		return entries[i].Username < entries[j].Username
+	})
+
+	size := s.LeaderboardSize
+	if size <= 0 {
+		size = defaultLeaderboardSize
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+		if i > 0 && entries[i].NumAssets == entries[i-1].NumAssets {
+			entries[i].Rank = entries[i-1].Rank
+		}
+	}
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+
+	return entries, nil
+}
+
+// leaderboardMessage formats a leaderboard for discord, holders are mentioned
+func (s Server) leaderboardMessage(l i18n.Localizer, collection string) (string, error) {
+	entries, err := s.leaderboard(collection)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{l.T("leaderboard.title." + leaderboardCollection(collection))}
+	if len(entries) == 0 {
+		lines = append(lines, l.T("leaderboard.empty"))
+	}
+	for _, entry := range entries {
+		lines = append(lines, l.T("leaderboard.line", entry.Rank, "<@"+entry.DiscordUserID+">", entry.NumAssets))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// PostLeaderboard posts the overall leaderboard to the channel every interval, mentions
+// don't ping
+func (s Server) PostLeaderboard(ctx context.Context, interval time.Duration) {
+	for lifecycle.Sleep(ctx, interval) {
+		message, err := s.leaderboardMessage(s.Messages.Localizer(""), LeaderboardAll)
+		if err != nil {
+			logrus.WithError(err).Error("Error building leaderboard")
+			continue
+		}
+
+		_, err = s.Discord.ChannelMessageSendComplex(s.DiscordChannelID, &discordgo.MessageSend{
+			Content:         message,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			logrus.WithError(err).Error("Error posting leaderboard")
+		}
+	}
+}
+
+// RenderLeaderboard renders the leaderboard page
+func (s Server) RenderLeaderboard(c echo.Context) error {
+	l := s.localizer(c)
+	collection := leaderboardCollection(c.QueryParam("collection"))
+
+	entries, err := s.leaderboard(collection)
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error building leaderboard")
+		return s.RenderError(c, ErrorKindStorage)
+	}
+
+	page := struct {
+		L           i18n.Localizer
+		Collection  string
+		Collections []string
+		Entries     []leaderboardEntry
+	}{
+		L:           l,
+		Collection:  collection,
+		Collections: []string{LeaderboardAll, LeaderboardChains, LeaderboardHunters},
+		Entries:     entries,
+	}
+	err = c.Render(http.StatusOK, "leaderboard.html", page)
+	if err != nil {
+		requestLogger(c).WithError(err).Error("Error rendering leaderboard template")
+	}
+	return err
+}
+
+// leaderboardCount is how many assets of the collection a user held at their last verification
+func leaderboardCount(discordUser db.DiscordUser, collection string) int {
+	switch collection {
+	case LeaderboardChains:
+		return int(discordUser.NumChains.Int64)
+	case LeaderboardHunters:
+		return int(discordUser.NumHunters.Int64)
+	}
+	return int(discordUser.NumChains.Int64 + discordUser.NumHunters.Int64)
+}
+
+// leaderboardCollection defaults unknown collections to all
+func leaderboardCollection(collection string) string {
+	switch collection {
+	case LeaderboardChains, LeaderboardHunters:
+		return collection
+	}
+	return LeaderboardAll
+}
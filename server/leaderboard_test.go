@@ -0,0 +1,61 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLeaderboard(t *testing.T) {
+	env := newTestEnv(t)
+	for _, discordUserID := range []string{"user-1", "user-2", "user-3", "user-4", "user-5"} {
+		env.addUser(t, discordUserID)
+	}
+	env.addLink(t, "user-1", "account-1", chains("a", "2"), hunter("b"))
+	env.addLink(t, "user-2", "account-2", chains("c", "3"))
+	env.addLink(t, "user-3", "account-3", hunter("d"), hunter("e"), hunter("f"))
+	env.addLink(t, "user-4", "account-4", chains("g", "9"))
+	env.addLink(t, "user-5", "account-5", otherAsset("h"))
+	env.store.UpdateDiscordUserLeaderboardOptOut("user-4", true)
+	for _, discordUserID := range []string{"user-1", "user-2", "user-3", "user-4", "user-5"} {
+		err := env.assignRoles(discordUserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		collection string
+		want       []leaderboardEntry
+	}{
+		{LeaderboardAll, []leaderboardEntry{
+			{Rank: 1, DiscordUserID: "user-1", Username: "user user-1", NumAssets: 3},
+			{Rank: 1, DiscordUserID: "user-2", Username: "user user-2", NumAssets: 3},
+			{Rank: 1, DiscordUserID: "user-3", Username: "user user-3", NumAssets: 3},
+		}},
+		{LeaderboardChains, []leaderboardEntry{
+			{Rank: 1, DiscordUserID: "user-2", Username: "user user-2", NumAssets: 3},
+			{Rank: 2, DiscordUserID: "user-1", Username: "user user-1", NumAssets: 2},
+		}},
+		{LeaderboardHunters, []leaderboardEntry{
+			{Rank: 1, DiscordUserID: "user-3", Username: "user user-3", NumAssets: 3},
+			{Rank: 2, DiscordUserID: "user-1", Username: "user user-1", NumAssets: 1},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.collection, func(t *testing.T) {
+			entries, err := env.server.leaderboard(test.collection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("got %+v, want %+v", entries, test.want)
+			}
+		})
+	}
+
+	_, err := env.server.leaderboard("unknown")
+	if err == nil {
+		t.Error("built an unknown leaderboard, want an error")
+	}
+}
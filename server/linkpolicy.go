@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/reliablestaking/nftkeyme-discord/config"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// LinkPolicyUnlimited lets an nftkeyme account unlock roles for any number of discord users
+	LinkPolicyUnlimited = config.LinkPolicyUnlimited
+	// LinkPolicyExclusive rejects linking an nftkeyme account already linked to another discord user
+	LinkPolicyExclusive = config.LinkPolicyExclusive
+	// LinkPolicyAllow lets an nftkeyme account be linked to at most N discord users
+	LinkPolicyAllow = config.LinkPolicyAllow
+	// LinkPolicyTransfer moves an nftkeyme account to the discord user who linked it last
+	LinkPolicyTransfer = config.LinkPolicyTransfer
+
+	auditActionTransferLink = "transfer_link"
+)
+
+// LinkPolicy limits how many discord users one nftkeyme account can unlock roles for
+type LinkPolicy struct {
+	Mode            string
+	MaxDiscordUsers int
+}
+
+// ParseLinkPolicy parses unlimited, exclusive, allow:N or transfer, empty is unlimited
+func ParseLinkPolicy(policy string) (LinkPolicy, error) {
+	mode, maxDiscordUsers, err := config.ParseLinkPolicy(policy)
+	if err != nil {
+		return LinkPolicy{}, err
+	}
+
+	return LinkPolicy{Mode: mode, MaxDiscordUsers: maxDiscordUsers}, nil
+}
+
+// linkAccount links an nftkeyme account to a discord user under the link policy. It returns
+// an ErrorKindAlreadyLinked error if the policy rejects the link, and for the transfer
+// policy removes the account from the discord users it was linked to before
+func (s Server) linkAccount(ctx context.Context, log *logrus.Entry, discordUserID string, nftkeymeUser *nftkeyme.UserInfo, token *oauth2.Token) error {
+	nftkeymeID := nftkeymeUser.ID
+	if s.LinkPolicy.Mode == LinkPolicyTransfer {
+		err := s.transferAccount(ctx, log, discordUserID, nftkeymeID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the limit is checked as the link is stored, so two users linking the same account at
+	// once can't both get it
+	log.Infof("Linking nftkeyme account %s", nftkeymeID)
+	s.invalidateAssets(ctx, log, nftkeymeID)
+	linked, err := s.Store.UpsertNftkeymeLink(discordUserID, nftkeymeID, nftkeymeUser.Email, token.AccessToken, token.RefreshToken, token.Expiry, s.LinkPolicy.linkLimit())
+	if err != nil {
+		log.WithError(err).Errorf("Error persisting nftkeyme link for discord user %s", discordUserID)
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+	if !linked {
+		log.Infof("Nftkeyme account %s already linked to %d discord users, rejecting", nftkeymeID, s.LinkPolicy.MaxDiscordUsers)
+		return &flowError{Kind: ErrorKindAlreadyLinked, Err: fmt.Errorf("nftkeyme account %s already linked", nftkeymeID)}
+	}
+
+	return nil
+}
+
+// linkLimit is how many other discord users an account can be linked to when linking it, 0
+// is no limit. Transfers remove the other links first
+func (p LinkPolicy) linkLimit() int {
+	if p.Mode == LinkPolicyExclusive || p.Mode == LinkPolicyAllow {
+		return p.MaxDiscordUsers
+	}
+
+	return 0
+}
+
+// transferAccount removes an nftkeyme account from the discord users it was linked to before
+func (s Server) transferAccount(ctx context.Context, log *logrus.Entry, discordUserID, nftkeymeID string) error {
+	links, err := s.Store.GetNftkeymeLinksByNftkeymeID(nftkeymeID)
+	if err != nil {
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	others := make([]db.NftkeymeLink, 0)
+	for _, link := range links {
+		if link.DiscordUserID != discordUserID {
+			others = append(others, link)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	s.invalidateAssets(ctx, log, nftkeymeID)
+	for _, other := range others {
+		otherLog := logrus.WithField("discord_user_id", other.DiscordUserID).WithField("request_discord_user_id", discordUserID)
+		otherLog.Infof("Transferring nftkeyme account %s to discord user %s", nftkeymeID, discordUserID)
+		_, err = s.removeLink(ctx, otherLog, other.DiscordUserID, other.ID, auditActionTransferLink, "discord:"+discordUserID)
+		if err != nil && errorKindOf(err) == ErrorKindStorage {
+			return err
+		}
+		if err != nil {
+			// the previous owner left the server or discord is down, the next verify pass fixes their roles
+			otherLog.WithError(err).Error("Error updating roles after transfer")
+		}
+
+		s.notifyLinkTransferred(otherLog, other.DiscordUserID)
+	}
+
+	return nil
+}
+
+// linkCounts checks if a link's assets count under the link policy. Links from before the
+// policy was set can share an nftkeyme account, the oldest ones count, or the newest with
+// the transfer policy
+func (s Server) linkCounts(link db.NftkeymeLink) (bool, error) {
+	if s.LinkPolicy.Mode == LinkPolicyUnlimited || s.LinkPolicy.Mode == "" {
+		return true, nil
+	}
+
+	links, err := s.Store.GetNftkeymeLinksByNftkeymeID(link.NftkeymeID)
+	if err != nil {
+		return false, err
+	}
+
+	for i, other := range links {
+		if other.ID != link.ID {
+			continue
+		}
+		if s.LinkPolicy.Mode == LinkPolicyTransfer {
+			return i == len(links)-1, nil
+		}
+		return i < s.LinkPolicy.MaxDiscordUsers, nil
+	}
+
+	return false, nil
+}
+
+// notifyLinkTransferred lets a discord user know their nftkeyme account was linked elsewhere
+func (s Server) notifyLinkTransferred(log *logrus.Entry, discordUserID string) {
+	s.notifyUser(log, discordUserID, func(l i18n.Localizer) string {
+		return l.T("dm.link_transferred")
+	})
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+)
+
+const (
+	langQueryParam = "lang"
+	langCookieName = "lang"
+)
+
+// localizer picks the language for the request, the lang query param wins and is
+// remembered in a cookie across the oauth redirects, then the Accept-Language header
+func (s Server) localizer(c echo.Context) i18n.Localizer {
+	queryLang := c.QueryParam(langQueryParam)
+	cookieLang := ""
+	if cookie, err := c.Cookie(langCookieName); err == nil {
+		cookieLang = cookie.Value
+	}
+
+	lang := s.Messages.Match(queryLang, cookieLang, c.Request().Header.Get("Accept-Language"))
+	if queryLang != "" && lang != cookieLang {
+		c.SetCookie(&http.Cookie{
+			Name:     langCookieName,
+			Value:    lang,
+			Path:     "/",
+			Expires:  time.Now().Add(365 * 24 * time.Hour),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return s.Messages.Localizer(lang)
+}
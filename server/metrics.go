@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetMetrics writes gauges in the prometheus text format
+func (s Server) GetMetrics(c echo.Context) error {
+	isLeader, _ := s.Leader.Leadership()
+	leader := 0
+	if isLeader {
+		leader = 1
+	}
+
+	lastVerified := float64(0)
+	if verified := s.Readiness.Verified(); !verified.IsZero() {
+		lastVerified = float64(verified.Unix())
+	}
+
+	setupProblems := len(s.Readiness.Problems()[ReadinessDiscordSetup])
+	setupWarnings := len(s.Readiness.Warnings()[ReadinessDiscordSetup])
+
+	metrics := bytes.Buffer{}
+	writeGauge(&metrics, "nftkeyme_discord_leader", "Whether this replica is the leader running the background workers", float64(leader))
+	writeGauge(&metrics, "nftkeyme_discord_last_verification_timestamp_seconds", "When the last verification pass finished on this replica, 0 if none has", lastVerified)
+	writeGauge(&metrics, "nftkeyme_discord_setup_problems", "Number of fatal problems found by the discord setup check", float64(setupProblems))
+	writeGauge(&metrics, "nftkeyme_discord_setup_warnings", "Number of warnings from the discord setup check", float64(setupWarnings))
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4", metrics.Bytes())
+}
+
+func writeGauge(metrics *bytes.Buffer, name, help string, value float64) {
+	fmt.Fprintf(metrics, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(metrics, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(metrics, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/reliablestaking/nftkeyme-discord/rarity"
+	"github.com/reliablestaking/nftkeyme-discord/roles"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// RoleConfig is the part of the config that can be reloaded while running
+	RoleConfig struct {
+		RoleMap              map[int]string
+		PolicyIDCheck        string
+		PolicyIDCheckHunters string
+		RoleEngine           roles.Engine
+		Rarity               rarity.Collections
+	}
+
+	// RoleConfigs holds the current role config, replaced atomically on reload so a
+	// verification always sees one consistent config
+	RoleConfigs struct {
+		current atomic.Value
+
+		reconcileMu sync.Mutex
+		reconciling *reconciliation
+	}
+
+	// reconciliation is a reconcile running in the background after a reload
+	reconciliation struct {
+		cancel  context.CancelFunc
+		done    chan struct{}
+		dropped []string
+	}
+)
+
+// NewRoleConfigs holds the role config loaded at startup
+func NewRoleConfigs(roleConfig RoleConfig) *RoleConfigs {
+	roleConfigs := RoleConfigs{}
+	roleConfigs.current.Store(roleConfig)
+	return &roleConfigs
+}
+
+// Load returns the current role config
+func (r *RoleConfigs) Load() RoleConfig {
+	return r.current.Load().(RoleConfig)
+}
+
+// Swap replaces the role config and returns the previous one
+func (r *RoleConfigs) Swap(roleConfig RoleConfig) RoleConfig {
+	previous := r.Load()
+	r.current.Store(roleConfig)
+	return previous
+}
+
+// roleConfig returns the current role config
+func (s Server) roleConfig() RoleConfig {
+	return s.Roles.Load()
+}
+
+// managedRoleIDs returns every role the config adds and removes
+func (rc RoleConfig) managedRoleIDs() []string {
+	seen := make(map[string]bool)
+	roleIDs := make([]string, 0)
+	for _, roleID := range rc.RoleMap {
+		if !seen[roleID] {
+			seen[roleID] = true
+			roleIDs = append(roleIDs, roleID)
+		}
+	}
+	for _, roleID := range rc.RoleEngine.RoleIDs() {
+		if !seen[roleID] {
+			seen[roleID] = true
+			roleIDs = append(roleIDs, roleID)
+		}
+	}
+
+	return roleIDs
+}
+
+// ReloadRoles swaps in a validated role config. With reconcile the leader verifies every
+// linked user again in the background until it loses leadership, and roles the previous
+// config managed but the new one doesn't are removed from them. Other replicas only swap the
+// config. A reconcile still running is stopped and its removals carried over to the new one
+func (s Server) ReloadRoles(manager *lifecycle.Manager, roleConfig RoleConfig, reconcile bool) {
+	previous := s.Roles.Swap(roleConfig)
+	logrus.Infof("Reloaded role config, %d tiers and %d role rules", len(roleConfig.RoleMap), len(roleConfig.RoleEngine.Rules))
+
+	if !reconcile {
+		return
+	}
+	if !s.Leader.IsLeader() {
+		logrus.Info("Not the leader, the leader reconciles linked users")
+		return
+	}
+
+	s.Roles.reconcileMu.Lock()
+	defer s.Roles.reconcileMu.Unlock()
+
+	droppedBefore := make([]string, 0)
+	if running := s.Roles.reconciling; running != nil {
+		select {
+		case <-running.done:
+		default:
+			logrus.Info("Stopping the running reconciliation, starting over with the new config")
+			running.cancel()
+			<-running.done
+			droppedBefore = running.dropped
+		}
+	}
+
+	stillManaged := make(map[string]bool)
+	for _, roleID := range roleConfig.managedRoleIDs() {
+		stillManaged[roleID] = true
+	}
+	dropped := make([]string, 0)
+	for _, roleID := range append(droppedBefore, previous.managedRoleIDs()...) {
+		if !stillManaged[roleID] {
+			stillManaged[roleID] = true
+			dropped = append(dropped, roleID)
+		}
+	}
+
+	// the reconcile runs under the leadership, so it stops if another replica takes over
+	ctx, cancel := context.WithCancel(manager.Context())
+	running := &reconciliation{cancel: cancel, done: make(chan struct{}), dropped: dropped}
+	started := s.Leader.Start(ctx, "reconcile", func(ctx context.Context) {
+		defer close(running.done)
+		defer cancel()
+
+		s.reconcile(ctx, dropped)
+	})
+	if !started {
+		cancel()
+		logrus.Info("No longer the leader, the leader reconciles linked users")
+		return
+	}
+	s.Roles.reconciling = running
+}
+
+// reconcile verifies every linked user again after a reload, stopping between users when
+// the context is canceled
+func (s Server) reconcile(ctx context.Context, droppedRoleIDs []string) {
+	logrus.Infof("Reconciling linked users after reload, removing %d roles no longer managed", len(droppedRoleIDs))
+	discordUsers, err := s.Store.GetLinkedDiscordUsers()
+	if err != nil {
+		logrus.WithError(err).Error("Error getting linked users to reconcile")
+		return
+	}
+
+	for _, discordUser := range discordUsers {
+		log := logrus.WithField("discord_user_id", discordUser.DiscordUserID).WithField("reconcile", true)
+
+		for _, roleID := range droppedRoleIDs {
+			err = s.setRole(log, discordUser.DiscordUserID, roleID, false)
+			if err != nil {
+				log.WithError(err).Error("Error removing role no longer managed")
+			}
+		}
+
+		// the user in progress is finished before stopping, up to the shutdown deadline
+		err = s.assignRoles(s.ShutdownDeadline(), log, discordUser.DiscordUserID)
+		if err != nil {
+			log.WithError(err).Error("Error assigning roles")
+		}
+
+		if !lifecycle.Sleep(ctx, 5*time.Second) {
+			logrus.Info("Stopping reconciliation")
+			return
+		}
+	}
+
+	logrus.Infof("Reconciled %d linked users", len(discordUsers))
+}
@@ -1,17 +1,21 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
-	"os"
-	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/announce"
+	"github.com/reliablestaking/nftkeyme-discord/cache"
 	"github.com/reliablestaking/nftkeyme-discord/discord"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/leader"
 	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
@@ -20,20 +24,32 @@ import (
 type (
 	// Server struct
 	Server struct {
-		Store                db.Store
-		BuildTime            string
-		Sha1ver              string
-		DiscordAuthCodeURL   string
-		DiscordOauthConfig   *oauth2.Config
-		NftkeymeOauthConfig  *oauth2.Config
-		DiscordClient        discord.Client
-		NftkeymeClient       nftkeyme.NftkeymeClient
-		DiscordSession       *discordgo.Session
-		PolicyIDCheck        string
-		PolicyIDCheckHunters string
-		DiscordServerID      string
-		DiscordChannelID     string
-		RoleMap              map[int]string
+		Store               Store
+		BuildTime           string
+		Sha1ver             string
+		DiscordAuthCodeURL  string
+		DiscordOauthConfig  *oauth2.Config
+		NftkeymeOauthConfig *oauth2.Config
+		DiscordClient       discord.Client
+		NftkeymeClient      nftkeyme.API
+		DiscordSession      *discordgo.Session
+		Discord             DiscordAPI
+		DiscordServerID     string
+		DiscordChannelID    string
+		Messages            *i18n.Bundle
+		SessionSecret       []byte
+		LinkPolicy          LinkPolicy
+		Roles               *RoleConfigs
+		Readiness           *Readiness
+		Leader              *leader.Elector
+		AssetCache          cache.Cache
+		AssetCacheTTL       time.Duration
+		Announcer           *announce.Announcer
+		LeaderboardSize     int
+		Port                int
+		AllowedOrigins      []string
+		AdminAPIKey         string
+		ShutdownDeadline    func() context.Context
 	}
 
 	// Version struct
@@ -53,31 +69,49 @@ func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Con
 	return t.templates.ExecuteTemplate(w, name, data)
 }
 
-// Start the server
-func (s Server) Start() {
+// Start the server, once the context is canceled it stops accepting requests and waits up
+// to the shutdown timeout for the ones in flight
+func (s Server) Start(ctx context.Context) error {
 	logrus.Info("Starting server...")
 	e := echo.New()
 
-	allowedOriginsCsv := make([]string, 0)
-	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-	if allowedOrigins != "" {
-		allowedOriginsCsv = strings.Split(allowedOrigins, ",")
-	}
-
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:     allowedOriginsCsv,
+		AllowOrigins:     s.AllowedOrigins,
 		AllowMethods:     []string{echo.GET, echo.HEAD, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
 		AllowCredentials: true,
 	}))
+	e.Use(middleware.RequestID())
 
 	// asset / stake key endpoint
 	e.GET("/init", s.InitFlow)
 	e.GET("/discord", s.HandleDiscordAuthCode)
 	e.GET("/nftkeyme", s.HandleNftkeymeAuthCode)
 
+	// account data endpoints
+	e.GET("/account", s.RenderAccount)
+	e.GET("/account/links/add", s.AddNftkeymeLink)
+	e.POST("/account/links/:linkId/delete", s.DeleteNftkeymeLink)
+	e.POST("/account/unlink", s.UnlinkAccount)
+	admin := e.Group("/admin", middleware.KeyAuth(adminAuth(s.AdminAPIKey)))
+	admin.GET("/users/:discordUserId/export", s.AdminExportUser)
+	admin.DELETE("/users/:discordUserId", s.AdminEraseUser)
+	admin.GET("/snapshots", s.AdminExportSnapshot)
+	admin.GET("/giveaways", s.AdminGetGiveaways)
+	admin.POST("/giveaways", s.AdminCreateGiveaway)
+	admin.GET("/giveaways/:giveawayId", s.AdminGetGiveaway)
+	admin.POST("/giveaways/:giveawayId/draw", s.AdminDrawGiveaway)
+
+	// leaderboard
+	e.GET("/leaderboard", s.RenderLeaderboard)
+
 	// version endpoint
 	e.GET("/version", s.GetVersion)
 
+	// health endpoints for probes and monitors
+	e.GET("/healthz", s.GetHealth)
+	e.GET("/readyz", s.GetReadiness)
+	e.GET("/metrics", s.GetMetrics)
+
 	// static CSS/images
 	e.Static("/static", "assets")
 
@@ -90,11 +124,19 @@ func (s Server) Start() {
 	e.GET("/", s.RenderStart)
 	e.GET("/end", s.RenderEnd)
 
-	port := os.Getenv("NFTKEYME_SERVICE_PORT")
-	if port == "" {
-		port = "8080"
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		logrus.Info("Stopping server...")
+		shutdown <- e.Shutdown(s.ShutdownDeadline())
+	}()
+
+	err := e.Start(fmt.Sprintf(":%d", s.Port))
+	if err != http.ErrServerClosed {
+		return err
 	}
-	e.Logger.Fatal(e.Start(":" + port))
+
+	return <-shutdown
 }
 
 // GetVersion return build version info
@@ -109,41 +151,67 @@ func (s Server) GetVersion(c echo.Context) (err error) {
 
 // InitFlow initialize the flow
 func (s Server) InitFlow(c echo.Context) (err error) {
+	action := c.QueryParam("action")
+	if action == AccountActionUnlink || action == AccountActionExport {
+		return s.startAccountAction(c, action)
+	}
+
 	// redirect to discord auth flow
 	return c.Redirect(302, s.DiscordAuthCodeURL)
 }
 
 // HandleDiscordAuthCode handle redirect
 func (s Server) HandleDiscordAuthCode(c echo.Context) (err error) {
-	logrus.Infof("Handling auth code from discord")
+	log := requestLogger(c)
+	log.Infof("Handling auth code from discord")
+	if c.QueryParam("error") != "" {
+		log.Infof("Discord returned error %s", c.QueryParam("error"))
+		return s.RenderError(c, ErrorKindAccessDenied)
+	}
 	authCode := c.QueryParam("code")
+	if authCode == "" {
+		log.Info("Discord auth code missing")
+		return s.RenderError(c, ErrorKindCodeExpired)
+	}
+	action, err := s.accountAction(c)
+	if err != nil {
+		log.WithError(err).Error("Error checking account action")
+		return s.RenderError(c, ErrorKindCodeExpired)
+	}
 
 	//exchange code for token
 	token, err := s.DiscordOauthConfig.Exchange(oauth2.NoContext, authCode)
 	if err != nil {
-		logrus.WithError(err).Error("Error exchange code for token")
-		return c.JSON(http.StatusInternalServerError, nil)
+		log.WithError(err).Error("Error exchange code for token")
+		return s.RenderError(c, exchangeErrorKind(err, ErrorKindDiscordUnavailable))
 	}
 
 	// lookup user info
 	userInfo, err := s.DiscordClient.GetUserInfo(token.AccessToken)
-	if err != nil {
-		logrus.WithError(err).Error("Error getting user info")
-		return c.JSON(http.StatusInternalServerError, nil)
+	if err != nil || userInfo == nil {
+		log.WithError(err).Error("Error getting user info")
+		return s.RenderError(c, ErrorKindDiscordUnavailable)
+	}
+
+	log = log.WithField("discord_user_id", userInfo.ID)
+	log.Infof("Got user with id %s and email %s and username %s", userInfo.ID, userInfo.Email, userInfo.Username)
+	s.setSession(c, userInfo.ID)
+	if action != "" {
+		log.Infof("Handling account action %s", action)
+		return s.handleAccountAction(c, log, action, userInfo.ID)
 	}
 
-	logrus.Infof("Got user with id %s and email %s and username %s", userInfo.ID, userInfo.Email, userInfo.Username)
 	discordUser, err := s.Store.GetUserByDiscordID(userInfo.ID)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error getting discord user %s", userInfo.ID)
-		return c.JSON(http.StatusInternalServerError, nil)
+		log.WithError(err).Errorf("Error getting discord user %s", userInfo.ID)
+		return s.RenderError(c, ErrorKindStorage)
 	}
 	if discordUser == nil {
-		logrus.Infof("Inserting discord user record %s", userInfo.ID)
+		log.Infof("Inserting discord user record %s", userInfo.ID)
 		err = s.Store.InsertDiscordUser(userInfo.ID, userInfo.Username, userInfo.Email)
 		if err != nil {
-			logrus.WithError(err).Errorf("Error persisting discord user %s", userInfo.ID)
-			return c.JSON(http.StatusInternalServerError, nil)
+			log.WithError(err).Errorf("Error persisting discord user %s", userInfo.ID)
+			return s.RenderError(c, ErrorKindStorage)
 		}
 	}
 
@@ -157,112 +225,139 @@ func (s Server) HandleDiscordAuthCode(c echo.Context) (err error) {
 func (s Server) HandleNftkeymeAuthCode(c echo.Context) (err error) {
 	authCode := c.QueryParam("code")
 	state := c.QueryParam("state")
-	logrus.Infof("Handling auth code from nftkeyme with state/discord id %s", state)
+	log := requestLogger(c).WithField("discord_user_id", state)
+	log.Infof("Handling auth code from nftkeyme with state/discord id %s", state)
+	if c.QueryParam("error") != "" {
+		log.Infof("Nftkeyme returned error %s", c.QueryParam("error"))
+		return s.RenderError(c, ErrorKindAccessDenied)
+	}
+	if authCode == "" {
+		log.Info("Nftkeyme auth code missing")
+		return s.RenderError(c, ErrorKindCodeExpired)
+	}
+	// the state is the discord user to link to, only the user logged in with discord in this
+	// browser can link to it
+	if state == "" || s.sessionUser(c) != state {
+		log.Info("Nftkeyme state doesn't match the discord login session")
+		return s.RenderError(c, ErrorKindSessionNotFound)
+	}
 
 	//exchange code for token
-	token, err := s.NftkeymeOauthConfig.Exchange(oauth2.NoContext, authCode)
+	ctx := c.Request().Context()
+	token, err := s.NftkeymeOauthConfig.Exchange(ctx, authCode)
 	if err != nil {
-		logrus.WithError(err).Error("Error exchange code for token")
-		return s.RenderError("Internal server error", c)
+		log.WithError(err).Error("Error exchange code for token")
+		return s.RenderError(c, exchangeErrorKind(err, ErrorKindNftkeymeUnavailable))
 	}
 
 	// persist tokens
-	logrus.Infof("Checking if user already exsists in db %s", state)
+	log.Infof("Checking if user already exsists in db %s", state)
 	discordUser, err := s.Store.GetUserByDiscordID(state)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error getting discord user %s", state)
-		return s.RenderError("Internal server error", c)
+		log.WithError(err).Errorf("Error getting discord user %s", state)
+		return s.RenderError(c, ErrorKindStorage)
 	}
 	if discordUser == nil {
-		logrus.Errorf("User not found in db %s", state)
-		return s.RenderError("Internal server error", c)
+		log.Errorf("User not found in db %s", state)
+		return s.RenderError(c, ErrorKindSessionNotFound)
 	} else {
-		logrus.Infof("Updating discord user record %s", state)
+		log.Infof("Updating discord user record %s", state)
 
-		nftkeymeUser, err := s.NftkeymeClient.GetUserInfo(token.AccessToken)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error getting nftkeyme info %s", state)
-			return s.RenderError("Internal server error", c)
+		nftkeymeUser, err := s.NftkeymeClient.GetUserInfo(ctx, token.AccessToken)
+		if err != nil || nftkeymeUser == nil {
+			log.WithError(err).Errorf("Error getting nftkeyme info %s", state)
+			return s.RenderError(c, ErrorKindNftkeymeUnavailable)
 		}
 
-		err = s.Store.UpdateDiscordUserNftkeyInfo(state, nftkeymeUser.ID, nftkeymeUser.Email)
+		err = s.linkAccount(ctx, log, state, nftkeymeUser, token)
 		if err != nil {
-			logrus.WithError(err).Errorf("Error persisting discord user with nftkeyme info %s", state)
-			return s.RenderError("Internal server error", c)
+			log.WithError(err).Errorf("Error linking nftkeyme account %s", nftkeymeUser.ID)
+			return s.RenderError(c, errorKindOf(err))
 		}
 
-		err = s.Store.UpdateDiscordUser(state, token.AccessToken, token.RefreshToken)
+		// remember language for bot messages
+		err = s.Store.UpdateDiscordUserLocale(state, s.localizer(c).Lang)
 		if err != nil {
-			logrus.WithError(err).Errorf("Error persisting discord user %s", state)
-			return s.RenderError("Internal server error", c)
+			log.WithError(err).Errorf("Error persisting locale for discord user %s", state)
+			return s.RenderError(c, ErrorKindStorage)
 		}
 	}
 
 	// get assets
-	err = s.assignRoles(*token, state)
+	err = s.assignRoles(ctx, log, state)
 	if err != nil {
-		logrus.WithError(err).Error("Error getting assets")
-		return s.RenderError("Error assigning roles", c)
+		log.WithError(err).Error("Error assigning roles")
+		return s.RenderError(c, errorKindOf(err))
 	}
 
 	return c.Redirect(302, "/end")
 }
 
-func (s Server) numberOfPolicyID(assets []nftkeyme.Asset) int {
-	count := 0
-	for _, asset := range assets {
-		if asset.PolicyId == s.PolicyIDCheck {
-			count++
-		}
-	}
-
-	return count
-}
-
 // RenderStart renders start page
 func (s Server) RenderStart(c echo.Context) error {
+	l := s.localizer(c)
 	start := struct {
+		L           i18n.Localizer
 		Title       string
 		Description string
 		Link        string
 	}{
-		Title:       "Zombie Chains Discord",
-		Description: "Gain access to Zombie Chains discord roles using NFT Key Me!",
+		L:           l,
+		Title:       l.T("start.title"),
+		Description: l.T("start.description"),
 		Link:        "/init",
 	}
 	err := c.Render(http.StatusOK, "start.html", start)
 	if err != nil {
-		logrus.WithError(err).Error("Error rendering start template")
+		requestLogger(c).WithError(err).Error("Error rendering start template")
 	}
 	return err
 }
 
 // RenderEnd renders end page
 func (s Server) RenderEnd(c echo.Context) error {
+	l := s.localizer(c)
 	start := struct {
+		L           i18n.Localizer
 		Description string
 		Link        string
 	}{
-		Description: "You can now access the Zombie Chains discord with special roles!",
-		Link:        "",
+		L:           l,
+		Description: l.T("end.description"),
+		Link:        "/account",
 	}
 	err := c.Render(http.StatusOK, "end.html", start)
 	if err != nil {
-		logrus.WithError(err).Error("Error rendering start template")
+		requestLogger(c).WithError(err).Error("Error rendering end template")
 	}
 	return err
 }
 
-// RenderError renders an error page
-func (s Server) RenderError(errorMsg string, c echo.Context) error {
+// RenderError renders an error page for the given kind of failure
+func (s Server) RenderError(c echo.Context, kind ErrorKind) error {
+	page, ok := errorPages[kind]
+	if !ok {
+		page = errorPages[ErrorKindInternal]
+	}
+	l := s.localizer(c)
 	errorEnd := struct {
-		Error string
+		L         i18n.Localizer
+		Title     string
+		Error     string
+		RetryLink string
+		RetryText string
+		RequestID string
 	}{
-		Error: errorMsg,
+		L:         l,
+		Title:     l.T(page.Key + ".title"),
+		Error:     l.T(page.Key + ".message"),
+		RetryLink: page.RetryLink,
+		RetryText: l.T(page.RetryKey),
+		RequestID: requestID(c),
 	}
-	err := c.Render(http.StatusOK, "error.html", errorEnd)
+	err := c.Render(page.Status, "error.html", errorEnd)
 	if err != nil {
-		logrus.WithError(err).Error("Error rendering start template")
+		requestLogger(c).WithError(err).Error("Error rendering error template")
 	}
 	return err
 }
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+)
+
+// nftkeymeCallback sends the redirect back from nftkeyme to the server, from the browser the
+// state's discord user logged in with
+func (env *testEnv) nftkeymeCallback(t *testing.T, query url.Values) *httptest.ResponseRecorder {
+	return env.nftkeymeCallbackAs(t, query, query.Get("state"))
+}
+
+// nftkeymeCallbackAs sends the redirect back from nftkeyme from the browser a discord user
+// logged in with, none if empty
+func (env *testEnv) nftkeymeCallbackAs(t *testing.T, query url.Values, sessionUser string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Renderer = testRenderer{}
+	req := httptest.NewRequest(http.MethodGet, "/nftkeyme?"+query.Encode(), nil)
+	if sessionUser != "" {
+		login := httptest.NewRecorder()
+		env.server.setSession(e.NewContext(req, login), sessionUser)
+		req.Header.Set("Cookie", login.Header().Get("Set-Cookie"))
+	}
+	rec := httptest.NewRecorder()
+
+	err := env.server.HandleNftkeymeAuthCode(e.NewContext(req, rec))
+	if err != nil {
+		t.Fatalf("handling callback: %v", err)
+	}
+	return rec
+}
+
+// linkAccount makes nftkeyme serve an account for the auth code and returns the callback query
+func (env *testEnv) linkAccount(discordUserID, nftkeymeID string, assets ...nftkeyme.Asset) url.Values {
+	code := "code-" + discordUserID + "-" + nftkeymeID
+	env.nftkeyme.SetUser(code, nftkeyme.FakeUser{
+		Info:   nftkeyme.UserInfo{ID: nftkeymeID, Email: nftkeymeID + "@example.com"},
+		Assets: assets,
+	})
+
+	return url.Values{"code": {code}, "state": {discordUserID}}
+}
+
+func TestHandleNftkeymeAuthCodeLinksAndAssignsRoles(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.discord.GuildMemberRoleAdd(testServerID, "user-1", testRoleWhale)
+
+	rec := env.nftkeymeCallback(t, env.linkAccount("user-1", "account-1", chains("a", "1"), hunter("b"), otherAsset("c")))
+
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/end" {
+		t.Fatalf("got %d to %q, want redirect to /end", rec.Code, rec.Header().Get("Location"))
+	}
+	link, ok := env.store.link("user-1", "account-1")
+	if !ok {
+		t.Fatal("link not stored")
+	}
+	if link.NumAssets.Int64 != 2 {
+		t.Errorf("link counted %d assets, want 2", link.NumAssets.Int64)
+	}
+	if !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("holder role not granted")
+	}
+	if env.discord.hasRole("user-1", testRoleWhale) {
+		t.Error("whale role not removed")
+	}
+}
+
+func TestHandleNftkeymeAuthCodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(env *testEnv) url.Values
+		status int
+		// session is the discord user logged in in the browser, the state's user if empty
+		// and none if "-"
+		session string
+	}{
+		{
+			name: "declined",
+			setup: func(env *testEnv) url.Values {
+				return url.Values{"error": {"access_denied"}, "state": {"user-1"}}
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "missing code",
+			setup: func(env *testEnv) url.Values {
+				return url.Values{"state": {"user-1"}}
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "code expired",
+			setup: func(env *testEnv) url.Values {
+				query := env.linkAccount("user-1", "account-1")
+				env.tokens.fail(query.Get("code"), http.StatusBadRequest, `{"error":"invalid_grant"}`)
+				return query
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "token endpoint rate limited",
+			setup: func(env *testEnv) url.Values {
+				query := env.linkAccount("user-1", "account-1")
+				env.tokens.fail(query.Get("code"), http.StatusTooManyRequests, `{"error":"rate_limited"}`)
+				return query
+			},
+			status: http.StatusBadGateway,
+		},
+		{
+			name: "client rejected",
+			setup: func(env *testEnv) url.Values {
+				query := env.linkAccount("user-1", "account-1")
+				env.tokens.fail(query.Get("code"), http.StatusUnauthorized, `{"error":"invalid_client"}`)
+				return query
+			},
+			status: http.StatusBadGateway,
+		},
+		{
+			name: "discord login missing",
+			setup: func(env *testEnv) url.Values {
+				return env.linkAccount("user-2", "account-1")
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "no discord session",
+			setup: func(env *testEnv) url.Values {
+				return env.linkAccount("user-1", "account-1")
+			},
+			status:  http.StatusBadRequest,
+			session: "-",
+		},
+		{
+			name: "state of another discord user",
+			setup: func(env *testEnv) url.Values {
+				env.addUser(t, "user-2")
+				return env.linkAccount("user-1", "account-1")
+			},
+			status:  http.StatusBadRequest,
+			session: "user-2",
+		},
+		{
+			name: "nftkeyme down",
+			setup: func(env *testEnv) url.Values {
+				query := env.linkAccount("user-1", "account-1")
+				env.nftkeyme.SetErr(errors.New("down"))
+				return query
+			},
+			status: http.StatusBadGateway,
+		},
+		{
+			name: "already linked elsewhere",
+			setup: func(env *testEnv) url.Values {
+				env.server.LinkPolicy = LinkPolicy{Mode: LinkPolicyExclusive, MaxDiscordUsers: 1}
+				env.addUser(t, "user-2")
+				env.addLink(t, "user-2", "account-1", chains("a", "1"))
+				return env.linkAccount("user-1", "account-1", chains("a", "1"))
+			},
+			status: http.StatusConflict,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.addUser(t, "user-1")
+
+			query := test.setup(env)
+			session := test.session
+			if session == "" {
+				session = query.Get("state")
+			} else if session == "-" {
+				session = ""
+			}
+			rec := env.nftkeymeCallbackAs(t, query, session)
+
+			if rec.Code != test.status {
+				t.Errorf("got status %d, want %d", rec.Code, test.status)
+			}
+			if rec.Body.String() != "error.html" {
+				t.Errorf("rendered %q, want the error page", rec.Body.String())
+			}
+			if _, ok := env.store.link("user-1", "account-1"); ok {
+				t.Error("account linked despite the error")
+			}
+		})
+	}
+}
+
+func TestHandleNftkeymeAuthCodeTransfersAccount(t *testing.T) {
+	env := newTestEnv(t)
+	env.server.LinkPolicy = LinkPolicy{Mode: LinkPolicyTransfer, MaxDiscordUsers: 1}
+	env.addUser(t, "user-1")
+	env.addUser(t, "user-2")
+	env.addLink(t, "user-2", "account-1", chains("a", "1"))
+	env.discord.GuildMemberRoleAdd(testServerID, "user-2", testRoleHolder)
+
+	rec := env.nftkeymeCallback(t, env.linkAccount("user-1", "account-1", chains("a", "1")))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("got status %d, want a redirect", rec.Code)
+	}
+	if _, ok := env.store.link("user-2", "account-1"); ok {
+		t.Error("previous link kept")
+	}
+	if env.discord.hasRole("user-2", testRoleHolder) {
+		t.Error("previous holder kept the role")
+	}
+	if !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("new holder didn't get the role")
+	}
+	if len(env.nftkeyme.Revoked()) != 1 {
+		t.Errorf("revoked %d tokens, want the previous link's", len(env.nftkeyme.Revoked()))
+	}
+	if len(env.discord.directMessages("user-2")) != 1 {
+		t.Error("previous holder not told about the transfer")
+	}
+}
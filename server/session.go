@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sessionCookieName   = "session"
+	sessionDuration     = time.Hour
+	unlinkTokenDuration = 15 * time.Minute
+)
+
+// setSession remembers the discord user who just logged in with a signed cookie
+func (s Server) setSession(c echo.Context, discordUserID string) {
+	expiry := time.Now().Add(sessionDuration)
+	payload := fmt.Sprintf("%s|%d", discordUserID, expiry.Unix())
+
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    payload + "|" + s.signSession(payload),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionUser returns the discord user id of a valid session, empty if there is none
+func (s Server) sessionUser(c echo.Context) string {
+	cookie, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+
+	parts := strings.Split(cookie.Value, "|")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload := parts[0] + "|" + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.signSession(payload))) {
+		return ""
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return ""
+	}
+
+	return parts[0]
+}
+
+// unlinkToken returns the token the unlink confirmation form posts back, it's only valid for
+// the same discord user and for a while
+func (s Server) unlinkToken(discordUserID string) string {
+	expiry := time.Now().Add(unlinkTokenDuration).Unix()
+	return fmt.Sprintf("%d|%s", expiry, s.signSession(fmt.Sprintf("unlink|%s|%d", discordUserID, expiry)))
+}
+
+// validUnlinkToken checks a token posted back from the unlink confirmation form
+func (s Server) validUnlinkToken(discordUserID, token string) bool {
+	parts := strings.Split(token, "|")
+	if len(parts) != 2 {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[1]), []byte(s.signSession(fmt.Sprintf("unlink|%s|%d", discordUserID, expiry))))
+}
+
+func (s Server) signSession(payload string) string {
+	mac := hmac.New(sha256.New, s.SessionSecret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/sirupsen/logrus"
+)
+
+// ReadinessDiscordSetup is the readiness check for the roles, permissions and channel the
+// bot needs in the server
+const ReadinessDiscordSetup = "discordSetup"
+
+type (
+	// Readiness holds the problems found by checks that keep the service from being ready,
+	// and warnings that don't
+	Readiness struct {
+		mu       sync.Mutex
+		problems map[string][]string
+		warnings map[string][]string
+		verified time.Time
+	}
+
+	// SetupProblems are what the discord setup check found. Fatal problems make assigning
+	// roles or posting fail, warnings only keep announcements from being posted
+	SetupProblems struct {
+		Fatal    []string
+		Warnings []string
+	}
+)
+
+// NewReadiness creates readiness with no problems
+func NewReadiness() *Readiness {
+	return &Readiness{problems: make(map[string][]string), warnings: make(map[string][]string)}
+}
+
+// Set replaces the problems and warnings found by a check, no problems means it passed
+func (r *Readiness) Set(check string, problems, warnings []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.problems, check)
+	delete(r.warnings, check)
+	if len(problems) > 0 {
+		r.problems[check] = problems
+	}
+	if len(warnings) > 0 {
+		r.warnings[check] = warnings
+	}
+}
+
+// Problems returns the problems of every failing check
+func (r *Readiness) Problems() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	problems := make(map[string][]string)
+	for check, checkProblems := range r.problems {
+		problems[check] = checkProblems
+	}
+
+	return problems
+}
+
+// Warnings returns the warnings of every check
+func (r *Readiness) Warnings() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	warnings := make(map[string][]string)
+	for check, checkWarnings := range r.warnings {
+		warnings[check] = checkWarnings
+	}
+
+	return warnings
+}
+
+// SetVerified records when a verification pass over every linked user finished
+func (r *Readiness) SetVerified(verified time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.verified = verified
+}
+
+// Verified returns when the last verification pass finished, zero if none has yet
+func (r *Readiness) Verified() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.verified
+}
+
+// CheckSetup checks the discord setup for the current role config and records the result
+// as readiness, returning false if there are fatal problems
+func (s Server) CheckSetup() bool {
+	problems := s.CheckDiscordSetup(s.roleConfig())
+	problems.Log()
+	s.Readiness.Set(ReadinessDiscordSetup, problems.Fatal, problems.Warnings)
+
+	return len(problems.Fatal) == 0
+}
+
+// Log logs fatal problems as errors and warnings as warnings
+func (p SetupProblems) Log() {
+	for _, problem := range p.Fatal {
+		logrus.Errorf("Discord setup: %s", problem)
+	}
+	for _, warning := range p.Warnings {
+		logrus.Warnf("Discord setup: %s", warning)
+	}
+}
+
+// MonitorSetup checks the discord setup every interval until the context is canceled, so
+// replicas that aren't verifying access report it too
+func (s Server) MonitorSetup(ctx context.Context, interval time.Duration) {
+	for {
+		s.CheckSetup()
+		if !lifecycle.Sleep(ctx, interval) {
+			return
+		}
+	}
+}
+
+// CheckDiscordSetup checks that every role of a role config exists and is below the bot's
+// highest role, that the bot can manage roles and that it can post in the channel. Anything
+// that makes assigning a role or posting fail is fatal, only embeds the channel doesn't
+// allow are a warning
+func (s Server) CheckDiscordSetup(rc RoleConfig) SetupProblems {
+	problems := SetupProblems{Fatal: make([]string, 0), Warnings: make([]string, 0)}
+
+	botUser, err := s.Discord.User("@me")
+	if err != nil {
+		problems.Fatal = append(problems.Fatal, fmt.Sprintf("Error getting bot user: %v", err))
+		return problems
+	}
+	guild, err := s.Discord.Guild(s.DiscordServerID)
+	if err != nil {
+		problems.Fatal = append(problems.Fatal, fmt.Sprintf("Error getting server %s: %v", s.DiscordServerID, err))
+		return problems
+	}
+	member, err := s.Discord.GuildMember(s.DiscordServerID, botUser.ID)
+	if err != nil {
+		problems.Fatal = append(problems.Fatal, fmt.Sprintf("Error getting bot member of server %s: %v", s.DiscordServerID, err))
+		return problems
+	}
+
+	guildRoles := make(map[string]*discordgo.Role)
+	for _, role := range guild.Roles {
+		guildRoles[role.ID] = role
+	}
+
+	// permissions from @everyone and the bot's roles, the owner can do anything
+	owner := guild.OwnerID == botUser.ID
+	var permissions int64
+	if everyone, ok := guildRoles[guild.ID]; ok {
+		permissions = everyone.Permissions
+	}
+	topPosition := 0
+	for _, roleID := range member.Roles {
+		role, ok := guildRoles[roleID]
+		if !ok {
+			continue
+		}
+		permissions |= role.Permissions
+		if role.Position > topPosition {
+			topPosition = role.Position
+		}
+	}
+	if !owner && permissions&discordgo.PermissionAdministrator == 0 && permissions&discordgo.PermissionManageRoles == 0 {
+		problems.Fatal = append(problems.Fatal, "Bot doesn't have the Manage Roles permission")
+	}
+
+	roleIDs := rc.managedRoleIDs()
+	sort.Strings(roleIDs)
+	for _, roleID := range roleIDs {
+		role, ok := guildRoles[roleID]
+		switch {
+		case !ok:
+			problems.Fatal = append(problems.Fatal, fmt.Sprintf("Role %s doesn't exist in the server", roleID))
+		case role.Managed:
+			problems.Fatal = append(problems.Fatal, fmt.Sprintf("Role %s (%s) is managed by an integration and can't be assigned", roleID, role.Name))
+		case !owner && role.Position >= topPosition:
+			problems.Fatal = append(problems.Fatal, fmt.Sprintf("Role %s (%s) isn't below the bot's highest role", roleID, role.Name))
+		}
+	}
+
+	channelPermissions, err := s.Discord.UserChannelPermissions(botUser.ID, s.DiscordChannelID)
+	if err != nil {
+		problems.Fatal = append(problems.Fatal, fmt.Sprintf("Error checking channel %s: %v", s.DiscordChannelID, err))
+	} else if channelPermissions&discordgo.PermissionViewChannel == 0 || channelPermissions&discordgo.PermissionSendMessages == 0 {
+		problems.Fatal = append(problems.Warnings, fmt.Sprintf("Bot can't send messages in channel %s", s.DiscordChannelID))
+	} else if channelPermissions&discordgo.PermissionEmbedLinks == 0 {
+		problems.Warnings = append(problems.Warnings, fmt.Sprintf("Bot can't post embeds in channel %s, needed for announcements", s.DiscordChannelID))
+	}
+
+	return problems
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCheckSetup(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(discord *fakeDiscord)
+		fatal    string
+		warning  string
+		verifies bool
+	}{
+		{
+			name:     "ok",
+			setup:    func(discord *fakeDiscord) {},
+			verifies: true,
+		},
+		{
+			name: "missing role",
+			setup: func(discord *fakeDiscord) {
+				discord.guildRoles = discord.guildRoles[1:]
+			},
+			fatal: "Role role-holder doesn't exist in the server",
+		},
+		{
+			name: "role managed by an integration",
+			setup: func(discord *fakeDiscord) {
+				discord.guildRoles[1].Managed = true
+			},
+			fatal: "Role role-whale (Whale) is managed by an integration",
+		},
+		{
+			name: "role above the bot",
+			setup: func(discord *fakeDiscord) {
+				discord.guildRoles[1].Position = 5
+			},
+			fatal: "Role role-whale (Whale) isn't below the bot's highest role",
+		},
+		{
+			name: "channel not writable",
+			setup: func(discord *fakeDiscord) {
+				discord.channelPermissions = discordgo.PermissionViewChannel
+			},
+			fatal: "Bot can't send messages in channel channel-1",
+		},
+		{
+			name: "no embeds",
+			setup: func(discord *fakeDiscord) {
+				discord.channelPermissions = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages
+			},
+			warning:  "Bot can't post embeds in channel channel-1",
+			verifies: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			test.setup(env.discord)
+
+			verifies := env.server.CheckSetup()
+			if verifies != test.verifies {
+				t.Errorf("got %t, want %t", verifies, test.verifies)
+			}
+
+			problems := env.server.Readiness.Problems()[ReadinessDiscordSetup]
+			if !containsPrefix(problems, test.fatal) {
+				t.Errorf("got problems %q, want %q", problems, test.fatal)
+			}
+			warnings := env.server.Readiness.Warnings()[ReadinessDiscordSetup]
+			if !containsPrefix(warnings, test.warning) {
+				t.Errorf("got warnings %q, want %q", warnings, test.warning)
+			}
+		})
+	}
+}
+
+// containsPrefix checks that one of the problems starts with prefix, or that there are none
+// if prefix is empty
+func containsPrefix(problems []string, prefix string) bool {
+	if prefix == "" {
+		return len(problems) == 0
+	}
+	for _, problem := range problems {
+		if strings.HasPrefix(problem, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/reliablestaking/nftkeyme-discord/snapshot"
+)
+
+// AdminExportSnapshot exports what every holder held on a date as csv or json
+func (s Server) AdminExportSnapshot(c echo.Context) error {
+	log := requestLogger(c)
+
+	day, err := snapshot.ParseDate(c.QueryParam("date"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = snapshot.FormatJSON
+	}
+	if format != snapshot.FormatJSON && format != snapshot.FormatCSV {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Unknown snapshot format %s", format))
+	}
+
+	holders, err := snapshot.Take(s.Store, day, snapshot.ParsePolicies(c.QueryParam("policy")))
+	if err != nil {
+		log.WithError(err).Error("Error taking snapshot")
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+
+	fileName := fmt.Sprintf("snapshot-%s.%s", day.Format(snapshot.DateLayout), format)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	if format == snapshot.FormatCSV {
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	} else {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+
+	return snapshot.Write(c.Response(), format, holders)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/snapshot"
+)
+
+type (
+	// Store is everything the server keeps in the database, a db.Store
+	Store interface {
+		UserStore
+		LinkStore
+		HistoryStore
+		GiveawayStore
+		AuditStore
+		Ping(ctx context.Context) error
+	}
+
+	// UserStore keeps the discord users who logged in
+	UserStore interface {
+		GetUserByDiscordID(discordUserID string) (*db.DiscordUser, error)
+		GetAllDiscordUsers() ([]db.DiscordUser, error)
+		GetLinkedDiscordUsers() ([]db.DiscordUser, error)
+		InsertDiscordUser(discordUserID, discordUsername, discordEmail string) error
+		UpdateDiscordUserNumAssets(discordUserID string, numAssets, numChains, numHunters int) error
+		UpdateDiscordUserLocale(discordUserID, locale string) error
+		UpdateDiscordUserDmOptOut(discordUserID string, optOut bool) error
+		UpdateDiscordUserLeaderboardOptOut(discordUserID string, optOut bool) error
+		DeleteDiscordUser(discordUserID string) error
+	}
+
+	// LinkStore keeps the nftkeyme accounts linked to discord users and their tokens
+	LinkStore interface {
+		GetNftkeymeLinks(discordUserID string) ([]db.NftkeymeLink, error)
+		GetNftkeymeLinksByNftkeymeID(nftkeymeID string) ([]db.NftkeymeLink, error)
+		UpsertNftkeymeLink(discordUserID, nftkeymeID, nftkeymeEmail, accessToken, refreshToken string, tokenExpiry time.Time, maxDiscordUsers int) (bool, error)
+		UpdateNftkeymeLinkToken(linkID int, accessToken, refreshToken string, tokenExpiry time.Time) error
+		UpdateNftkeymeLinkNumAssets(linkID int, numAssets int) error
+		SetNftkeymeLinkBroken(linkID int) error
+		DeleteNftkeymeLink(linkID int) error
+	}
+
+	// HistoryStore keeps what users held over time
+	HistoryStore interface {
+		snapshot.Store
+		RecordAssetHoldings(discordUserID string, holdings []db.AssetHolding, seenAt time.Time, release bool) error
+		GetAssetHoldings(discordUserID string) ([]db.AssetHolding, error)
+		InsertAssetSnapshot(discordUserID string, takenAt time.Time, numAssets int, assets []db.SnapshotAsset) error
+		GetAssetSnapshotsForDiscordUser(discordUserID string) ([]db.AssetSnapshot, error)
+	}
+
+	// GiveawayStore keeps giveaways and their entries
+	GiveawayStore interface {
+		InsertGiveaway(giveaway db.Giveaway, entries []db.GiveawayEntry) (int, error)
+		GetGiveaway(giveawayID int) (*db.Giveaway, error)
+		GetGiveaways() ([]db.Giveaway, error)
+		GetGiveawayEntries(giveawayID int) ([]db.GiveawayEntry, error)
+		GetGiveawayEntriesForDiscordUser(discordUserID string) ([]db.GiveawayEntry, error)
+		SetGiveawayDrawn(giveawayID int, seed string, winners []string) (bool, error)
+	}
+
+	// AuditStore keeps the audit trail
+	AuditStore interface {
+		InsertAuditEvent(action, discordUserID, actor, detail string) error
+		GetAuditEventsForDiscordUser(discordUserID string) ([]db.AuditEvent, error)
+	}
+
+	// DiscordAPI manages roles and sends messages in the server, a discordgo session
+	DiscordAPI interface {
+		User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error)
+		Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error)
+		UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error)
+		GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+		GuildMemberRoleAdd(guildID, userID, roleID string, options ...discordgo.RequestOption) error
+		GuildMemberRoleRemove(guildID, userID, roleID string, options ...discordgo.RequestOption) error
+		GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+		UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+		ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+		ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	}
+)
+
+var _ Store = db.Store{}
+var _ DiscordAPI = (*discordgo.Session)(nil)
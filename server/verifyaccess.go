@@ -1,90 +1,319 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"sort"
 	"time"
 
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/i18n"
+	"github.com/reliablestaking/nftkeyme-discord/lifecycle"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/reliablestaking/nftkeyme-discord/roles"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
-// VerifyAccess rechecks that users are allowed access
-func (s Server) VerifyAccess() {
+// errLinkBroken is returned for a link whose tokens were rejected, its assets aren't counted
+// until it is linked again
+var errLinkBroken = errors.New("Nftkeyme link is broken")
+
+// VerifyAccess rechecks that users are allowed access, each pass first checks the discord
+// setup and waits for it to be fixed if it has problems
+func (s Server) VerifyAccess(ctx context.Context) {
 	for true {
 		logrus.Info("Verifying access...")
-		discordUsers, err := s.Store.GetAllDiscordUsers()
+		if !s.CheckSetup() {
+			logrus.Error("Discord setup has problems, not verifying access until fixed")
+			if !lifecycle.Sleep(ctx, 5*time.Minute) {
+				return
+			}
+			continue
+		}
+
+		discordUsers, err := s.Store.GetLinkedDiscordUsers()
 		if err != nil {
 			logrus.WithError(err).Error("Error getting all users")
 		}
+		listed := err == nil
 
 		for _, discordUser := range discordUsers {
-			logrus.Infof("Verifying access for user %s", discordUser.DiscordUserID)
-			t := oauth2.Token{
-				RefreshToken: discordUser.NftkeymeRefreshToken.String,
-			}
+			log := logrus.WithField("discord_user_id", discordUser.DiscordUserID)
+			log.Infof("Verifying access for user %s", discordUser.DiscordUserID)
 
-			tokenSource := s.NftkeymeOauthConfig.TokenSource(oauth2.NoContext, &t)
-			newToken, err := tokenSource.Token()
+			// the user in progress is finished before stopping, up to the shutdown deadline
+			err = s.assignRoles(s.ShutdownDeadline(), log, discordUser.DiscordUserID)
 			if err != nil {
-				logrus.WithError(err).Error("Error getting token")
-				continue
+				log.WithError(err).Error("Error assigning roles")
 			}
 
-			if newToken.AccessToken != discordUser.NftkeymeAccessToken.String {
-				logrus.Infof("Updating discord user %s with new token", discordUser.DiscordUserID)
-				err = s.Store.UpdateDiscordUser(discordUser.DiscordUserID, newToken.AccessToken, newToken.RefreshToken)
-				if err != nil {
-					logrus.WithError(err).Error("Error updating discord user")
-					continue
-				}
+			if !lifecycle.Sleep(ctx, 5*time.Second) {
+				logrus.Info("Stopping access verification")
+				return
 			}
+		}
+		if listed {
+			s.Readiness.SetVerified(time.Now())
+		}
 
-			err = s.assignRoles(*newToken, discordUser.DiscordUserID)
-			if err != nil {
-				logrus.WithError(err).Error("Error assigning roles")
-				continue
-			}
+		if !lifecycle.Sleep(ctx, 24*time.Hour) {
+			return
+		}
+	}
+}
+
+// linkToken returns a usable access token for a link, refreshing and persisting it
+// when it has expired or its expiry is unknown
+func (s Server) linkToken(ctx context.Context, log *logrus.Entry, link db.NftkeymeLink) (*oauth2.Token, error) {
+	t := oauth2.Token{
+		RefreshToken: link.NftkeymeRefreshToken.String,
+	}
+	if link.TokenExpiry.Valid {
+		t.AccessToken = link.NftkeymeAccessToken.String
+		t.Expiry = link.TokenExpiry.Time
+	}
+
+	tokenSource := s.NftkeymeOauthConfig.TokenSource(ctx, &t)
+	newToken, err := tokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
 
-			time.Sleep(5 * time.Second)
+	if newToken.AccessToken != link.NftkeymeAccessToken.String {
+		log.Infof("Updating nftkeyme link %d with new token", link.ID)
+		err = s.Store.UpdateNftkeymeLinkToken(link.ID, newToken.AccessToken, newToken.RefreshToken, newToken.Expiry)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	return newToken, nil
+}
+
+// assetsForLink gets the assets held by a linked nftkeyme account across the checked policies
+func (s Server) assetsForLink(ctx context.Context, log *logrus.Entry, rc RoleConfig, link db.NftkeymeLink) ([]nftkeyme.Asset, error) {
+	policyIDs := rc.assetPolicies()
+	buckets, err := s.fetchAssets(ctx, log, link, policyIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make([]nftkeyme.Asset, 0)
+	for _, policyID := range policyIDs {
+		log.Infof("Found %d assets for policy id %s", len(buckets[policyID]), policyID)
+		assets = append(assets, buckets[policyID]...)
+	}
 
-		time.Sleep(24 * time.Hour)
+	err = s.Store.UpdateNftkeymeLinkNumAssets(link.ID, rc.countAssets(assets))
+	if err != nil {
+		log.WithError(err).Error("Error updating number of assets for link")
+		return nil, &flowError{Kind: ErrorKindStorage, Err: err}
 	}
+
+	return assets, nil
 }
 
-func (s Server) assignRoles(token oauth2.Token, discordUserID string) error {
-	assets, err := s.NftkeymeClient.GetAssetsForUser(token.AccessToken, s.PolicyIDCheck)
+// fetchAssets gets the assets of a linked nftkeyme account by policy. Policies not cached
+// are fetched one at a time with the policy filter, so the response cap only counts the
+// assets of that policy
+func (s Server) fetchAssets(ctx context.Context, log *logrus.Entry, link db.NftkeymeLink, policyIDs []string) (map[string][]nftkeyme.Asset, error) {
+	buckets, missing := s.cachedAssets(ctx, log, link.NftkeymeID, policyIDs)
+	if len(missing) == 0 {
+		log.Info("Using cached assets")
+		return buckets, nil
+	}
+
+	token, err := s.linkToken(ctx, log, link)
 	if err != nil {
-		logrus.WithError(err).Error("Error getting assets")
-		return err
+		log.WithError(err).Errorf("Error getting token for nftkeyme link %d", link.ID)
+		if exchangeErrorKind(err, ErrorKindNftkeymeUnavailable) == ErrorKindCodeExpired {
+			s.linkBroken(log, link)
+			return nil, errLinkBroken
+		}
+		return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+	}
+
+	fetched := make(map[string][]nftkeyme.Asset)
+	for _, policyID := range missing {
+		if _, ok := fetched[policyID]; ok {
+			continue
+		}
+
+		assets, err := s.NftkeymeClient.GetAssetsForUser(ctx, token.AccessToken, policyID)
+		if err != nil {
+			log.WithError(err).Errorf("Error getting assets of policy %s", policyID)
+			return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+		}
+		// assets of other policies are left out in case the filter isn't applied
+		fetched[policyID] = nftkeyme.BucketByPolicy(assets, []string{policyID})[policyID]
+		buckets[policyID] = fetched[policyID]
 	}
-	logrus.Infof("Found %d chains", len(assets))
+	s.cacheAssets(ctx, log, link.NftkeymeID, fetched)
+
+	return buckets, nil
+}
 
-	assetsHunters, err := s.NftkeymeClient.GetAssetsForUser(token.AccessToken, s.PolicyIDCheckHunters)
+// linkBroken records that a link's tokens were rejected and tells the user the first time
+func (s Server) linkBroken(log *logrus.Entry, link db.NftkeymeLink) {
+	if link.BrokenAt.Valid {
+		return
+	}
+
+	err := s.Store.SetNftkeymeLinkBroken(link.ID)
 	if err != nil {
-		logrus.WithError(err).Error("Error getting assets")
-		return err
+		log.WithError(err).Error("Error marking nftkeyme link as broken")
+		return
+	}
+
+	s.notifyUser(log, link.DiscordUserID, func(l i18n.Localizer) string {
+		return l.T("dm.link_broken", link.NftkeymeEmail.String)
+	})
+}
+
+// countsForLink counts the assets of policies only count rules look at, without fetching
+// their metadata
+func (s Server) countsForLink(ctx context.Context, log *logrus.Entry, link db.NftkeymeLink, policyIDs []string) (map[string]nftkeyme.AssetCount, error) {
+	token, err := s.linkToken(ctx, log, link)
+	if err != nil {
+		log.WithError(err).Errorf("Error getting token for nftkeyme link %d", link.ID)
+		return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+	}
+
+	counts := make(map[string]nftkeyme.AssetCount)
+	for _, policyID := range policyIDs {
+		count, err := s.NftkeymeClient.CountAssetsForUser(ctx, token.AccessToken, policyID)
+		if err != nil {
+			log.WithError(err).Error("Error counting assets")
+			return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+		}
+		log.Infof("Counted %d assets for policy id %s", count.Assets, policyID)
+		counts[policyID] = count
+	}
+
+	return counts, nil
+}
+
+// stakeAddressesForLink gets the stake keys of a linked nftkeyme account
+func (s Server) stakeAddressesForLink(ctx context.Context, log *logrus.Entry, link db.NftkeymeLink) ([]string, error) {
+	token, err := s.linkToken(ctx, log, link)
+	if err != nil {
+		log.WithError(err).Errorf("Error getting token for nftkeyme link %d", link.ID)
+		return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+	}
+
+	stakeKeys, err := s.NftkeymeClient.GetStakeKeysForUser(ctx, token.AccessToken)
+	if err != nil {
+		log.WithError(err).Error("Error getting stake keys")
+		return nil, &flowError{Kind: ErrorKindNftkeymeUnavailable, Err: err}
+	}
+
+	stakeAddresses := make([]string, 0)
+	for _, stakeKey := range stakeKeys {
+		stakeAddresses = append(stakeAddresses, stakeKey.StakeAddress)
 	}
+	log.Infof("Found %d stake keys", len(stakeAddresses))
+
+	return stakeAddresses, nil
+}
+
+// assignRoles counts assets across every nftkeyme account linked to the user and
+// assigns the matching role
+func (s Server) assignRoles(ctx context.Context, log *logrus.Entry, discordUserID string) error {
+	// one config for the whole verification even if it's reloaded meanwhile
+	rc := s.roleConfig()
+
+	links, err := s.Store.GetNftkeymeLinks(discordUserID)
+	if err != nil {
+		log.WithError(err).Error("Error getting nftkeyme links")
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+
+	assets := make([]nftkeyme.Asset, 0)
+	stakeAddresses := make([]string, 0)
+	countPolicies := rc.countPolicies()
+	policyCounts := make(map[string]nftkeyme.AssetCount)
+	complete := true
+	for _, link := range links {
+		counts, err := s.linkCounts(link)
+		if err != nil {
+			log.WithError(err).Error("Error checking link policy")
+			return &flowError{Kind: ErrorKindStorage, Err: err}
+		}
+		if !counts {
+			log.Warnf("Nftkeyme account %s is linked to too many discord users, not counting its assets", link.NftkeymeID)
+			complete = false
+			continue
+		}
+		if link.BrokenAt.Valid {
+			log.Warnf("Nftkeyme link %d is broken, not counting its assets", link.ID)
+			complete = false
+			continue
+		}
+
+		linkAssets, err := s.assetsForLink(ctx, log.WithField("nftkeyme_id", link.NftkeymeID), rc, link)
+		if errors.Is(err, errLinkBroken) {
+			complete = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		assets = append(assets, linkAssets...)
+
+		if len(countPolicies) > 0 {
+			linkCounts, err := s.countsForLink(ctx, log.WithField("nftkeyme_id", link.NftkeymeID), link, countPolicies)
+			if err != nil {
+				return err
+			}
+			for policyID, count := range linkCounts {
+				policyCounts[policyID] = policyCounts[policyID].Add(count)
+			}
+		}
 
-	logrus.Infof("Found %d hunters", len(assetsHunters))
-	assets = append(assets, assetsHunters...)
+		if rc.RoleEngine.UsesSource(roles.SourceDelegation) {
+			linkStakeAddresses, err := s.stakeAddressesForLink(ctx, log.WithField("nftkeyme_id", link.NftkeymeID), link)
+			if err != nil {
+				return err
+			}
+			stakeAddresses = append(stakeAddresses, linkStakeAddresses...)
+		}
+	}
 
-	logrus.Infof("Found %d total assets for user %s", len(assets), discordUserID)
+	log.Infof("Found %d total assets across %d linked accounts for user %s", len(assets), len(links), discordUserID)
 
 	//check for policy id
-	numAssets := len(assets)
-	logrus.Infof("Found %d assets for policy id %s", numAssets, s.PolicyIDCheck)
+	numAssets := rc.countAssets(assets)
+	log.Infof("Counted %d collection assets", numAssets)
 
-	// update num roles
-	err = s.Store.UpdateDiscordUserNumAssets(discordUserID, numAssets)
+	history, err := s.recordHoldings(log, discordUserID, assets, complete)
 	if err != nil {
-		logrus.WithError(err).Error("Error updating number of assets")
 		return err
 	}
+	err = s.recordSnapshot(log, discordUserID, assets, numAssets)
+	if err != nil {
+		return err
+	}
+
+	discordUser, err := s.Store.GetUserByDiscordID(discordUserID)
+	if err != nil {
+		log.WithError(err).Error("Error getting discord user")
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
+	change := rc.compareTiers(discordUser, numAssets)
+	change.Chains = countPolicyAssets(assets, rc.PolicyIDCheck)
+	change.Hunters = countPolicyAssets(assets, rc.PolicyIDCheckHunters)
+
+	// update num roles
+	err = s.Store.UpdateDiscordUserNumAssets(discordUserID, numAssets, change.Chains, change.Hunters)
+	if err != nil {
+		log.WithError(err).Error("Error updating number of assets")
+		return &flowError{Kind: ErrorKindStorage, Err: err}
+	}
 
 	// manage roles
 	keys := make([]int, 0)
-	for k, _ := range s.RoleMap {
+	for k, _ := range rc.RoleMap {
 		keys = append(keys, k)
 	}
 	sort.Sort(sort.Reverse(sort.IntSlice(keys)))
@@ -92,22 +321,116 @@ func (s Server) assignRoles(token oauth2.Token, discordUserID string) error {
 	roleFound := false
 	for _, k := range keys {
 		if numAssets >= k && !roleFound {
-			logrus.Infof("Adding user %s to role %s", discordUserID, s.RoleMap[k])
-			err = s.DiscordSession.GuildMemberRoleAdd(s.DiscordServerID, discordUserID, s.RoleMap[k])
-			if err != nil {
-				logrus.WithError(err).Error("Error adding user to role")
-				return err
-			}
+			err = s.setRole(log, discordUserID, rc.RoleMap[k], true)
 			roleFound = true
 		} else {
-			logrus.Infof("Removing user %s from role %s", discordUserID, s.RoleMap[k])
-			err = s.DiscordSession.GuildMemberRoleRemove(s.DiscordServerID, discordUserID, s.RoleMap[k])
-			if err != nil {
-				logrus.WithError(err).Error("Error removing user from role")
-				return err
+			err = s.setRole(log, discordUserID, rc.RoleMap[k], false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// rule roles are independent of the tier above
+	holder := roles.Holder{
+		Assets:         assets,
+		Rarity:         rc.Rarity,
+		StakeAddresses: stakeAddresses,
+		History:        history,
+		Counts:         policyCounts,
+	}
+	grants, err := rc.RoleEngine.Evaluate(ctx, holder)
+	if err != nil {
+		log.WithError(err).Error("Error evaluating role rules")
+		return &flowError{Kind: ErrorKindInternal, Err: err}
+	}
+	for _, roleID := range rc.RoleEngine.RoleIDs() {
+		log.Infof("Role rules for role %s matched %t", roleID, grants[roleID])
+		err = s.setRole(log, discordUserID, roleID, grants[roleID])
+		if err != nil {
+			return err
+		}
+	}
+
+	s.announceTierChange(discordUser, change)
+	if change.Upgrade || change.Downgrade {
+		s.notifyTierChange(log, discordUserID, change)
+	}
+
+	return nil
+}
+
+// assetPolicies returns the policies to query, the collections counted for tiers and
+// any policy a role rule is limited to
+func (rc RoleConfig) assetPolicies() []string {
+	policyIDs := []string{rc.PolicyIDCheck, rc.PolicyIDCheckHunters}
+	for _, rulePolicyID := range rc.RoleEngine.Policies() {
+		found := false
+		for _, policyID := range policyIDs {
+			if policyID == rulePolicyID {
+				found = true
+			}
+		}
+		if !found {
+			policyIDs = append(policyIDs, rulePolicyID)
+		}
+	}
+
+	return policyIDs
+}
+
+// countPolicies returns the policies only count rules look at, those of the collections
+// counted for tiers are fetched in full anyway
+func (rc RoleConfig) countPolicies() []string {
+	policyIDs := make([]string, 0)
+	for _, policyID := range rc.RoleEngine.CountPolicies() {
+		if policyID != rc.PolicyIDCheck && policyID != rc.PolicyIDCheckHunters {
+			policyIDs = append(policyIDs, policyID)
+		}
+	}
+
+	return policyIDs
+}
+
+// countAssets counts the collection assets for tiers, honoring quantity so semi fungible
+// assets held more than once count more than once
+func (rc RoleConfig) countAssets(assets []nftkeyme.Asset) int {
+	return countPolicyAssets(assets, rc.PolicyIDCheck, rc.PolicyIDCheckHunters)
+}
+
+// countPolicyAssets counts the assets of some policies like the count path does, honoring
+// quantity, so the tier and leaderboard counts match what counting them at nftkeyme gives
+func countPolicyAssets(assets []nftkeyme.Asset, policyIDs ...string) int {
+	policyAssets := make([]nftkeyme.Asset, 0)
+	for _, asset := range assets {
+		for _, policyID := range policyIDs {
+			if asset.PolicyId == policyID {
+				policyAssets = append(policyAssets, asset)
+				break
 			}
 		}
 	}
 
+	return int(nftkeyme.CountAssets(policyAssets).Total())
+}
+
+// setRole adds or removes a managed role for the user
+func (s Server) setRole(log *logrus.Entry, discordUserID, roleID string, grant bool) error {
+	if grant {
+		log.Infof("Adding user %s to role %s", discordUserID, roleID)
+		err := s.Discord.GuildMemberRoleAdd(s.DiscordServerID, discordUserID, roleID)
+		if err != nil {
+			log.WithError(err).Error("Error adding user to role")
+			return &flowError{Kind: discordErrorKind(err), Err: err}
+		}
+		return nil
+	}
+
+	log.Infof("Removing user %s from role %s", discordUserID, roleID)
+	err := s.Discord.GuildMemberRoleRemove(s.DiscordServerID, discordUserID, roleID)
+	if err != nil {
+		log.WithError(err).Error("Error removing user from role")
+		return &flowError{Kind: discordErrorKind(err), Err: err}
+	}
 	return nil
 }
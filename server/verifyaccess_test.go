@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+	"github.com/reliablestaking/nftkeyme-discord/roles"
+	"github.com/sirupsen/logrus"
+)
+
+// assignRoles verifies a user like the daily verification does
+func (env *testEnv) assignRoles(discordUserID string) error {
+	return env.server.assignRoles(context.Background(), logrus.WithField("discord_user_id", discordUserID), discordUserID)
+}
+
+func TestAssignRolesCountsEveryLink(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "3"), otherAsset("x"))
+	env.addLink(t, "user-1", "account-2", hunter("b"), hunter("c"))
+	env.discord.GuildMemberRoleAdd(testServerID, "user-1", testRoleHolder)
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := env.store.GetUserByDiscordID("user-1")
+	if user.NumAssets.Int64 != 5 {
+		t.Errorf("counted %d assets, want 5", user.NumAssets.Int64)
+	}
+	if !env.discord.hasRole("user-1", testRoleWhale) {
+		t.Error("whale role not granted")
+	}
+	if env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("lower tier role kept")
+	}
+	if len(env.discord.directMessages("user-1")) != 0 {
+		t.Error("first verification shouldn't message the user")
+	}
+}
+
+func TestAssignRolesTierChangeMessagesUser(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.store.UpdateDiscordUserNumAssets("user-1", 1, 1, 0)
+	env.addLink(t, "user-1", "account-1", chains("a", "5"))
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := env.discord.directMessages("user-1")
+	if len(messages) != 1 || !strings.Contains(messages[0], "from Holder to Whale") {
+		t.Errorf("got messages %q, want one about the upgrade", messages)
+	}
+}
+
+func TestAssignRolesSkipsBrokenLinks(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"))
+	env.addLink(t, "user-1", "account-2", chains("b", "4"))
+	env.discord.GuildMemberRoleAdd(testServerID, "user-1", testRoleWhale)
+	link := env.expireLink(t, "user-1", "account-2")
+	env.tokens.fail(link.NftkeymeRefreshToken.String, http.StatusBadRequest, `{"error":"invalid_grant","error_description":"revoked"}`)
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, _ = env.store.link("user-1", "account-2")
+	if !link.BrokenAt.Valid {
+		t.Error("link not marked broken")
+	}
+	if len(env.discord.directMessages("user-1")) != 1 {
+		t.Error("user not told about the broken link")
+	}
+	if env.discord.hasRole("user-1", testRoleWhale) || !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("roles not recalculated from the remaining link")
+	}
+
+	// already broken links are skipped without asking for a token again
+	requests := env.tokens.requestCount()
+	err = env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.tokens.requestCount() != requests {
+		t.Error("token refreshed for a broken link")
+	}
+	if len(env.discord.directMessages("user-1")) != 1 {
+		t.Error("user told about the broken link again")
+	}
+}
+
+func TestAssignRolesKeepsHoldingsOfSkippedLinks(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"))
+	env.addLink(t, "user-1", "account-2", chains("b", "1"))
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held := func() map[string]bool {
+		holdings, _ := env.store.GetAssetHoldings("user-1")
+		held := make(map[string]bool)
+		for _, holding := range holdings {
+			held[holding.AssetName] = holding.Held
+		}
+		return held
+	}
+
+	link := env.expireLink(t, "user-1", "account-2")
+	env.tokens.fail(link.NftkeymeRefreshToken.String, http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	err = env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held()["b"] {
+		t.Error("asset of a broken link released")
+	}
+
+	// with every link fetched assets that are gone are released
+	env.store.DeleteNftkeymeLink(link.ID)
+	err = env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := held(); held["b"] || !held["a"] {
+		t.Errorf("got holdings %v, want only a held", held)
+	}
+}
+
+func TestAssignRolesProviderErrorsDontBreakLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"rate limited", http.StatusTooManyRequests, `{"error":"rate_limited"}`},
+		{"client rejected", http.StatusUnauthorized, `{"error":"invalid_client"}`},
+		{"bad request", http.StatusBadRequest, `{"error":"invalid_request"}`},
+		{"server error", http.StatusInternalServerError, `oops`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.addUser(t, "user-1")
+			env.addLink(t, "user-1", "account-1", chains("a", "5"))
+			env.discord.GuildMemberRoleAdd(testServerID, "user-1", testRoleWhale)
+			link := env.expireLink(t, "user-1", "account-1")
+			env.tokens.fail(link.NftkeymeRefreshToken.String, test.status, test.body)
+
+			err := env.assignRoles("user-1")
+			if errorKindOf(err) != ErrorKindNftkeymeUnavailable {
+				t.Errorf("got %v, want nftkeyme unavailable", err)
+			}
+
+			link, _ = env.store.link("user-1", "account-1")
+			if link.BrokenAt.Valid {
+				t.Error("link marked broken")
+			}
+			if len(env.discord.directMessages("user-1")) != 0 {
+				t.Error("user messaged")
+			}
+			if !env.discord.hasRole("user-1", testRoleWhale) {
+				t.Error("roles changed without knowing the assets")
+			}
+		})
+	}
+}
+
+func TestAssignRolesRefreshesExpiredToken(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"))
+	link := env.expireLink(t, "user-1", "account-1")
+	refreshed := "refreshed-" + link.NftkeymeRefreshToken.String
+	env.nftkeyme.SetUser(refreshed, nftkeyme.FakeUser{Assets: []nftkeyme.Asset{chains("a", "1")}})
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, _ = env.store.link("user-1", "account-1")
+	if link.NftkeymeAccessToken.String != refreshed {
+		t.Errorf("stored token %q, want the refreshed one", link.NftkeymeAccessToken.String)
+	}
+	if !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("holder role not granted")
+	}
+}
+
+func TestAssignRolesLinkPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	env.server.LinkPolicy = LinkPolicy{Mode: LinkPolicyExclusive, MaxDiscordUsers: 1}
+	env.addUser(t, "user-1")
+	env.addUser(t, "user-2")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"))
+	env.addLink(t, "user-2", "account-1", chains("a", "1"))
+
+	for _, discordUserID := range []string{"user-1", "user-2"} {
+		err := env.assignRoles(discordUserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("first link didn't count")
+	}
+	if env.discord.hasRole("user-2", testRoleHolder) {
+		t.Error("second link of an exclusive account counted")
+	}
+}
+
+// fetchRecorder records the policies whose assets are fetched in full
+type fetchRecorder struct {
+	*nftkeyme.Fake
+	fetched []string
+}
+
+func (f *fetchRecorder) GetAssetsForUser(ctx context.Context, token string, policyID string) ([]nftkeyme.Asset, error) {
+	f.fetched = append(f.fetched, policyID)
+	return f.Fake.GetAssetsForUser(ctx, token, policyID)
+}
+
+func TestAssignRolesCountOnlyRules(t *testing.T) {
+	env := newTestEnv(t)
+	rules, err := roles.CompileRules([]roles.Rule{{Name: "other", RoleID: "role-other", Policy: "policy-other", Min: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := roles.NewEngine(rules, roles.AssetSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := env.server.roleConfig()
+	rc.RoleEngine = engine
+	env.server.Roles = NewRoleConfigs(rc)
+	recorder := &fetchRecorder{Fake: env.nftkeyme}
+	env.server.NftkeymeClient = recorder
+
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"), otherAsset("x"))
+	env.addLink(t, "user-1", "account-2", otherAsset("y"))
+
+	err = env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.discord.hasRole("user-1", "role-other") {
+		t.Error("count rule didn't add up the assets of both links")
+	}
+	for _, policyID := range recorder.fetched {
+		if policyID == "policy-other" {
+			t.Error("assets of a policy only a count rule looks at fetched in full")
+		}
+	}
+}
+
+func TestAssignRolesFetchesByPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	recorder := &fetchRecorder{Fake: env.nftkeyme}
+	env.server.NftkeymeClient = recorder
+
+	env.addUser(t, "user-1")
+	env.addLink(t, "user-1", "account-1", chains("a", "1"), hunter("b"), otherAsset("x"))
+
+	err := env.assignRoles("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(recorder.fetched)
+	want := []string{testPolicyChains, testPolicyHunter}
+	sort.Strings(want)
+	if !reflect.DeepEqual(recorder.fetched, want) {
+		t.Errorf("fetched policies %v, want %v", recorder.fetched, want)
+	}
+	if !env.discord.hasRole("user-1", testRoleHolder) {
+		t.Error("holder role not added from the assets fetched by policy")
+	}
+}
@@ -0,0 +1,150 @@
+package snapshot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/nftkeyme"
+)
+
+const (
+	// FormatCSV writes one row per asset
+	FormatCSV = "csv"
+	// FormatJSON writes one object per holder
+	FormatJSON = "json"
+
+	// DateLayout is the layout of snapshot dates
+	DateLayout = "2006-01-02"
+)
+
+// Store reads the snapshots recorded at each verification, a db.Store
+type Store interface {
+	GetAssetSnapshotsBefore(before time.Time) ([]db.AssetSnapshot, error)
+}
+
+// Holder is what a discord user held at the end of a day
+type Holder struct {
+	DiscordUserID string             `json:"discordUserId"`
+	TakenAt       time.Time          `json:"takenAt"`
+	Assets        []db.SnapshotAsset `json:"assets"`
+}
+
+// Count adds up the quantities of the holder's assets the way verification counts them
+func (h Holder) Count() int64 {
+	assets := make([]nftkeyme.Asset, 0)
+	for _, asset := range h.Assets {
+		assets = append(assets, nftkeyme.Asset{PolicyId: asset.PolicyID, Quantity: asset.Quantity})
+	}
+
+	return nftkeyme.CountAssets(assets).Total()
+}
+
+// ParseDate parses a snapshot date, empty is today
+func ParseDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour), nil
+	}
+
+	day, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid snapshot date %s, expected %s", date, DateLayout)
+	}
+
+	return day, nil
+}
+
+// ParsePolicies splits a comma separated list of policy ids
+func ParsePolicies(policies string) []string {
+	policyIDs := make([]string, 0)
+	for _, policyID := range strings.Split(policies, ",") {
+		policyID = strings.TrimSpace(policyID)
+		if policyID != "" {
+			policyIDs = append(policyIDs, policyID)
+		}
+	}
+
+	return policyIDs
+}
+
+// Take returns every user's assets as of the last verification on or before the day (UTC),
+// limited to the policies if any. Users without assets are left out
+func Take(store Store, day time.Time, policyIDs []string) ([]Holder, error) {
+	snapshots, err := store.GetAssetSnapshotsBefore(day.Truncate(24 * time.Hour).Add(24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]bool)
+	for _, policyID := range policyIDs {
+		policies[policyID] = true
+	}
+
+	holders := make([]Holder, 0)
+	for _, snapshot := range snapshots {
+		assets, err := snapshot.SnapshotAssets()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading snapshot %d: %v", snapshot.ID, err)
+		}
+
+		holder := Holder{
+			DiscordUserID: snapshot.DiscordUserID,
+			TakenAt:       snapshot.TakenAt,
+			Assets:        make([]db.SnapshotAsset, 0),
+		}
+		for _, asset := range assets {
+			if len(policies) == 0 || policies[asset.PolicyID] {
+				holder.Assets = append(holder.Assets, asset)
+			}
+		}
+		if len(holder.Assets) > 0 {
+			holders = append(holders, holder)
+		}
+	}
+
+	return holders, nil
+}
+
+// Write writes holders as csv or json
+func Write(w io.Writer, format string, holders []Holder) error {
+	switch format {
+	case FormatCSV:
+		return WriteCSV(w, holders)
+	case FormatJSON, "":
+		return WriteJSON(w, holders)
+	}
+
+	return fmt.Errorf("Unknown snapshot format %s", format)
+}
+
+// WriteCSV writes a header and one row per asset held
+func WriteCSV(w io.Writer, holders []Holder) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"discord_user_id", "taken_at", "policy_id", "asset_name", "quantity"})
+	if err != nil {
+		return err
+	}
+
+	for _, holder := range holders {
+		for _, asset := range holder.Assets {
+			err = writer.Write([]string{holder.DiscordUserID, holder.TakenAt.Format(time.RFC3339), asset.PolicyID, asset.AssetName, asset.Quantity})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSON writes the holders as a json list
+func WriteJSON(w io.Writer, holders []Holder) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(holders)
+}
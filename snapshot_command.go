@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/reliablestaking/nftkeyme-discord/db"
+	"github.com/reliablestaking/nftkeyme-discord/snapshot"
+	"github.com/sirupsen/logrus"
+)
+
+// runSnapshotCommand exports a holder snapshot, e.g. snapshot -date 2021-10-01 -format csv
+func runSnapshotCommand(store db.Store, args []string) {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	date := flags.String("date", "", "day to export holders for, yyyy-mm-dd in UTC, default today")
+	format := flags.String("format", snapshot.FormatCSV, "csv or json")
+	policies := flags.String("policy", "", "comma separated policy ids to include, default all")
+	out := flags.String("out", "", "file to write to, default stdout")
+	flags.Parse(args)
+
+	day, err := snapshot.ParseDate(*date)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error parsing date")
+	}
+
+	holders, err := snapshot.Take(store, day, snapshot.ParsePolicies(*policies))
+	if err != nil {
+		logrus.WithError(err).Fatal("Error taking snapshot")
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error creating snapshot file")
+		}
+		defer file.Close()
+		w = file
+	}
+
+	err = snapshot.Write(w, *format, holders)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error writing snapshot")
+	}
+	logrus.Infof("Exported %d holders as of %s", len(holders), day.Format(snapshot.DateLayout))
+}